@@ -0,0 +1,51 @@
+package api
+
+import (
+	"github.com/cenkalti/backoff"
+	"log"
+)
+
+// Quota describes the storage available to the Drive account.
+type Quota struct {
+	// Limit is the number of bytes the account may store. It's zero if the
+	// account has unlimited storage.
+	Limit uint64
+
+	// Usage is the number of bytes used across all Google services, including
+	// files that weren't created by fusedrive.
+	Usage uint64
+}
+
+// Unlimited returns true if the account has no storage limit.
+func (q Quota) Unlimited() bool {
+	return q.Limit == 0
+}
+
+// GetQuota returns the storage quota of the Drive account.
+func (d *DriveApi) GetQuota() (Quota, error) {
+	var quota Quota
+
+	call := func() error {
+		log.Print("Calling About.Get")
+		about, err := d.Service.About.Get().Fields("storageQuota").Do()
+		if err != nil {
+			log.Printf("About.Get response error: %v", err)
+			return retryable(err)
+		}
+
+		if about.StorageQuota != nil {
+			quota = Quota{
+				Limit: uint64(about.StorageQuota.Limit),
+				Usage: uint64(about.StorageQuota.Usage),
+			}
+		}
+
+		// Success.
+		return nil
+	}
+
+	// Keep attempting the call until it succeeds, or we fail with a permanent
+	// error.
+	err := backoff.Retry(call, backoff.NewExponentialBackOff())
+	return quota, err
+}
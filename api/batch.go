@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/cenkalti/backoff"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// batchSize is the number of requests sent in each batch. This is the maximum
+// that Drive allows.
+const batchSize = 100
+
+// GetFiles returns the metadata for each of the files with the given ids,
+// keyed by id. Files that don't exist are left out. The requests are sent in
+// batches of batchSize, or one at a time if Client isn't set.
+func (d *DriveApi) GetFiles(ids []string) (map[string]RemoteFile, error) {
+	files := make(map[string]RemoteFile)
+
+	if d.Client == nil {
+		for _, id := range ids {
+			file, err := d.GetFile(id)
+			if IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			files[id] = file
+		}
+		return files, nil
+	}
+
+	for len(ids) > 0 {
+		batch := ids[:min(uint64(len(ids)), batchSize)]
+		ids = ids[len(batch):]
+
+		call := func() error {
+			err := d.getBatch(batch, files)
+			if err != nil {
+				log.Printf("Batch response error: %v", err)
+				return retryable(err)
+			}
+
+			// Success.
+			return nil
+		}
+
+		// Keep attempting the call until it succeeds, or we fail with a
+		// permanent error.
+		err := backoff.Retry(call, backoff.NewExponentialBackOff())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// batchUrl returns the endpoint that batches of Drive requests are sent to.
+func (d *DriveApi) batchUrl() (*url.URL, error) {
+	base, err := url.Parse(d.Service.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	return base.Parse("/batch" + strings.TrimSuffix(base.Path, "/"))
+}
+
+// getBatch fetches the metadata of the given files in a single batch request,
+// adding those that exist to files.
+func (d *DriveApi) getBatch(ids []string, files map[string]RemoteFile) error {
+	log.Printf("Calling Files.Get metadata for a batch of %d files", len(ids))
+
+	endpoint, err := d.batchUrl()
+	if err != nil {
+		return err
+	}
+	base, err := url.Parse(d.Service.BasePath)
+	if err != nil {
+		return err
+	}
+
+	// Each part of the request holds a request for one file, and is answered
+	// by the part of the response with the same Content-ID.
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for i, id := range ids {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {"<" + strconv.Itoa(i) + ">"},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(part, "GET %sfiles/%s?fields=%s HTTP/1.1\r\n\r\n",
+			base.Path, url.PathEscape(id), url.QueryEscape(remoteFileFields))
+	}
+	if err := parts.Close(); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", endpoint.String(), &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type",
+		"multipart/mixed; boundary="+parts.Boundary())
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := googleapi.CheckResponse(response); err != nil {
+		return err
+	}
+
+	_, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	reader := multipart.NewReader(response.Body, params["boundary"])
+	answered := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		i, err := strconv.Atoi(strings.TrimPrefix(strings.Trim(
+			part.Header.Get("Content-ID"), "<>"), "response-"))
+		if err != nil || i < 0 || i >= len(ids) {
+			return fmt.Errorf("unexpected batch response part %q",
+				part.Header.Get("Content-ID"))
+		}
+
+		if err := readBatchResponse(part, ids[i], files); err != nil {
+			return err
+		}
+		answered++
+	}
+
+	// A response that doesn't answer every request is retried.
+	if answered != len(ids) {
+		return fmt.Errorf("batch response answered %d of %d requests",
+			answered, len(ids))
+	}
+	return nil
+}
+
+// readBatchResponse reads the response to a request for the metadata of the
+// file with the given id, adding it to files if it exists.
+func readBatchResponse(part *multipart.Part, id string,
+	files map[string]RemoteFile) error {
+	response, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if err := googleapi.CheckResponse(response); err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	var f drive.File
+	if err := json.NewDecoder(response.Body).Decode(&f); err != nil {
+		return err
+	}
+	file, err := toRemoteFile(&f)
+	if err != nil {
+		return err
+	}
+	files[id] = file
+	return nil
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/simonhorlick/fusedrive/blockcache"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -14,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"time"
 
 	"github.com/cenkalti/backoff"
 )
@@ -29,10 +31,47 @@ const (
 	// binaryMimeType is the value of the MimeType attribute that is set on
 	// files uploaded to Google Drive.
 	binaryMimeType = "application/octet-stream"
+
+	// ownerProperty is the app property that holds the Owner of each file
+	// uploaded to Google Drive.
+	ownerProperty = "fusedrive-owner"
 )
 
 type DriveApi struct {
 	Service *drive.Service
+
+	// Owner identifies the filesystem that files are uploaded for. It's
+	// recorded with each file that's uploaded, and only files with the same
+	// owner are listed, so that filesystems sharing an account don't see each
+	// other's files. If empty, files aren't marked and every file is listed.
+	Owner string
+
+	// Client is the http client that Service sends requests with. It's used
+	// to send batches of requests, which Service doesn't support. If nil,
+	// requests are sent one at a time.
+	Client *http.Client
+
+	// KeepRevisionInterval is the minimum time between revisions of a file
+	// that are kept forever when the file is updated. If zero, Drive's default
+	// revision retention applies.
+	KeepRevisionInterval time.Duration
+
+	// Readahead is the number of range requests that sequential readers keep
+	// in flight ahead of their position, each of up to ReadaheadSize bytes. If
+	// zero, sequential readers issue one large request at a time.
+	Readahead int
+
+	// ReadaheadSize is the largest size of each readahead request. Requests
+	// start smaller and grow as a file is read sequentially.
+	ReadaheadSize uint64
+
+	// BlockCache holds content that's been read before, so it doesn't have to
+	// be downloaded again. If nil, content isn't cached.
+	BlockCache *blockcache.Cache
+
+	// stats measures range requests so readers can size them to suit the
+	// connection.
+	stats readStats
 }
 
 type DriveApiFile struct {
@@ -42,8 +81,16 @@ type DriveApiFile struct {
 	// The Google Drive id of this file.
 	Id string
 
+	// The Google Drive id of the revision of this file, or empty for the
+	// latest revision.
+	Revision string
+
 	// The size of this file in bytes.
 	Size uint64
+
+	// Version identifies the content of this file, such as the md5 of the
+	// remote copy, so that it can be cached. If empty, it isn't cached.
+	Version string
 }
 
 func NewDriveApi(dataPath string) *DriveApi {
@@ -66,7 +113,7 @@ func NewDriveApi(dataPath string) *DriveApi {
 		log.Fatalf("Unable to retrieve Drive client: %v", err)
 	}
 
-	return &DriveApi{Service: srv}
+	return &DriveApi{Service: srv, Client: client}
 }
 
 // Retrieve a token, saves the token, then returns the generated client.
@@ -130,15 +177,30 @@ func isHttpSuccess(code int) bool {
 	return code >= 200 && code < 300
 }
 
-// Create uploads a new file to the remote and returns the id of the created
-// file.
-func (d *DriveApi) Create(reader io.Reader) (string, error) {
+// rewind seeks reader back to the start, if it supports seeking, so that a
+// failed upload can be retried from the beginning.
+func rewind(reader io.Reader) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(0, io.SeekStart)
+		return err
+	}
+	return nil
+}
+
+// Create uploads a new file to the remote and returns the metadata of the
+// created file.
+func (d *DriveApi) Create(reader io.Reader) (RemoteFile, error) {
 	// TODO(simon): Log progress of uploads.
 	var response *drive.File
 	call := func() error {
+		if err := rewind(reader); err != nil {
+			return backoff.Permanent(err)
+		}
+
 		request := d.Service.Files.Create(&drive.File{
-			MimeType: binaryMimeType,
-		}).Media(reader)
+			MimeType:      binaryMimeType,
+			AppProperties: d.appProperties(),
+		}).Media(reader).Fields(remoteFileFields)
 
 		log.Printf("Calling Files.Create")
 		var err error
@@ -171,22 +233,40 @@ func (d *DriveApi) Create(reader io.Reader) (string, error) {
 	// error.
 	err := backoff.Retry(call, backoff.NewExponentialBackOff())
 	if err != nil {
-		return "", err
+		return RemoteFile{}, err
 	}
 
-	return response.Id, nil
+	return toRemoteFile(response)
+}
+
+// appProperties returns the app properties that are set on uploaded files.
+func (d *DriveApi) appProperties() map[string]string {
+	if d.Owner == "" {
+		return nil
+	}
+	return map[string]string{ownerProperty: d.Owner}
 }
 
-// Update replaces the contents of the given file with the data from reader.
-func (d *DriveApi) Update(id string, reader io.Reader) error {
+// Update replaces the contents of the given file with the data from reader and
+// returns the metadata of the updated file.
+func (d *DriveApi) Update(id string, reader io.Reader) (RemoteFile, error) {
 	// TODO(simon): Log progress of uploads.
+	var response *drive.File
 	call := func() error {
+		if err := rewind(reader); err != nil {
+			return backoff.Permanent(err)
+		}
+
+		// Files uploaded before they were marked with an owner are marked
+		// when they're next updated.
 		request := d.Service.Files.Update(id, &drive.File{
-			MimeType: binaryMimeType,
-		}).Media(reader)
+			MimeType:      binaryMimeType,
+			AppProperties: d.appProperties(),
+		}).Media(reader).Fields(remoteFileFields)
 
 		log.Printf("Calling Files.Update for %s", id)
-		response, err := request.Do()
+		var err error
+		response, err = request.Do()
 
 		log.Printf("Files.Update returned %#v for %s", response, id)
 
@@ -215,7 +295,18 @@ func (d *DriveApi) Update(id string, reader io.Reader) error {
 
 	// Keep attempting the call until it succeeds, or we fail with a permanent
 	// error.
-	return backoff.Retry(call, backoff.NewExponentialBackOff())
+	err := backoff.Retry(call, backoff.NewExponentialBackOff())
+	if err != nil {
+		return RemoteFile{}, err
+	}
+
+	// The content has been replaced, so failing to keep the revision isn't
+	// fatal.
+	if err := d.applyRevisionPolicy(id); err != nil {
+		log.Printf("failed to apply revision policy for %s: %v", id, err)
+	}
+
+	return toRemoteFile(response)
 }
 
 // ReadAt returns the content of the file in the given range with the given
@@ -277,14 +368,20 @@ func (d *DriveApi) ReadAt(id string, size uint64, off uint64) (io.ReadCloser,
 
 func (d *DriveApi) ReadAll(id string, file *os.File) error {
 	call := func() error {
+		// Discard anything written by a previous attempt.
+		if err := file.Truncate(0); err != nil {
+			return backoff.Permanent(err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return backoff.Permanent(err)
+		}
+
 		log.Printf("Calling Files.Get for %s", id)
 		response, err := d.Service.Files.Get(id).Download()
 
-		log.Printf("Files.Get returned %s for %s", response.Status, id)
-
 		if err != nil {
 			log.Printf("Files.Get response error for %s: %v", id, err)
-			return err
+			return retryable(err)
 		} else {
 			log.Printf("Files.Get for %s returned %d", id, response.StatusCode)
 
@@ -382,6 +479,12 @@ func IsPermanentError(status int) bool {
 	case http.StatusInternalServerError:
 		return false
 
+	// The service or a proxy in front of it is overloaded or timed out, retry
+	// with backoff.
+	case http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return false
+
 	// For unknown responses, do not retry.
 	default:
 		log.Printf("Unknown http response status: %v", status)
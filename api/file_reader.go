@@ -2,16 +2,18 @@ package api
 
 import (
 	"fmt"
+	"github.com/simonhorlick/fusedrive/blockcache"
+	"golang.org/x/net/context"
 	"io"
 	"log"
+	"net/http"
+	"time"
 )
 
-// Some observations: throughput continually increases as this value increases
-// and setting it crazy high is beneficial at the expense of possibly wasted
-// downloads. Fetching chunks in parallel doesn't seem to improve throughput
-// and instead hurts time-to-first-byte.
-const defaultSequentialReadSize = 512 * 1024 * 1024
-const defaultRandomReadSize = 4 * 1024 * 1024
+// DefaultReadaheadSize is a suitable limit on the size of each readahead
+// request. Smaller requests return their first byte sooner but are less
+// efficient.
+const DefaultReadaheadSize = 16 * 1024 * 1024
 
 // min returns the smaller of a and b.
 func min(a uint64, b uint64) uint64 {
@@ -33,6 +35,17 @@ type FileReader struct {
 	driveApi *DriveApi
 	id       string
 
+	// revision is the revision of the file to read, or empty for the latest.
+	revision string
+
+	// version identifies the content being read, so it can be cached. If
+	// empty, the content isn't cached.
+	version string
+
+	// cache holds blocks of content that have been read before, or nil if
+	// content isn't cached. Readahead requests are aligned to its blocks.
+	cache *blockcache.Cache
+
 	// The position of this reader within the file.
 	position uint64
 
@@ -40,35 +53,132 @@ type FileReader struct {
 	length uint64
 
 	// The current active http response.
-	httpResponse io.ReadCloser
+	httpResponse *rangeReader
+
+	// sizer chooses the amount of data to read from the api in each request.
+	sizer *readSizer
+
+	// readahead is the number of requests to keep in flight ahead of
+	// position. If zero, a single request is streamed at a time.
+	readahead int
+
+	// pending are the readahead requests in flight, in order of offset.
+	pending []*fetch
+
+	// buffered is the remaining data of the oldest readahead request, which
+	// starts at position.
+	buffered []byte
+
+	// next is the offset of the next readahead request.
+	next uint64
+
+	// ctx is cancelled when the reader is closed to abandon any readahead
+	// requests.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// fetch is a readahead request, which is read into memory in the background.
+type fetch struct {
+	off  uint64
+	size uint64
+
+	// length is the length of the file when the request was made. It's copied
+	// so that the request doesn't race with the reader finding that the file
+	// is shorter than expected.
+	length uint64
 
-	// The amount of data to read from the api.
-	readSize uint64
+	// done is closed once data and err are set.
+	done chan struct{}
+	data []byte
+	err  error
 }
 
 func NewFileReader(driveApi *DriveApi, id string, length, position uint64,
 	sequential bool) *FileReader {
+	return NewRevisionReader(driveApi, id, "", "", length, position,
+		sequential)
+}
 
-	// If we're reading sequentially then fetch as much data as possible in each
-	// api call. If we're reading randomly, then just fetch the minimum.
-	var readSize uint64
+// NewRevisionReader returns a FileReader for the given revision of a file. If
+// revision is empty then the latest revision is read. If version is set and
+// driveApi has a BlockCache, content is read from and added to the cache.
+func NewRevisionReader(driveApi *DriveApi, id, revision, version string,
+	length, position uint64, sequential bool) *FileReader {
+
+	// If we're reading sequentially then start with a moderate request, or
+	// keep several requests in flight if readahead is enabled. If we're
+	// reading randomly, then just fetch the minimum. Either way, requests grow
+	// for as long as the reads continue sequentially.
+	size := uint64(minReadSize)
 	if sequential {
-		readSize = defaultSequentialReadSize
-	} else {
-		readSize = defaultRandomReadSize
+		size = initialReadSize
+	}
+	maxSize := uint64(maxReadSize)
+	readahead := 0
+	if sequential && driveApi.Readahead > 0 {
+		readahead = driveApi.Readahead
+		maxSize = driveApi.ReadaheadSize
+	}
+
+	// Cached content is always read through readahead requests, which are
+	// made up of whole blocks.
+	var cache *blockcache.Cache
+	if driveApi.BlockCache != nil && version != "" {
+		cache = driveApi.BlockCache
+		if readahead == 0 {
+			readahead = 1
+			maxSize = driveApi.ReadaheadSize
+		}
+	}
+	if readahead > 0 && maxSize == 0 {
+		maxSize = DefaultReadaheadSize
 	}
 
-	return &FileReader{
-		driveApi: driveApi,
-		id:       id,
-		position: position,
-		length:   length,
-		readSize: readSize,
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f := &FileReader{
+		driveApi:  driveApi,
+		id:        id,
+		revision:  revision,
+		version:   version,
+		cache:     cache,
+		position:  position,
+		length:    length,
+		sizer:     newReadSizer(&driveApi.stats, size, maxSize),
+		readahead: readahead,
+		ctx:       ctx,
+		cancel:    cancel,
 	}
+	f.next = f.start()
+	return f
 }
 
-// ReadAt begins streaming the given range of bytes from this file.
+// start returns the offset of the first readahead request needed to read from
+// position onwards.
+func (f *FileReader) start() uint64 {
+	if f.cache == nil {
+		return f.position
+	}
+	blockSize := f.cache.BlockSize()
+	return f.position / blockSize * blockSize
+}
+
+// ReadAt begins streaming the given range of bytes from this file. Failed
+// requests are retried, and an interrupted response is resumed from where it
+// left off.
 func (f *FileReader) ReadAt(size uint64, off uint64) (io.ReadCloser, error) {
+	r, err := f.open(f.ctx, size, off)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// readAt begins streaming the given range of bytes from this file. The request
+// is abandoned if ctx is cancelled.
+func (f *FileReader) readAt(ctx context.Context, size uint64,
+	off uint64) (io.ReadCloser, error) {
 	log.Printf("Sending HTTP request for %d bytes at offset %d ", size, off)
 	if size == 0 {
 		log.Printf("error: Attempted zero byte read")
@@ -80,15 +190,26 @@ func (f *FileReader) ReadAt(size uint64, off uint64) (io.ReadCloser, error) {
 	startRange := off
 	endRange := startRange + size - 1
 
-	request := f.driveApi.Service.Files.Get(f.id)
-	request.Header().Add("Range",
-		fmt.Sprintf("bytes=%d-%d", startRange, endRange))
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", startRange, endRange)
 
-	response, err := request.Download()
+	var response *http.Response
+	var err error
+	start := time.Now()
+	if f.revision == "" {
+		request := f.driveApi.Service.Files.Get(f.id).Context(ctx)
+		request.Header().Add("Range", rangeHeader)
+		response, err = request.Download()
+	} else {
+		request := f.driveApi.Service.Revisions.Get(f.id, f.revision).
+			Context(ctx)
+		request.Header().Add("Range", rangeHeader)
+		response, err = request.Download()
+	}
 	if err != nil {
 		log.Printf("Response error %v", err)
 		return nil, err
 	}
+	f.driveApi.stats.addLatency(time.Since(start))
 
 	return response.Body, nil
 }
@@ -97,6 +218,10 @@ func (f *FileReader) ReadAt(size uint64, off uint64) (io.ReadCloser, error) {
 func (f *FileReader) Read(p []byte) (int, error) {
 	//log.Printf("FileReader Read of %d bytes at offset %d", len(p), f.position)
 
+	if f.readahead > 0 {
+		return f.readAhead(p)
+	}
+
 	totalRead := 0
 
 	for len(p) > 0 {
@@ -109,16 +234,14 @@ func (f *FileReader) Read(p []byte) (int, error) {
 
 		// Start a new http request if there isn't already one in progress.
 		if f.httpResponse == nil {
-			requestSize := min(remainingBytes, f.readSize)
+			requestSize := min(remainingBytes, f.sizer.Size())
 			log.Printf("Sending http request for %d bytes, remaining %d bytes",
 				requestSize, remainingBytes)
 
 			// Start the request.
-			resp, err := f.ReadAt(requestSize, f.position)
+			resp, err := f.open(f.ctx, requestSize, f.position)
 			if err != nil {
-				log.Printf("Error calling ReadAt: %v", err)
-				// TODO(simon): Handle retries properly here.
-				// handle http 416 range not satisfiable
+				log.Printf("Error starting http request: %v", err)
 				return totalRead, err
 			}
 			f.httpResponse = resp
@@ -141,7 +264,8 @@ func (f *FileReader) Read(p []byte) (int, error) {
 		// We've exhausted this http response, so start another request.
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			log.Printf("EOF for http request")
-			closeErr := f.httpResponse.Close()
+			resp := f.httpResponse
+			closeErr := resp.Close()
 			f.httpResponse = nil
 
 			if closeErr != nil {
@@ -149,6 +273,17 @@ func (f *FileReader) Read(p []byte) (int, error) {
 					closeErr)
 			}
 
+			// If the file turned out to be shorter than expected then there's
+			// nothing more to read.
+			if resp.truncated {
+				f.length = f.position
+				return totalRead, io.EOF
+			}
+
+			// The reader has used up a whole response and is reading on, so
+			// make the next request bigger.
+			f.sizer.Grow()
+
 			// If possible start a new http request and continue filling p.
 			continue
 		} else if err != nil {
@@ -160,7 +295,228 @@ func (f *FileReader) Read(p []byte) (int, error) {
 	return totalRead, nil
 }
 
+// Reset is called when the caller has skipped over content it didn't need,
+// so that the next request is small in case the reads aren't sequential.
+func (f *FileReader) Reset() {
+	f.sizer.Reset()
+}
+
+// readAhead fills p from the readahead requests, issuing more as the oldest
+// are consumed so that there are always readahead requests in flight.
+func (f *FileReader) readAhead(p []byte) (int, error) {
+	totalRead := 0
+
+	for len(p) > 0 {
+		// If we've read the whole thing then return end-of-file.
+		if f.position >= f.length {
+			return totalRead, io.EOF
+		}
+
+		if len(f.buffered) == 0 {
+			f.fill()
+
+			// Wait for the oldest request, which holds position.
+			head := f.pending[0]
+			<-head.done
+			f.pending = f.pending[1:]
+
+			// The file is shorter than expected, so stop reading where it
+			// ends.
+			if head.err == io.EOF {
+				f.discard()
+				f.length = head.off + uint64(len(head.data))
+				if f.position >= f.length {
+					return totalRead, io.EOF
+				}
+				f.buffered = head.data[f.position-head.off:]
+				continue
+			}
+
+			if head.err != nil {
+				log.Printf("Readahead request at offset %d failed: %v",
+					head.off, head.err)
+				f.discard()
+				return totalRead, head.err
+			}
+
+			// The reader has caught up with the oldest request, so make the
+			// next ones bigger.
+			f.buffered = head.data[f.position-head.off:]
+			f.sizer.Grow()
+			f.fill()
+		}
+
+		n := copy(p, f.buffered)
+		f.buffered = f.buffered[n:]
+		f.position += uint64(n)
+		totalRead += n
+		p = p[n:]
+	}
+
+	return totalRead, nil
+}
+
+// fill issues readahead requests until there are enough in flight or the end
+// of the file is reached.
+func (f *FileReader) fill() {
+	for len(f.pending) < f.readahead && f.next < f.length {
+		size := f.sizer.Size()
+		if f.cache != nil {
+			// Keep requests aligned to whole blocks.
+			blockSize := f.cache.BlockSize()
+			size = (size + blockSize - 1) / blockSize * blockSize
+		}
+
+		fe := &fetch{
+			off:    f.next,
+			size:   min(size, f.length-f.next),
+			length: f.length,
+			done:   make(chan struct{}),
+		}
+		f.next += fe.size
+		f.pending = append(f.pending, fe)
+
+		if f.cache != nil {
+			go f.getCached(f.ctx, fe)
+		} else {
+			go f.get(f.ctx, fe)
+		}
+	}
+}
+
+// get performs a readahead request.
+func (f *FileReader) get(ctx context.Context, fe *fetch) {
+	defer close(fe.done)
+	fe.data, fe.err = f.download(ctx, fe.size, fe.off)
+}
+
+// download reads the given range of bytes from this file into memory. If the
+// file ends before the end of the range, the part that exists is returned
+// along with io.EOF.
+func (f *FileReader) download(ctx context.Context, size uint64,
+	off uint64) ([]byte, error) {
+	body, err := f.open(ctx, size, off)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	start := time.Now()
+	data := make([]byte, size)
+	n, err := io.ReadFull(body, data)
+	if err == nil {
+		f.driveApi.stats.addTransfer(size, time.Since(start))
+	}
+
+	// Interrupted responses are resumed, so a short read means the file is
+	// shorter than expected.
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		log.Printf("Expecting %d bytes at offset %d, got %d", size, off, n)
+		return data[:n], io.EOF
+	}
+	return data, err
+}
+
+// getCached performs a readahead request, taking as many blocks as possible
+// from the cache and adding any that are downloaded to it. If the file turns out
+// to be shorter than expected, the content up to where it ends is returned
+// along with io.EOF.
+func (f *FileReader) getCached(ctx context.Context, fe *fetch) {
+	defer close(fe.done)
+
+	blockSize := f.cache.BlockSize()
+	first := fe.off / blockSize
+	count := (fe.size + blockSize - 1) / blockSize
+
+	// Find the range of blocks that aren't cached.
+	blocks := make([][]byte, count)
+	missingFirst, missingLast := count, uint64(0)
+	for i := range blocks {
+		index := first + uint64(i)
+		data, ok := f.cache.Get(f.blockKey(index))
+		if ok && uint64(len(data)) == f.blockLength(index, fe.length) {
+			blocks[i] = data
+			continue
+		}
+		if missingFirst == count {
+			missingFirst = uint64(i)
+		}
+		missingLast = uint64(i)
+	}
+
+	if missingFirst < count {
+		off := (first + missingFirst) * blockSize
+		end := min((first+missingLast+1)*blockSize, fe.length)
+		data, err := f.download(ctx, end-off, off)
+		if err == io.EOF {
+			fe.err = err
+		} else if err != nil {
+			fe.err = err
+			return
+		}
+
+		for i := missingFirst; i <= missingLast; i++ {
+			index := first + i
+			start := (i - missingFirst) * blockSize
+			if start >= uint64(len(data)) {
+				break
+			}
+			blocks[i] = data[start:min(start+f.blockLength(index, fe.length),
+				uint64(len(data)))]
+
+			// Content that's shorter than expected isn't cached, as it
+			// doesn't match the version that's being read.
+			if fe.err != nil {
+				continue
+			}
+			if err := f.cache.Put(f.blockKey(index), blocks[i]); err != nil {
+				log.Printf("failed to cache block %d of %s: %v", index, f.id,
+					err)
+			}
+		}
+
+		// Nothing after the end of a short download can be returned.
+		if fe.err != nil {
+			blocks = blocks[:missingFirst+
+				(uint64(len(data))+blockSize-1)/blockSize]
+		}
+	}
+
+	fe.data = make([]byte, 0, fe.size)
+	for _, block := range blocks {
+		fe.data = append(fe.data, block...)
+	}
+}
+
+// blockKey returns the key of the block with the given index in the cache.
+func (f *FileReader) blockKey(index uint64) blockcache.Key {
+	return blockcache.Key{Id: f.id, Version: f.version, Index: index}
+}
+
+// blockLength returns the length of the block with the given index in a file
+// of the given length, which is only less than the block size at the end of
+// the file.
+func (f *FileReader) blockLength(index, length uint64) uint64 {
+	blockSize := f.cache.BlockSize()
+	return min(blockSize, length-index*blockSize)
+}
+
+// discard abandons the readahead requests in flight, so the next read starts
+// again from position.
+func (f *FileReader) discard() {
+	f.cancel()
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.pending = nil
+	f.buffered = nil
+	f.next = f.start()
+}
+
 func (f *FileReader) Close() error {
+	// Abandon any readahead requests.
+	f.cancel()
+	f.pending = nil
+	f.buffered = nil
+
 	// If there's an open http response then close it.
 	if f.httpResponse != nil {
 		err := f.httpResponse.Close()
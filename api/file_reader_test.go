@@ -0,0 +1,190 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/simonhorlick/fusedrive/blockcache"
+	"google.golang.org/api/drive/v3"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves the content of files over a fake Drive api. If handler is
+// set, it's given each media request first and returns true if it handled it.
+type testServer struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	content  []byte
+	requests int
+	ranges   []string
+	handler  func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newTestServer(content []byte) *testServer {
+	s := &testServer{content: content}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	content, handler := s.content, s.handler
+	s.mu.Unlock()
+
+	if handler != nil && handler(w, r) {
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// requestCount returns the number of requests that have been made.
+func (s *testServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// requestedRanges returns the Range headers of the requests that have been
+// made.
+func (s *testServer) requestedRanges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// api returns a DriveApi that talks to this server.
+func (s *testServer) api(t *testing.T) *DriveApi {
+	srv, err := drive.New(s.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.BasePath = s.server.URL + "/drive/v3/"
+	return &DriveApi{Service: srv}
+}
+
+// testContent returns size bytes of content that differ at every offset within
+// a block.
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	return content
+}
+
+// openCache returns a block cache with blocks of the given size in a temporary
+// directory.
+func openCache(t *testing.T, blockSize uint64) (*blockcache.Cache, string) {
+	dir, err := ioutil.TempDir("", "blockcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := blockcache.Open(dir, blockSize, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, dir
+}
+
+// readFrom reads a file of the given length from position to the end.
+func readFrom(t *testing.T, driveApi *DriveApi, length, position uint64,
+	sequential bool) []byte {
+	r := NewRevisionReader(driveApi, "id", "", "version", length, position,
+		sequential)
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestCachedReadUnalignedLength ensures that a file whose length isn't a
+// multiple of the block size is read in full through the cache, and then read
+// again from the cache alone.
+func TestCachedReadUnalignedLength(t *testing.T) {
+	content := testContent(5*1024 + 500)
+	s := newTestServer(content)
+	defer s.server.Close()
+
+	cache, dir := openCache(t, 1024)
+	defer os.RemoveAll(dir)
+
+	driveApi := s.api(t)
+	driveApi.BlockCache = cache
+	driveApi.Readahead = 2
+	driveApi.ReadaheadSize = 2048
+
+	length := uint64(len(content))
+	if data := readFrom(t, driveApi, length, 0, true); !bytes.Equal(data,
+		content) {
+		t.Fatalf("Expecting %d bytes of content, got %d", len(content),
+			len(data))
+	}
+
+	requests := s.requestCount()
+	if data := readFrom(t, driveApi, length, 1500, false); !bytes.Equal(data,
+		content[1500:]) {
+		t.Fatalf("Expecting %d bytes of content, got %d", len(content)-1500,
+			len(data))
+	}
+	if s.requestCount() != requests {
+		t.Fatalf("Expecting cached content to be read without requests, "+
+			"made %d", s.requestCount()-requests)
+	}
+}
+
+// TestCachedReadShortFile ensures that a file that's shorter than expected is
+// read up to where it ends.
+func TestCachedReadShortFile(t *testing.T) {
+	content := testContent(2*1024 + 300)
+	s := newTestServer(content)
+	defer s.server.Close()
+
+	cache, dir := openCache(t, 1024)
+	defer os.RemoveAll(dir)
+
+	driveApi := s.api(t)
+	driveApi.BlockCache = cache
+	driveApi.Readahead = 2
+	driveApi.ReadaheadSize = 1024
+
+	data := readFrom(t, driveApi, 4*1024, 0, true)
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expecting %d bytes of content, got %d", len(content),
+			len(data))
+	}
+}
+
+// TestReadGrowsRequests ensures that requests made without readahead double in
+// size for as long as the reads carry on.
+func TestReadGrowsRequests(t *testing.T) {
+	content := testContent(4*minReadSize + 100)
+	s := newTestServer(content)
+	defer s.server.Close()
+
+	data := readFrom(t, s.api(t), uint64(len(content)), 0, false)
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expecting %d bytes of content, got %d", len(content),
+			len(data))
+	}
+
+	want := []string{
+		fmt.Sprintf("bytes=%d-%d", 0, minReadSize-1),
+		fmt.Sprintf("bytes=%d-%d", minReadSize, 3*minReadSize-1),
+		fmt.Sprintf("bytes=%d-%d", 3*minReadSize, len(content)-1),
+	}
+	if got := s.requestedRanges(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expecting requests for %v, got %v", want, got)
+	}
+}
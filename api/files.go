@@ -0,0 +1,199 @@
+package api
+
+import (
+	"fmt"
+	"github.com/cenkalti/backoff"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// listPageSize is the number of files requested in each call to
+	// Files.List. This is the maximum that Drive allows.
+	listPageSize = 1000
+
+	// remoteFileFields are the fields that are requested to describe a
+	// RemoteFile.
+	remoteFileFields = "id,size,md5Checksum,trashed,createdTime"
+)
+
+// RemoteFile describes the metadata Drive holds for a file.
+type RemoteFile struct {
+	// Id is the Google Drive id of this file.
+	Id string
+
+	// Size is the size of the file content in bytes.
+	Size uint64
+
+	// Md5Checksum is the hex encoded md5 of the file content.
+	Md5Checksum string
+
+	// Trashed is true if the file has been moved to the Drive trash.
+	Trashed bool
+
+	// CreatedTime is when the file was created.
+	CreatedTime time.Time
+}
+
+// toRemoteFile converts file metadata returned by the api.
+func toRemoteFile(f *drive.File) (RemoteFile, error) {
+	created, err := time.Parse(time.RFC3339, f.CreatedTime)
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("invalid created time for %s: %v",
+			f.Id, err)
+	}
+
+	return RemoteFile{
+		Id:          f.Id,
+		Size:        uint64(f.Size),
+		Md5Checksum: f.Md5Checksum,
+		Trashed:     f.Trashed,
+		CreatedTime: created,
+	}, nil
+}
+
+// IsNotFound returns true if err was caused by the file not existing on the
+// remote.
+func IsNotFound(err error) bool {
+	serr, ok := err.(*googleapi.Error)
+	return ok && serr.Code == http.StatusNotFound
+}
+
+// ListFiles returns the metadata for every file on the remote that was created
+// by fusedrive, including those in the Drive trash. If Owner is set, only files
+// that were uploaded with the same owner are listed. Files are fetched in pages
+// of listPageSize.
+func (d *DriveApi) ListFiles() ([]RemoteFile, error) {
+	var files []RemoteFile
+	pageToken := ""
+
+	for {
+		var response *drive.FileList
+		call := func() error {
+			log.Printf("Calling Files.List")
+			request := d.Service.Files.List().
+				Spaces("drive").
+				PageSize(listPageSize).
+				Fields("nextPageToken",
+					googleapi.Field("files("+remoteFileFields+")"))
+			if pageToken != "" {
+				request.PageToken(pageToken)
+			}
+			if d.Owner != "" {
+				request.Q(fmt.Sprintf(
+					"appProperties has { key='%s' and value='%s' }",
+					ownerProperty, d.Owner))
+			}
+
+			var err error
+			response, err = request.Do()
+			if err != nil {
+				log.Printf("Files.List response error: %v", err)
+				return retryable(err)
+			}
+
+			// Success.
+			return nil
+		}
+
+		// Keep attempting the call until it succeeds, or we fail with a
+		// permanent error.
+		err := backoff.Retry(call, backoff.NewExponentialBackOff())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range response.Files {
+			file, err := toRemoteFile(f)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+
+		log.Printf("Listed %d files", len(files))
+
+		if response.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = response.NextPageToken
+	}
+}
+
+// GetFile returns the metadata for the file with the given id. If the file
+// doesn't exist then the error satisfies IsNotFound.
+func (d *DriveApi) GetFile(id string) (RemoteFile, error) {
+	var response *drive.File
+	call := func() error {
+		log.Printf("Calling Files.Get metadata for %s", id)
+		var err error
+		response, err = d.Service.Files.Get(id).
+			Fields(remoteFileFields).Do()
+		if err != nil {
+			log.Printf("Files.Get response error for %s: %v", id, err)
+			return retryable(err)
+		}
+
+		// Success.
+		return nil
+	}
+
+	// Keep attempting the call until it succeeds, or we fail with a permanent
+	// error.
+	err := backoff.Retry(call, backoff.NewExponentialBackOff())
+	if err != nil {
+		return RemoteFile{}, err
+	}
+
+	return toRemoteFile(response)
+}
+
+// Trash moves the file with the given id to the Drive trash, where Drive
+// deletes it permanently after 30 days.
+func (d *DriveApi) Trash(id string) error {
+	return d.setTrashed(id, true)
+}
+
+// Untrash moves the file with the given id out of the Drive trash.
+func (d *DriveApi) Untrash(id string) error {
+	return d.setTrashed(id, false)
+}
+
+func (d *DriveApi) setTrashed(id string, trashed bool) error {
+	call := func() error {
+		log.Printf("Calling Files.Update to set trashed to %t for %s", trashed,
+			id)
+		_, err := d.Service.Files.Update(id, &drive.File{
+			Trashed:         trashed,
+			ForceSendFields: []string{"Trashed"},
+		}).Do()
+		if err != nil {
+			log.Printf("Files.Update response error for %s: %v", id, err)
+			return retryable(err)
+		}
+
+		// Success.
+		return nil
+	}
+
+	// Keep attempting the call until it succeeds, or we fail with a permanent
+	// error.
+	return backoff.Retry(call, backoff.NewExponentialBackOff())
+}
+
+// Download returns the content of the file with the given id. The request isn't
+// retried, so it's only suitable for callers that can try again later.
+func (d *DriveApi) Download(id string) (io.ReadCloser, error) {
+	log.Printf("Calling Files.Get for %s", id)
+	response, err := d.Service.Files.Get(id).Download()
+	if err != nil {
+		log.Printf("Files.Get response error for %s: %v", id, err)
+		return nil, err
+	}
+
+	return response.Body, nil
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"github.com/cenkalti/backoff"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxReadRetries is the number of times in a row a range request is retried
+// without receiving any data before the error is returned to the reader.
+const maxReadRetries = 6
+
+var _ io.ReadCloser = &rangeReader{} // Verify that interface is implemented.
+
+// rangeReader streams a range of bytes from a file. If the response fails part
+// way through, the request is issued again with backoff from where it left off,
+// so that a dropped connection doesn't fail the read.
+type rangeReader struct {
+	f   *FileReader
+	ctx context.Context
+
+	// off is the offset of the next byte to read, and end is the offset just
+	// after the last byte of the range.
+	off uint64
+	end uint64
+
+	// body is the response being read, or nil if there isn't one.
+	body io.ReadCloser
+
+	// retries limits how often the request is retried. It's reset whenever
+	// data is received.
+	retries backoff.BackOff
+
+	// truncated is true if the file ended before the end of the range.
+	truncated bool
+}
+
+// open begins streaming the given range of bytes from this file, retrying
+// with backoff if the request fails. The request is abandoned if ctx is
+// cancelled.
+func (f *FileReader) open(ctx context.Context, size uint64,
+	off uint64) (*rangeReader, error) {
+	r := &rangeReader{
+		f:   f,
+		ctx: ctx,
+		off: off,
+		end: off + size,
+		retries: backoff.WithMaxRetries(backoff.NewExponentialBackOff(),
+			maxReadRetries),
+	}
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// connect requests the rest of the range, retrying until it succeeds or the
+// retries are exhausted.
+func (r *rangeReader) connect() error {
+	for r.off < r.end {
+		body, err := r.f.readAt(r.ctx, r.end-r.off, r.off)
+		if err == nil {
+			r.body = body
+			return nil
+		}
+
+		// The file is shorter than expected, so there's nothing more to read.
+		if serr, ok := err.(*googleapi.Error); ok &&
+			serr.Code == http.StatusRequestedRangeNotSatisfiable {
+			log.Printf("File %s ends before offset %d", r.f.id, r.off)
+			r.truncated = true
+			r.end = r.off
+			return nil
+		}
+
+		if err := r.wait(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait sleeps before the next attempt at a failed request. Returns err if the
+// request can never succeed, the retries are exhausted or ctx is cancelled.
+func (r *rangeReader) wait(err error) error {
+	if serr, ok := err.(*googleapi.Error); ok && IsPermanentError(serr.Code) {
+		return err
+	}
+	if r.ctx.Err() != nil {
+		return err
+	}
+
+	d := r.retries.NextBackOff()
+	if d == backoff.Stop {
+		log.Printf("Giving up reading %s at offset %d: %v", r.f.id, r.off, err)
+		return err
+	}
+	log.Printf("Retrying read of %s at offset %d in %v: %v", r.f.id, r.off, d,
+		err)
+
+	select {
+	case <-time.After(d):
+		return nil
+	case <-r.ctx.Done():
+		return err
+	}
+}
+
+// Read implements the io.Reader interface.
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.off >= r.end {
+			return 0, io.EOF
+		}
+
+		if r.body == nil {
+			if err := r.connect(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if remaining := r.end - r.off; uint64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		n, err := r.body.Read(p)
+		r.off += uint64(n)
+		if n > 0 {
+			r.retries.Reset()
+		}
+		if err == nil || r.off >= r.end {
+			return n, nil
+		}
+
+		// The response ended early, so request the rest of the range.
+		log.Printf("Response for %s interrupted at offset %d: %v", r.f.id,
+			r.off, err)
+		_ = r.body.Close()
+		r.body = nil
+
+		if n > 0 {
+			return n, nil
+		}
+		if err := r.wait(err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *rangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// TestReadResumesInterruptedResponse ensures that a response that's cut off
+// part way through is resumed from where it stopped.
+func TestReadResumesInterruptedResponse(t *testing.T) {
+	content := testContent(1000)
+	s := newTestServer(content)
+	defer s.server.Close()
+
+	interrupted := false
+	s.handler = func(w http.ResponseWriter, r *http.Request) bool {
+		if interrupted {
+			return false
+		}
+		interrupted = true
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[:400])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	data := readFrom(t, s.api(t), uint64(len(content)), 0, false)
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expecting %d bytes of content, got %d", len(content),
+			len(data))
+	}
+
+	want := []string{
+		fmt.Sprintf("bytes=0-%d", len(content)-1),
+		fmt.Sprintf("bytes=400-%d", len(content)-1),
+	}
+	if got := s.requestedRanges(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expecting requests for %v, got %v", want, got)
+	}
+}
+
+// TestReadRetriesUnavailable ensures that a request that fails because the
+// service is unavailable is retried.
+func TestReadRetriesUnavailable(t *testing.T) {
+	content := testContent(1000)
+	s := newTestServer(content)
+	defer s.server.Close()
+
+	failed := false
+	s.handler = func(w http.ResponseWriter, r *http.Request) bool {
+		if failed {
+			return false
+		}
+		failed = true
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return true
+	}
+
+	data := readFrom(t, s.api(t), uint64(len(content)), 0, false)
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expecting %d bytes of content, got %d", len(content),
+			len(data))
+	}
+	if s.requestCount() != 2 {
+		t.Fatalf("Expecting 2 requests, got %d", s.requestCount())
+	}
+}
+
+// TestReadTruncatedFile ensures that a file that's shorter than expected is
+// read up to where it ends, once the rest of it can't be requested.
+func TestReadTruncatedFile(t *testing.T) {
+	content := testContent(1000)
+	s := newTestServer(content)
+	defer s.server.Close()
+
+	data := readFrom(t, s.api(t), 2*uint64(len(content)), 0, false)
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expecting %d bytes of content, got %d", len(content),
+			len(data))
+	}
+
+	// The second request is past the end of the file, so it fails with 416.
+	want := []string{
+		fmt.Sprintf("bytes=0-%d", 2*len(content)-1),
+		fmt.Sprintf("bytes=%d-%d", len(content), 2*len(content)-1),
+	}
+	if got := s.requestedRanges(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expecting requests for %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// minReadSize is the size of the first request made by a reader that was
+// started by seeking. Small requests waste little when the reader is abandoned
+// after a few reads.
+const minReadSize = 1024 * 1024
+
+// initialReadSize is the size of the first request made by a sequential
+// reader. It's kept small so the first byte arrives quickly, and grows as the
+// reader carries on.
+const initialReadSize = 4 * 1024 * 1024
+
+// maxReadSize is the largest request made when readahead is disabled. Some
+// observations: throughput continually increases as this value increases and
+// setting it crazy high is beneficial at the expense of possibly wasted
+// downloads, which is why requests only grow this large once a reader has
+// read sequentially for a while.
+const maxReadSize = 512 * 1024 * 1024
+
+// latencyRatio is how many times longer than the latency of a request its
+// transfer should take, so that requests spend most of their time moving data.
+const latencyRatio = 4
+
+// statsWeight is the weight given to each new measurement in the moving
+// averages kept by readStats.
+const statsWeight = 0.2
+
+// readStats keeps moving averages of the latency and throughput of range
+// requests. It's shared by every reader of a DriveApi and is safe for
+// concurrent use.
+type readStats struct {
+	mu sync.Mutex
+
+	// latency is the time taken for the response to a request to arrive.
+	latency time.Duration
+
+	// throughput is the rate in bytes per second at which response bodies are
+	// received.
+	throughput float64
+}
+
+// addLatency records the time taken for a response to arrive.
+func (s *readStats) addLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.latency == 0 {
+		s.latency = d
+		return
+	}
+	s.latency += time.Duration(statsWeight * float64(d-s.latency))
+}
+
+// addTransfer records that n bytes of a response body were received in d.
+func (s *readStats) addTransfer(n uint64, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	rate := float64(n) / d.Seconds()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.throughput == 0 {
+		s.throughput = rate
+		return
+	}
+	s.throughput += statsWeight * (rate - s.throughput)
+}
+
+// efficientSize returns the smallest request that spends most of its time
+// transferring data rather than waiting for the response, or zero if nothing
+// has been measured yet.
+func (s *readStats) efficientSize() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return uint64(s.throughput * s.latency.Seconds() * latencyRatio)
+}
+
+// readSizer chooses the size of each request made by a reader. Requests start
+// small and double each time the reader consumes a whole request and carries
+// on, up to a maximum. They go back to the smallest size when the reader skips
+// over content. Once latency and throughput have been measured, a
+// growing reader skips straight to a size at which latency is a small part of
+// each request.
+type readSizer struct {
+	stats *readStats
+	size  uint64
+	max   uint64
+}
+
+func newReadSizer(stats *readStats, size, max uint64) *readSizer {
+	return &readSizer{
+		stats: stats,
+		size:  min(size, max),
+		max:   max,
+	}
+}
+
+// Size returns the size of the next request.
+func (r *readSizer) Size() uint64 {
+	return r.size
+}
+
+// Grow is called when the reader has consumed a whole request and is reading
+// on, which suggests the reads will continue sequentially.
+func (r *readSizer) Grow() {
+	size := r.size * 2
+	if efficient := r.stats.efficientSize(); efficient > size {
+		size = efficient
+	}
+	size = min(size, r.max)
+
+	if size != r.size {
+		log.Printf("Growing read size from %d to %d bytes", r.size, size)
+		r.size = size
+	}
+}
+
+// Reset is called when the reader has skipped over content it didn't read,
+// which suggests the reads aren't sequential.
+func (r *readSizer) Reset() {
+	size := min(minReadSize, r.max)
+
+	if size != r.size {
+		log.Printf("Resetting read size from %d to %d bytes", r.size, size)
+		r.size = size
+	}
+}
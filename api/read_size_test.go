@@ -0,0 +1,82 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+const mib = 1024 * 1024
+
+func TestNewReadSizer(t *testing.T) {
+	tests := []struct {
+		name string
+		size uint64
+		max  uint64
+		want uint64
+	}{
+		{"below max", initialReadSize, maxReadSize, initialReadSize},
+		{"at max", 8 * mib, 8 * mib, 8 * mib},
+		{"above max", initialReadSize, 2 * mib, 2 * mib},
+	}
+
+	for _, test := range tests {
+		r := newReadSizer(&readStats{}, test.size, test.max)
+		if got := r.Size(); got != test.want {
+			t.Errorf("%s: expecting size %d, got %d", test.name, test.want,
+				got)
+		}
+	}
+}
+
+func TestReadSizerGrow(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       uint64
+		max        uint64
+		latency    time.Duration
+		throughput float64
+		want       uint64
+	}{
+		{"doubles", 4 * mib, maxReadSize, 0, 0, 8 * mib},
+		{"clamped to max", 12 * mib, 16 * mib, 0, 0, 16 * mib},
+		{"stays at max", 16 * mib, 16 * mib, 0, 0, 16 * mib},
+		{"jumps to efficient size", minReadSize, maxReadSize,
+			250 * time.Millisecond, 100 * mib, 100 * mib},
+		{"doubles past efficient size", 4 * mib, maxReadSize,
+			250 * time.Millisecond, mib, 8 * mib},
+		{"efficient size clamped to max", minReadSize, 64 * mib,
+			250 * time.Millisecond, 100 * mib, 64 * mib},
+	}
+
+	for _, test := range tests {
+		stats := &readStats{latency: test.latency, throughput: test.throughput}
+		r := newReadSizer(stats, test.size, test.max)
+		r.Grow()
+		if got := r.Size(); got != test.want {
+			t.Errorf("%s: expecting size %d, got %d", test.name, test.want,
+				got)
+		}
+	}
+}
+
+func TestReadSizerReset(t *testing.T) {
+	tests := []struct {
+		name string
+		size uint64
+		max  uint64
+		want uint64
+	}{
+		{"shrinks to min", 64 * mib, maxReadSize, minReadSize},
+		{"stays at min", minReadSize, maxReadSize, minReadSize},
+		{"max below min", 256 * 1024, 256 * 1024, 256 * 1024},
+	}
+
+	for _, test := range tests {
+		r := newReadSizer(&readStats{}, test.size, test.max)
+		r.Reset()
+		if got := r.Size(); got != test.want {
+			t.Errorf("%s: expecting size %d, got %d", test.name, test.want,
+				got)
+		}
+	}
+}
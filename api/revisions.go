@@ -0,0 +1,150 @@
+package api
+
+import (
+	"fmt"
+	"github.com/cenkalti/backoff"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"log"
+	"time"
+)
+
+// Revision is a previous version of the content of a file.
+type Revision struct {
+	// Id is the Google Drive id of this revision.
+	Id string
+
+	// ModifiedTime is when this revision was uploaded.
+	ModifiedTime time.Time
+
+	// Size is the size of this revision in bytes.
+	Size uint64
+
+	// KeepForever is true if this revision is never automatically deleted.
+	KeepForever bool
+}
+
+// retryable wraps err so that backoff.Retry stops retrying if the request can
+// never succeed.
+func retryable(err error) error {
+	if serr, ok := err.(*googleapi.Error); ok {
+		if IsPermanentError(serr.Code) {
+			return backoff.Permanent(err)
+		}
+	}
+	return err
+}
+
+// ListRevisions returns the revisions of the given file, oldest first.
+func (d *DriveApi) ListRevisions(id string) ([]Revision, error) {
+	var revisions []Revision
+	pageToken := ""
+
+	for {
+		var response *drive.RevisionList
+		call := func() error {
+			log.Printf("Calling Revisions.List for %s", id)
+			request := d.Service.Revisions.List(id).
+				Fields("nextPageToken",
+					"revisions(id,modifiedTime,size,keepForever)")
+			if pageToken != "" {
+				request.PageToken(pageToken)
+			}
+
+			var err error
+			response, err = request.Do()
+			if err != nil {
+				log.Printf("Revisions.List response error for %s: %v", id, err)
+				return retryable(err)
+			}
+
+			// Success.
+			return nil
+		}
+
+		// Keep attempting the call until it succeeds, or we fail with a
+		// permanent error.
+		err := backoff.Retry(call, backoff.NewExponentialBackOff())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range response.Revisions {
+			modified, err := time.Parse(time.RFC3339, r.ModifiedTime)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modified time for revision "+
+					"%s: %v", r.Id, err)
+			}
+
+			revisions = append(revisions, Revision{
+				Id:           r.Id,
+				ModifiedTime: modified,
+				Size:         uint64(r.Size),
+				KeepForever:  r.KeepForever,
+			})
+		}
+
+		if response.NextPageToken == "" {
+			return revisions, nil
+		}
+		pageToken = response.NextPageToken
+	}
+}
+
+// KeepRevision prevents the given revision from being automatically deleted.
+func (d *DriveApi) KeepRevision(id, revisionId string) error {
+	call := func() error {
+		log.Printf("Calling Revisions.Update for %s revision %s", id,
+			revisionId)
+		_, err := d.Service.Revisions.Update(id, revisionId, &drive.Revision{
+			KeepForever: true,
+		}).Do()
+		if err != nil {
+			log.Printf("Revisions.Update response error for %s: %v", id, err)
+			return retryable(err)
+		}
+
+		// Success.
+		return nil
+	}
+
+	// Keep attempting the call until it succeeds, or we fail with a permanent
+	// error.
+	return backoff.Retry(call, backoff.NewExponentialBackOff())
+}
+
+// applyRevisionPolicy marks the latest revision of the given file to be kept
+// forever if the most recent revision that's kept is older than
+// KeepRevisionInterval. Drive otherwise discards old revisions after 30 days.
+func (d *DriveApi) applyRevisionPolicy(id string) error {
+	if d.KeepRevisionInterval <= 0 {
+		return nil
+	}
+
+	revisions, err := d.ListRevisions(id)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		return nil
+	}
+
+	head := revisions[len(revisions)-1]
+	if head.KeepForever {
+		return nil
+	}
+
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if revisions[i].KeepForever {
+			age := head.ModifiedTime.Sub(revisions[i].ModifiedTime)
+			if age < d.KeepRevisionInterval {
+				return nil
+			}
+			break
+		}
+	}
+
+	log.Printf("Keeping revision %s of %s forever", head.Id, id)
+
+	return d.KeepRevision(id, head.Id)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"log"
+)
+
+// deleteBlob deletes the remote file with the given id, unless another file or
+// a snapshot still references it.
+func deleteBlob(driveApi *api.DriveApi, db *metadb.DB, id string) error {
+	referenced, err := db.IsReferenced(id)
+	if err != nil {
+		return err
+	}
+
+	if referenced {
+		log.Printf("Keeping remote file %s as it's still referenced", id)
+		return nil
+	}
+
+	return driveApi.Delete(id)
+}
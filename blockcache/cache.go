@@ -0,0 +1,267 @@
+// Package blockcache stores fixed-size blocks of remote files on the local
+// disk, so that content that's read repeatedly doesn't have to be downloaded
+// each time. The least recently used blocks are removed once the cache grows
+// beyond its maximum size.
+package blockcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBlockSize is a suitable size for each block. Smaller blocks waste less
+// space on partially read files but need more files on disk.
+const DefaultBlockSize = 1024 * 1024
+
+// tempSuffix marks blocks that are still being written.
+const tempSuffix = ".tmp"
+
+// Key identifies a block of a remote file.
+type Key struct {
+	// Id is the id of the remote file.
+	Id string
+
+	// Version identifies the content of the remote file, such as its md5 or a
+	// revision id, so blocks of content that has since changed aren't used.
+	Version string
+
+	// Index is the index of the block within the file.
+	Index uint64
+}
+
+// entry is a block that's stored in the cache.
+type entry struct {
+	name string
+	size int64
+}
+
+// Cache is a size-bounded cache of blocks in a directory on the local disk.
+// Blocks are kept across restarts. It's safe for concurrent use.
+type Cache struct {
+	dir       string
+	blockSize uint64
+	maxSize   int64
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// lru orders the blocks from most to least recently used.
+	lru *list.List
+
+	// entries holds the element of lru for each block, keyed by file name.
+	entries map[string]*list.Element
+
+	// size is the total size of every block.
+	size int64
+}
+
+// Open returns a cache of blocks of the given size in dir, which is created if
+// it doesn't exist. Blocks already in dir are ordered by their modification
+// time, which is updated whenever they're read.
+func Open(dir string, blockSize uint64, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		dir:       dir,
+		blockSize: blockSize,
+		maxSize:   maxSize,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Oldest first, so the most recently used end up at the front.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		// Blocks that were being written when fusedrive stopped are
+		// incomplete.
+		if strings.HasSuffix(info.Name(), tempSuffix) {
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+
+		c.entries[info.Name()] = c.lru.PushFront(&entry{
+			name: info.Name(),
+			size: info.Size(),
+		})
+		c.size += info.Size()
+	}
+
+	log.Printf("Block cache holds %d blocks, %d bytes", len(c.entries), c.size)
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// BlockSize returns the size of each block. The last block of a file may be
+// smaller.
+func (c *Cache) BlockSize() uint64 {
+	return c.blockSize
+}
+
+// fileName returns the name of the file that holds the block with the given
+// key.
+func (c *Cache) fileName(key Key) string {
+	h := sha256.New()
+	h.Write([]byte(key.Id))
+	h.Write([]byte{0})
+	h.Write([]byte(key.Version))
+	h.Write([]byte{0})
+
+	// Blocks of a different size hold different content for the same index.
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], c.blockSize)
+	binary.BigEndian.PutUint64(buf[8:], key.Index)
+	h.Write(buf[:])
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the content of the block with the given key, or false if it isn't
+// in the cache.
+func (c *Cache) Get(key Key) ([]byte, bool) {
+	name := c.fileName(key)
+
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	path := filepath.Join(c.dir, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("failed to read cached block %s: %v", name, err)
+		c.remove(name)
+		return nil, false
+	}
+
+	// Keep the order across restarts.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Printf("failed to touch cached block %s: %v", name, err)
+	}
+
+	return data, true
+}
+
+// Put stores the content of the block with the given key, evicting the least
+// recently used blocks if the cache is full.
+func (c *Cache) Put(key Key, data []byte) error {
+	name := c.fileName(key)
+
+	c.mu.Lock()
+	_, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	// Write to a temporary file first so that a partially written block is
+	// never read.
+	path := filepath.Join(c.dir, name)
+	f, err := ioutil.TempFile(c.dir, name+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another reader may have stored the same block in the meantime.
+	if _, ok := c.entries[name]; ok {
+		return nil
+	}
+
+	c.entries[name] = c.lru.PushFront(&entry{
+		name: name,
+		size: int64(len(data)),
+	})
+	c.size += int64(len(data))
+	c.evict()
+
+	return nil
+}
+
+// Size returns the total size of the blocks in the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// remove forgets about the block stored in the file with the given name.
+func (c *Cache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[name]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, name)
+		c.size -= e.Value.(*entry).size
+	}
+}
+
+// evict deletes the least recently used blocks until the cache is no larger
+// than its maximum size. c.mu must be held.
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		block := e.Value.(*entry)
+
+		c.lru.Remove(e)
+		delete(c.entries, block.name)
+		c.size -= block.size
+
+		err := os.Remove(filepath.Join(c.dir, block.name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove cached block %s: %v", block.name,
+				err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package blockcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "blockcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func block(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 10)
+}
+
+// TestPutGet ensures that blocks are only returned for the same id, version
+// and index.
+func TestPutGet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := Open(dir, 10, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := Key{Id: "a", Version: "1", Index: 0}
+	if _, ok := c.Get(key); ok {
+		t.Fatal("Expecting an empty cache")
+	}
+
+	if err := c.Put(key, block(1)); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := c.Get(key); !ok || !bytes.Equal(data, block(1)) {
+		t.Fatalf("Expecting the stored block, got %v", data)
+	}
+
+	for _, other := range []Key{
+		{Id: "b", Version: "1", Index: 0},
+		{Id: "a", Version: "2", Index: 0},
+		{Id: "a", Version: "1", Index: 1},
+	} {
+		if _, ok := c.Get(other); ok {
+			t.Fatalf("Expecting no block for %v", other)
+		}
+	}
+}
+
+// TestEviction ensures that the least recently used blocks are removed once
+// the cache is full.
+func TestEviction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := Open(dir, 10, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []Key{{Id: "a"}, {Id: "b"}, {Id: "c"}, {Id: "d"}}
+	for i, key := range keys[:3] {
+		if err := c.Put(key, block(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reading a makes b the least recently used.
+	if _, ok := c.Get(keys[0]); !ok {
+		t.Fatal("Expecting a to be cached")
+	}
+	if err := c.Put(keys[3], block(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.Get(keys[1]); ok {
+		t.Fatal("Expecting b to be evicted")
+	}
+	for _, key := range []Key{keys[0], keys[2], keys[3]} {
+		if _, ok := c.Get(key); !ok {
+			t.Fatalf("Expecting %s to be cached", key.Id)
+		}
+	}
+	if c.Size() != 30 {
+		t.Fatalf("Expecting 30 bytes to be cached, got %d", c.Size())
+	}
+}
+
+// TestReopen ensures that blocks survive a restart, and that incomplete blocks
+// are removed.
+func TestReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := Open(dir, 10, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key{Id: "a", Version: "1", Index: 3}
+	if err := c.Put(key, block(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	incomplete := filepath.Join(dir, "partial"+tempSuffix)
+	if err := ioutil.WriteFile(incomplete, block(2), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(dir, 10, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := c.Get(key); !ok || !bytes.Equal(data, block(1)) {
+		t.Fatal("Expecting block to survive a restart")
+	}
+	if _, err := os.Stat(incomplete); !os.IsNotExist(err) {
+		t.Fatalf("Expecting incomplete block to be removed, got %v", err)
+	}
+
+	// A different block size doesn't reuse the same blocks.
+	c, err = Open(dir, 20, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(key); ok {
+		t.Fatal("Expecting no block with a different block size")
+	}
+
+	// Shrinking the cache evicts blocks when it's opened.
+	c, err = Open(dir, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 0 {
+		t.Fatalf("Expecting every block to be evicted, got %d bytes",
+			c.Size())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"math"
+	"os"
+)
+
+// errChecksumMismatch is returned when the content of a file doesn't match the
+// checksums recorded when it was uploaded.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// computeChecksums returns the md5 of the content of f and, if withSha256 is
+// set, its sha256.
+func computeChecksums(f *os.File, withSha256 bool) (md5sum, sha256sum []byte,
+	err error) {
+	return checksumReader(io.NewSectionReader(f, 0, math.MaxInt64), withSha256)
+}
+
+// checksumReader returns the md5 of everything read from r and, if withSha256
+// is set, its sha256.
+func checksumReader(r io.Reader, withSha256 bool) (md5sum, sha256sum []byte,
+	err error) {
+	md5Hash := md5.New()
+	var w io.Writer = md5Hash
+
+	var sha256Hash hash.Hash
+	if withSha256 {
+		sha256Hash = sha256.New()
+		w = io.MultiWriter(md5Hash, sha256Hash)
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md5sum = md5Hash.Sum(nil)
+	if sha256Hash != nil {
+		sha256sum = sha256Hash.Sum(nil)
+	}
+	return md5sum, sha256sum, nil
+}
+
+// verifyChecksums checks the content of f against the expected checksums.
+// Checksums that weren't recorded aren't checked.
+func verifyChecksums(f *os.File, md5sum, sha256sum []byte) error {
+	if len(md5sum) == 0 && len(sha256sum) == 0 {
+		return nil
+	}
+
+	actualMd5, actualSha256, err := computeChecksums(f, len(sha256sum) > 0)
+	if err != nil {
+		return err
+	}
+
+	if len(md5sum) > 0 && !bytes.Equal(md5sum, actualMd5) {
+		return errChecksumMismatch
+	}
+	if len(sha256sum) > 0 && !bytes.Equal(sha256sum, actualSha256) {
+		return errChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// command is an administrative task that operates on the database while the
+// filesystem is unmounted.
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(dataDir string, args []string) error
+}
+
+var commands = []command{
+	{
+		name:  "status",
+		usage: "list files whose content isn't synced with Google Drive",
+		run:   status,
+	},
+	{
+		name:  "trash",
+		usage: "list the files in the trash",
+		run:   listTrash,
+	},
+	{
+		name:  "restore",
+		args:  "ENTRY [PATH]",
+		usage: "restore a file from the trash to PATH or its original path",
+		run:   restore,
+	},
+	{
+		name:  "snapshot",
+		args:  "create|delete NAME | list",
+		usage: "manage read-only snapshots of the filesystem",
+		run:   snapshot,
+	},
+	{
+		name:  "fsck",
+		args:  "[-repair] [-remove-missing]",
+		usage: "check the database against Google Drive and fix problems",
+		run:   fsck,
+	},
+	{
+		name:  "gc",
+		args:  "[-dry-run] [-grace DURATION] [-trash]",
+		usage: "remove files on Google Drive that nothing references",
+		run:   gc,
+	},
+	{
+		name:  "encrypt",
+		args:  "[-passphrase-file FILE] [-metadata]",
+		usage: "encrypt the content of files written to an empty filesystem",
+		run:   encrypt,
+	},
+	{
+		name: "rekey",
+		args: "[-passphrase-file FILE] [-new-passphrase-file FILE] [-rotate] " +
+			"[-keep-passphrase]",
+		usage: "change the passphrase or rotate the data key",
+		run:   rekey,
+	},
+}
+
+// newDriveApi returns a DriveApi for the filesystem with the given database.
+func newDriveApi(dataDir string, db *metadb.DB) (*api.DriveApi, error) {
+	owner, err := db.OwnerId()
+	if err != nil {
+		return nil, err
+	}
+
+	driveApi := api.NewDriveApi(dataDir)
+	driveApi.Owner = owner
+	return driveApi, nil
+}
+
+// findCommand returns the command with the given name, or nil if there isn't
+// one.
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// printCommands writes the usage of every command to stdout.
+func printCommands(program string) {
+	for _, cmd := range commands {
+		fmt.Printf("       %s [options] %s\n", program,
+			strings.TrimSpace(cmd.name+" "+cmd.args))
+		fmt.Printf("           %s\n", cmd.usage)
+	}
+}
+
+// newFlagSet returns a FlagSet for the arguments of the given command.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+func status(dataDir string, args []string) error {
+	db, err := openDB(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Walk(func(name string, attributes metadb.Attributes) error {
+		if !attributes.IsRegularFile || attributes.HasContent ||
+			attributes.State == metadb.Synced {
+			return nil
+		}
+
+		fmt.Printf("%s\t%d\t%s\n", attributes.State, attributes.Size, name)
+		return nil
+	})
+}
+
+func listTrash(dataDir string, args []string) error {
+	db, err := openDB(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	entries, err := db.ListTrash()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\t%s\n", entry.Name,
+			entry.DeletedAt.Format("2006-01-02 15:04:05"), entry.Path)
+	}
+
+	return nil
+}
+
+func restore(dataDir string, args []string) error {
+	flags := newFlagSet("restore")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: restore ENTRY [PATH]")
+	}
+
+	db, err := openDB(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	entry, err := db.GetTrashEntry(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("unable to find %s in trash: %v", flags.Arg(0), err)
+	}
+
+	target := entry.Path
+	if flags.NArg() == 2 {
+		target = strings.Trim(flags.Arg(1), "/")
+	}
+
+	// The directory the file was deleted from may have been deleted too.
+	if err := mkdirAll(db, path.Dir(target)); err != nil {
+		return err
+	}
+
+	err = db.RestoreFromTrash(entry.Name, target)
+	if err == metadb.AlreadyExists {
+		return fmt.Errorf("%s already exists", target)
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Restored %s to %s\n", entry.Name, target)
+
+	return nil
+}
+
+// mkdirAll creates the directory name along with any parents that don't
+// already exist.
+func mkdirAll(db *metadb.DB, name string) error {
+	if name == "." || name == "" {
+		return nil
+	}
+
+	_, err := db.GetAttributes(name)
+	if err == nil {
+		return nil
+	} else if err != metadb.DoesNotExist {
+		return err
+	}
+
+	if err := mkdirAll(db, path.Dir(name)); err != nil {
+		return err
+	}
+
+	return db.SetAttributes(name, metadb.Attributes{
+		// This is only ever used locally, so just generate a random id.
+		Id:            GenerateId(),
+		Mode:          0755,
+		IsRegularFile: false,
+	})
+}
+
+func snapshot(dataDir string, args []string) error {
+	flags := newFlagSet("snapshot")
+	flags.Parse(args)
+
+	action := flags.Arg(0)
+	name := flags.Arg(1)
+
+	switch {
+	case action == "list" && flags.NArg() == 1:
+	case (action == "create" || action == "delete") && flags.NArg() == 2:
+		if strings.Contains(name, "/") {
+			return fmt.Errorf("snapshot name must not contain /")
+		}
+	default:
+		return fmt.Errorf("usage: snapshot create|delete NAME | list")
+	}
+
+	db, err := openDB(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch action {
+	case "list":
+		snapshots, err := db.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			fmt.Printf("%s\t%s\n", s.Name,
+				s.Created.Format("2006-01-02 15:04:05"))
+		}
+
+	case "create":
+		err := db.CreateSnapshot(name, time.Now())
+		if err == metadb.AlreadyExists {
+			return fmt.Errorf("snapshot %s already exists", name)
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Created snapshot %s\n", name)
+
+	case "delete":
+		released, err := db.DeleteSnapshot(name)
+		if err == metadb.DoesNotExist {
+			return fmt.Errorf("snapshot %s does not exist", name)
+		} else if err != nil {
+			return err
+		}
+
+		// Remote files that only this snapshot referenced are no longer
+		// reachable.
+		if len(released) > 0 {
+			driveApi, err := newDriveApi(dataDir, db)
+			if err != nil {
+				return err
+			}
+			for _, id := range released {
+				if err := deleteBlob(driveApi, db, id); err != nil {
+					log.Printf("failed to delete remote file %s: %v", id, err)
+				}
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Deleted snapshot %s, released %d files\n",
+			name, len(released))
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/md5"
+	"github.com/simonhorlick/fusedrive/encryption"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+)
+
+// encryptFile encrypts the content of f into a new temporary file, which it
+// returns along with the md5 of the encrypted content.
+func encryptFile(keyring *encryption.Keyring, f *os.File) (*os.File, []byte,
+	error) {
+	blob, err := ioutil.TempFile("", "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md5Hash := md5.New()
+	w, err := keyring.NewWriter(io.MultiWriter(blob, md5Hash))
+	if err == nil {
+		_, err = io.Copy(w, io.NewSectionReader(f, 0, math.MaxInt64))
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		removeTempFile(blob)
+		return nil, nil, err
+	}
+
+	return blob, md5Hash.Sum(nil), nil
+}
+
+// decryptFile replaces the content of f with the decrypted content of blob.
+func decryptFile(keyring *encryption.Keyring, blob, f *os.File) error {
+	r, err := keyring.NewReader(io.NewSectionReader(blob, 0, math.MaxInt64))
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// removeTempFile closes and deletes a temporary file.
+func removeTempFile(f *os.File) {
+	if err := f.Close(); err != nil {
+		log.Printf("failed to close temporary file: %v", err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		log.Printf("failed to remove temporary file: %v", err)
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/encryption"
 	"github.com/simonhorlick/fusedrive/metadb"
 	"github.com/simonhorlick/fusedrive/serialize_reads"
 	"google.golang.org/api/drive/v3"
@@ -16,16 +18,48 @@ import (
 
 var _ nodefs.File = &DriveFile{} // Verify that interface is implemented.
 
-func NewDriveFile(driveApi *api.DriveApi, db *metadb.DB, file api.DriveApiFile) nodefs.File {
+func NewDriveFile(driveApi *api.DriveApi, db *metadb.DB, file api.DriveApiFile,
+	readOptions ReadOptions) nodefs.File {
 	return &DriveFile{
 		driveApi:     driveApi,
 		File:         NewUnimplementedFile(),
 		DriveApiFile: file,
 		db:           db,
-		lastReadData: make([]byte, 0, fuse.MAX_KERNEL_WRITE),
+		readOptions:  readOptions,
+		serializer:   serialize_reads.New(readOptions.Serializer),
 	}
 }
 
+// NewReadOnlyDriveFile returns a file for reading content from the remote that
+// isn't part of the live filesystem, such as a previous revision of a file. If
+// keyring is non-nil the remote copy is encrypted, and file.Size is the size of
+// its content.
+func NewReadOnlyDriveFile(driveApi *api.DriveApi, file api.DriveApiFile,
+	attributes *fuse.Attr, keyring *encryption.Keyring,
+	readOptions ReadOptions) nodefs.File {
+	return &DriveFile{
+		driveApi:     driveApi,
+		File:         NewUnimplementedFile(),
+		DriveApiFile: file,
+		attributes:   attributes,
+		keyring:      keyring,
+		readOptions:  readOptions,
+		serializer:   serialize_reads.New(readOptions.Serializer),
+	}
+}
+
+// NewStreamingDriveFile returns a read-only file that streams the content of a
+// file in the live filesystem from the remote. attributes are the attributes of
+// the file when it was opened, and release is called when it's released.
+func NewStreamingDriveFile(driveApi *api.DriveApi, file api.DriveApiFile,
+	attributes *fuse.Attr, keyring *encryption.Keyring,
+	readOptions ReadOptions, release func()) nodefs.File {
+	f := NewReadOnlyDriveFile(driveApi, file, attributes, keyring,
+		readOptions).(*DriveFile)
+	f.release = release
+	return f
+}
+
 type DriveFile struct {
 	driveApi *api.DriveApi
 
@@ -34,21 +68,33 @@ type DriveFile struct {
 	// The database to store file metadata.
 	db *metadb.DB
 
-	// reader is a read buffer for this file. Data is requested from the api in
-	// large chunks to increase throughput and buffered here until it is
-	// requested. This helps with sequential reads where fuse requests many
-	// small chunks of data.
-	reader io.ReadCloser
+	// attributes are the fixed attributes of a file that isn't part of the
+	// live filesystem, such as a previous revision. Such files are read-only.
+	// If nil, attributes are read from the database.
+	attributes *fuse.Attr
+
+	// keyring holds the keys to decrypt the remote copy, or nil if it isn't
+	// encrypted.
+	keyring *encryption.Keyring
+
+	// decrypter decrypts the chunks of an encrypted remote copy. It's created
+	// from the header of the file on the first read.
+	decrypter *encryption.Decrypter
 
-	// We cache the most recent read in memory in case we get more reads for
-	// this chunk in non-sequential order.
-	lastReadOffset int64
-	lastReadData   []byte
+	// readOptions configures how the file is read from the remote.
+	readOptions ReadOptions
 
-	// readerPosition is the current position of reader in the file. If a read
-	// comes in for an offset that isn't equal to readerPosition we dispose of
-	// the reader and create a new one.
-	readerPosition int64
+	// serializer reorders concurrent reads of this file so they reach its
+	// streams in order of offset.
+	serializer *serialize_reads.Serializer
+
+	// release is called when the file is released, if it's set.
+	release func()
+
+	// streams are the sequential streams of reads being followed through the
+	// file. If a read comes in for an offset that doesn't continue any of
+	// them we start a new stream.
+	streams []*readStream
 
 	// os.File is not threadsafe. Although fd themselves are
 	// constant during the lifetime of an open file, the OS may
@@ -77,61 +123,69 @@ func (f *DriveFile) String() string {
 // that begins streaming data from the given offset in the file using much
 // larger block sizes to increase throughput. It's very likely that subsequent
 // calls to Read will be sequential, so we can continue taking data from the
-// Reader and advancing it each time.
+// Reader and advancing it each time. Several such streams are followed at once
+// for clients that read from more than one place in the file.
 func (f *DriveFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse.Status) {
 	log.Printf("Read for %s at offset %d bufsize %d", f.Name, off, len(buf))
 
 	// Read requests can arrive out of order, which kills sequential read
 	// performance. Attempt to re-order them by waiting to see what other
 	// requests come in.
-	serialize_reads.Wait(off, len(buf))
-	defer serialize_reads.Done()
+	token, err := f.serializer.Wait(context.Background(), off, len(buf))
+	if err != nil {
+		log.Printf("error waiting to read %s: %v", f.Name, err)
+		return nil, fuse.EIO
+	}
+	defer token.Done()
+
+	// The serializer lets the next read through if this one takes too long,
+	// so the reader must still be protected from concurrent use.
+	f.lock.Lock()
+	defer f.lock.Unlock()
 
 	//log.Printf("DriveFile reading %s at offset %d bufsize %d", f.Name, off, len(buf))
 
-	// If we can reuse an existing reader, then do that. Otherwise create a new
-	// reader at the given offset.
-	if f.reader == nil {
-		log.Printf("DriveFile New reader created at offset %d", off)
-		// Start off by assuming sequential reads, if the reads aren't
-		// sequential then we'll re-create the reader and mark it
-		// non-sequential.
-		f.reader = api.NewFileReader(f.driveApi, f.Id,
-			f.Size, uint64(off), true)
-	} else if f.readerPosition != off {
-		// If this is a re-read of the previously fetched chunk, then return
-		// that.
-		if off >= f.lastReadOffset && off < f.lastReadOffset+int64(len(f.lastReadData)) {
-			offsetInLastRead := off - f.lastReadOffset
+	if off >= int64(f.Size) {
+		return fuse.ReadResultData(buf[:0]), fuse.OK
+	}
 
-			n := copy(buf, f.lastReadData[offsetInLastRead:])
+	// If we can continue an existing stream, then do that. Otherwise create a
+	// new stream at the given offset.
+	current := f.findStream(off)
+	if current == nil {
+		// If this is a re-read of a previously fetched chunk, then return
+		// that.
+		for _, s := range f.streams {
+			if s.hasRead(off) {
+				n := copy(buf, s.lastReadData[off-s.lastReadOffset:])
 
-			log.Printf("Returning %d bytes [%d, %d] from last read", n, off,
-				int64(n)+off-1)
+				log.Printf("Returning %d bytes [%d, %d] from last read", n,
+					off, int64(n)+off-1)
 
-			return fuse.ReadResultData(buf[:n]), fuse.OK
+				return fuse.ReadResultData(buf[:n]), fuse.OK
+			}
 		}
 
-		log.Printf("DriveFile Non-sequential read at offset %d, reader is currently at %d",
-			off, f.readerPosition)
-		_ = f.reader.Close()
-		f.reader = api.NewFileReader(f.driveApi, f.Id, f.Size, uint64(off), false)
-		f.readerPosition = off
+		current, err = f.newStream(off)
+		if err != nil {
+			log.Printf("error creating reader: %v", err)
+			return nil, fuse.EIO
+		}
 	}
+	f.touch(current)
 
-	remaining := f.Size - uint64(f.readerPosition)
+	remaining := f.Size - uint64(current.position)
 
 	// buf might be larger than the remaining data in the file, in that case
 	// read as much data as there is remaining. Otherwise just fill buf.
-	n, err := io.ReadAtLeast(f.reader, buf, min(int(remaining), len(buf)))
-	f.readerPosition += int64(n)
+	n, err := io.ReadAtLeast(current.reader, buf, min(int(remaining), len(buf)))
+	current.position += int64(n)
 
 	log.Printf("Returning %d bytes [%d, %d], next byte is at %d", n, off,
-		int64(n)+off-1, f.readerPosition)
+		int64(n)+off-1, current.position)
 
-	f.lastReadOffset = off
-	copy(f.lastReadData[:n], buf[:n])
-	f.lastReadData = f.lastReadData[:n]
+	current.lastReadOffset = off
+	current.lastReadData = append(current.lastReadData[:0], buf[:n]...)
 
 	if err == io.EOF {
 		log.Printf("DriveFile received EOF")
@@ -141,14 +195,82 @@ func (f *DriveFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse.
 	if err != nil {
 		// TODO(simon): Figure out the correct error code here.
 		log.Printf("error reading file: %v", err)
+
+		// The stream can't be relied on to be at the right position.
+		f.closeStream(current)
 		return nil, fuse.EIO
 	}
 
+	if err := f.promote(current); err != nil {
+		log.Printf("error promoting stream: %v", err)
+		f.closeStream(current)
+	}
+
 	//log.Printf("DriveFile Read %d bytes", n)
 
 	return fuse.ReadResultData(buf[:n]), fuse.OK
 }
 
+// decryptingReader decrypts the content read from an encrypted remote copy.
+type decryptingReader struct {
+	io.Reader
+	remote *api.FileReader
+}
+
+func (r decryptingReader) Close() error {
+	return r.remote.Close()
+}
+
+func (r decryptingReader) Reset() {
+	r.remote.Reset()
+}
+
+// newReader returns a reader of the content of this file from off onwards.
+func (f *DriveFile) newReader(off int64, sequential bool) (io.ReadCloser,
+	error) {
+	if f.keyring == nil {
+		return api.NewRevisionReader(f.driveApi, f.Id, f.Revision, f.Version,
+			f.Size, uint64(off), sequential), nil
+	}
+
+	ciphertextSize := encryption.CiphertextSize(f.Size)
+	if f.decrypter == nil {
+		decrypter, err := f.readHeader(ciphertextSize)
+		if err != nil {
+			return nil, err
+		}
+		f.decrypter = decrypter
+	}
+
+	// Start reading from the beginning of the chunk that holds off.
+	start, _ := f.decrypter.CiphertextRange(uint64(off), 1)
+	remote := api.NewRevisionReader(f.driveApi, f.Id, f.Revision, f.Version,
+		ciphertextSize, start, sequential)
+
+	return decryptingReader{
+		Reader: f.decrypter.NewReader(remote, uint64(off)),
+		remote: remote,
+	}, nil
+}
+
+// readHeader fetches the header of the encrypted remote copy of this file.
+func (f *DriveFile) readHeader(ciphertextSize uint64) (*encryption.Decrypter,
+	error) {
+	body, err := api.NewRevisionReader(f.driveApi, f.Id, f.Revision, "",
+		ciphertextSize, 0, false).ReadAt(uint64(encryption.HeaderSize), 0)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	h := make([]byte, encryption.HeaderSize)
+	if _, err := io.ReadFull(body, h); err != nil {
+		return nil, err
+	}
+
+	return f.keyring.NewDecrypter(h, ciphertextSize)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -159,12 +281,28 @@ func min(a, b int) int {
 
 func (f *DriveFile) Release() {
 	log.Printf("Release %s", f.Name)
-	// TODO(simon): Is there anything to do here?
+
+	f.serializer.Close()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.streams) > 0 {
+		f.closeStream(f.streams[0])
+	}
+
+	if f.release != nil {
+		f.release()
+	}
 }
 
 func (f *DriveFile) GetAttr(out *fuse.Attr) fuse.Status {
 	log.Printf("GetAttr \"%s\"", f.Name)
 
+	if f.attributes != nil {
+		*out = *f.attributes
+		return fuse.OK
+	}
+
 	attributes, err := f.db.GetAttributes(f.Name)
 
 	if err == metadb.DoesNotExist {
@@ -206,6 +344,10 @@ func (f *DriveFile) Flush() fuse.Status {
 // lost.  If the file previously was shorter, it is extended, and the
 // extended part reads as null bytes ('\0').
 func (f *DriveFile) Truncate(size uint64) fuse.Status {
+	if f.attributes != nil {
+		return fuse.EPERM
+	}
+
 	// TODO(simon): Do we need to implement this?
 	if size != 0 {
 		log.Printf("error: truncating file to non-zero size is not implemented")
@@ -1,23 +1,60 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
+	"encoding/hex"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	. "github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/encryption"
 	"github.com/simonhorlick/fusedrive/metadb"
 	"log"
-	"math"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // Verify that interface is implemented.
 var _ pathfs.FileSystem = &DriveFileSystem{}
 
-var EmptyId = string(bytes.Repeat([]byte{0x00}, 33))
+// DriveFileSystemOptions configures the behaviour of a DriveFileSystem.
+type DriveFileSystemOptions struct {
+	// TrashRetention is how long deleted files are kept in the trash before
+	// they're deleted from the remote. If zero, files are deleted immediately.
+	TrashRetention time.Duration
+
+	// CapToStagingDisk limits the free space reported by StatFs to the free
+	// space on the local disk that files are written to before uploading.
+	CapToStagingDisk bool
+
+	// Sha256Checksums records the sha256 of uploaded files as well as the md5
+	// that Drive provides.
+	Sha256Checksums bool
+
+	// Dedup stores files with identical content as a single remote file. This
+	// implies Sha256Checksums, as files are matched by their sha256.
+	Dedup bool
+
+	// ScrubBandwidth is the maximum rate, in bytes per second, at which files
+	// are downloaded to verify their checksums. If zero, files aren't
+	// scrubbed.
+	ScrubBandwidth int64
+
+	// ScrubInterval is how often each file is verified by the scrubber.
+	ScrubInterval time.Duration
+
+	// Keyring holds the keys used to encrypt file content before it's
+	// uploaded. If nil, files are stored unencrypted.
+	Keyring *encryption.Keyring
+
+	// Reads configures how files that are streamed from the remote are read.
+	Reads ReadOptions
+
+	// Streaming decides which files opened read-only are streamed from the
+	// remote instead of being downloaded in full first.
+	Streaming StreamPolicy
+}
 
 // DriveFileSystem exposes the Google Drive api as a fuse filesystem.
 type DriveFileSystem struct {
@@ -28,36 +65,56 @@ type DriveFileSystem struct {
 
 	// db is a database that stores all of the filesystem metadata.
 	db *metadb.DB
+
+	options DriveFileSystemOptions
+
+	// revisions caches the revisions listed in versions directories.
+	revisions *revisionCache
+
+	// quota caches the storage quota of the Drive account and the size of the
+	// filesystem for StatFs.
+	quota quotaCache
+
+	// quit is closed when the filesystem is unmounted to stop any background
+	// tasks.
+	quit chan struct{}
 }
 
-func NewDriveFileSystem(api *DriveApi, db *metadb.DB) pathfs.FileSystem {
+func NewDriveFileSystem(api *DriveApi, db *metadb.DB,
+	options DriveFileSystemOptions) pathfs.FileSystem {
 	log.Print("Creating DriveFileSystem")
 	return &DriveFileSystem{
-		FileSystem: pathfs.NewDefaultFileSystem(),
-		driveApi:   api,
-		db:         db,
-		localFileCache: NewLocalFileCache(api, db),
-	}
-}
-
-func (fs *DriveFileSystem) StatFs(name string) *fuse.StatfsOut {
-	return &fuse.StatfsOut{
-		Blocks: math.MaxUint64,
-		Bfree:  math.MaxUint64,
-		Bavail: math.MaxUint64,
-		Files:  0,
-		Ffree:  math.MaxUint64,
-		Bsize:  uint32(16 * 1024 * 1024),
-		Frsize: uint32(16 * 1024 * 1024),
+		FileSystem:     pathfs.NewDefaultFileSystem(),
+		driveApi:       api,
+		db:             db,
+		localFileCache: NewLocalFileCache(api, db, options),
+		options:        options,
+		revisions:      newRevisionCache(),
+		quit:           make(chan struct{}),
 	}
 }
 
 func (fs *DriveFileSystem) OnMount(nodeFs *pathfs.PathNodeFs) {
 	log.Printf("OnMount %v", nodeFs)
+
+	if fs.options.TrashRetention > 0 {
+		go fs.runTrashPurger()
+	}
+
+	go fs.runQuotaRefresher()
+
+	if fs.options.ScrubBandwidth > 0 {
+		go fs.runScrubber()
+	}
+
+	if fs.options.Keyring != nil {
+		go fs.runRotator()
+	}
 }
 
 func (fs *DriveFileSystem) OnUnmount() {
 	log.Print("OnUnmount")
+	close(fs.quit)
 }
 
 // toFuseAttributes adapts the attributes in the database into fuse attributes.
@@ -68,6 +125,10 @@ func toFuseAttributes(attributes metadb.Attributes, out *fuse.Attr) {
 	} else {
 		out.Mode = fuse.S_IFDIR | attributes.Mode
 	}
+
+	if !attributes.Mtime.IsZero() {
+		out.SetTimes(nil, &attributes.Mtime, &attributes.Mtime)
+	}
 }
 
 func (fs *DriveFileSystem) GetAttr(name string, context *fuse.Context) (
@@ -77,9 +138,16 @@ func (fs *DriveFileSystem) GetAttr(name string, context *fuse.Context) (
 		return &fuse.Attr{Mode: fuse.S_IFDIR | 0755}, fuse.OK
 	}
 
+	if inSnapshots(name) {
+		return fs.getSnapshotAttr(name)
+	}
+
 	attributes, err := fs.db.GetAttributes(name)
 
 	if err == metadb.DoesNotExist {
+		if file, version, ok := splitVersionsPath(name); ok {
+			return fs.getVersionAttr(file, version)
+		}
 		return nil, fuse.ENOENT
 	} else if err != nil {
 		log.Printf("failed to read file metadata %s: %v", name, err)
@@ -97,8 +165,17 @@ func (fs *DriveFileSystem) OpenDir(name string, context *fuse.Context) (
 	stream []fuse.DirEntry, status fuse.Status) {
 	log.Printf("OpenDir \"%s\"", name)
 
+	if inSnapshots(name) {
+		return fs.openSnapshotDir(name)
+	}
+
 	entries, err := fs.db.List(name)
-	if err != nil {
+	if err == metadb.DoesNotExist {
+		if file, version, ok := splitVersionsPath(name); ok && version == "" {
+			return fs.openVersionsDir(file)
+		}
+		return nil, fuse.ENOENT
+	} else if err != nil {
 		log.Printf("failed to read directory listing for %s: %v", name, err)
 		return nil, fuse.EIO
 	}
@@ -162,9 +239,16 @@ func (fs *DriveFileSystem) Open(name string, flags uint32,
 	context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
 	log.Printf("Open \"%s\" (%s)", name, PrintFlags(flags))
 
+	if inSnapshots(name) {
+		return fs.openSnapshotFile(name, flags)
+	}
+
 	attributes, err := fs.db.GetAttributes(name)
 
 	if err == metadb.DoesNotExist {
+		if file, version, ok := splitVersionsPath(name); ok && version != "" {
+			return fs.openVersion(name, file, version, flags)
+		}
 		return nil, fuse.ENOENT
 	} else if err != nil {
 		log.Printf("failed to read file metadata %s: %v", name, err)
@@ -181,7 +265,41 @@ func (fs *DriveFileSystem) Open(name string, flags uint32,
 	accessMode := flags & syscall.O_ACCMODE
 	readOnly := accessMode == syscall.O_RDONLY
 
-	return fs.localFileCache.Open(name, attributes.Id, readOnly), fuse.OK
+	// Files in the trash can only be read.
+	if inTrash(name) && !readOnly {
+		return nil, fuse.EROFS
+	}
+
+	if readOnly && fs.options.Streaming.ShouldStream(name, attributes) &&
+		fs.localFileCache.OpenStream(name, attributes) {
+		out := new(fuse.Attr)
+		toFuseAttributes(attributes, out)
+
+		inode, id := attributes.Inode, attributes.Id
+		return NewStreamingDriveFile(fs.driveApi, DriveApiFile{
+			Name:    name,
+			Id:      attributes.Id,
+			Size:    attributes.Size,
+			Version: hex.EncodeToString(attributes.Md5),
+		}, out, fs.options.Keyring, fs.options.Reads, func() {
+			fs.localFileCache.ReleaseStream(inode, id)
+		}), fuse.OK
+	}
+
+	return fs.openLocal(name, attributes, readOnly)
+}
+
+// openLocal opens the local copy of the file with the given attributes.
+func (fs *DriveFileSystem) openLocal(name string, attributes metadb.Attributes,
+	isReader bool) (nodefs.File, fuse.Status) {
+	file, err := fs.localFileCache.Open(name, attributes, isReader)
+	if err == metadb.DoesNotExist {
+		return nil, fuse.ENOENT
+	} else if err != nil {
+		log.Printf("failed to open %s: %v", name, err)
+		return nil, fuse.EIO
+	}
+	return file, fuse.OK
 }
 
 func RandomBytes() []byte {
@@ -202,12 +320,21 @@ func GenerateId() string {
 func (fs *DriveFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
 	log.Printf("Mkdir \"%s\"", name)
 
+	if inSnapshots(name) {
+		return fuse.EROFS
+	}
+
+	if inTrash(name) {
+		return fuse.EPERM
+	}
+
 	err := fs.db.SetAttributes(name, metadb.Attributes{
 		// This is only ever used locally, so just generate a random id.
 		Id:            GenerateId(),
 		Size:          0,
 		Mode:          mode,
 		IsRegularFile: false,
+		Mtime:         time.Now(),
 	})
 	if err != nil {
 		log.Printf("failed to create directory %s: %v", name, err)
@@ -221,7 +348,26 @@ func (fs *DriveFileSystem) Rename(oldName string, newName string,
 	context *fuse.Context) (code fuse.Status) {
 	log.Printf("Rename \"%s\" -> \"%s\"", oldName, newName)
 
-	err := fs.db.Rename(oldName, newName)
+	if inSnapshots(oldName) || inSnapshots(newName) {
+		return fuse.EROFS
+	}
+
+	// Files can only be moved into the trash by deleting them, and the trash
+	// itself can't be moved.
+	if inTrash(newName) || oldName == metadb.TrashDir {
+		return fuse.EPERM
+	}
+
+	// Rename the file in the database and any files that are currently open
+	// beneath it. Moving a file out of the trash restores it.
+	var err error
+	if entry, ok := trashEntryName(oldName); ok {
+		err = fs.restore(entry, newName)
+	} else {
+		err = fs.localFileCache.Rename(oldName, newName, func() error {
+			return fs.db.Rename(oldName, newName)
+		})
+	}
 	if err == metadb.DoesNotExist {
 		return fuse.ENOENT
 	}
@@ -230,7 +376,7 @@ func (fs *DriveFileSystem) Rename(oldName string, newName string,
 	}
 
 	if err != nil {
-		log.Printf("failed to rename file %s: %v", oldName)
+		log.Printf("failed to rename file %s: %v", oldName, err)
 		return fuse.EIO
 	}
 
@@ -241,6 +387,14 @@ func (fs *DriveFileSystem) Create(name string, flags uint32, mode uint32,
 	context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	log.Printf("Create \"%s\" (%s)", name, PrintFlags(flags))
 
+	if inSnapshots(name) {
+		return nil, fuse.EROFS
+	}
+
+	if inTrash(name) {
+		return nil, fuse.EPERM
+	}
+
 	// Ensure the file doesn't already exist.
 	_, err := fs.db.GetAttributes(name)
 	if err != metadb.DoesNotExist {
@@ -266,19 +420,27 @@ func (fs *DriveFileSystem) Create(name string, flags uint32, mode uint32,
 		return fs.Open(name, flags, context)
 	} else {
 		err := fs.db.SetAttributes(name, metadb.Attributes{
-			// Empty id signals that the file needs to be created on the remote.
-			Id:            EmptyId,
+			// The file is created on the remote when it's first written.
 			Size:          0,
 			Mode:          mode,
 			IsRegularFile: true,
 			HasContent:    false,
+			State:         metadb.LocalOnly,
+			Mtime:         time.Now(),
 		})
 		if err != nil {
 			log.Printf("failed to create attributes for file %s: %v", name, err)
 			return nil, fuse.EIO
 		}
 
-		return fs.localFileCache.Open(name, EmptyId, false), fuse.OK
+		// Read the attributes back to find the inode that was assigned.
+		attributes, err := fs.db.GetAttributes(name)
+		if err != nil {
+			log.Printf("failed to read attributes for file %s: %v", name, err)
+			return nil, fuse.EIO
+		}
+
+		return fs.openLocal(name, attributes, false)
 	}
 }
 
@@ -286,31 +448,88 @@ func (fs *DriveFileSystem) Unlink(name string, context *fuse.Context) (
 	code fuse.Status) {
 	log.Printf("Unlink \"%s\"", name)
 
-	attributes, err := fs.db.GetAndDeleteAttributes(name)
+	if inSnapshots(name) {
+		return fuse.EROFS
+	}
+
+	// Deleting a file from the trash removes it permanently.
+	if entry, ok := trashEntryName(name); ok {
+		attributes, err := fs.db.RemoveFromTrash(entry)
+		if err == metadb.DoesNotExist {
+			return fuse.ENOENT
+		} else if err != nil {
+			log.Printf("Failed to remove %s from trash: %v", name, err)
+			return fuse.EIO
+		}
+
+		return fs.removeRemote(name, attributes)
+	}
+
+	attributes, err := fs.db.GetAttributes(name)
 	if err == metadb.DoesNotExist {
 		return fuse.ENOENT
 	} else if err != nil {
-		log.Printf("Failed to delete metadata for file %s: %v", name, err)
+		log.Printf("Failed to read metadata for file %s: %v", name, err)
 		return fuse.EIO
 	}
 
-	if attributes.HasContent {
-		err := fs.db.RemoveFile(name)
+	// Files stored in the database are small enough that they're not worth
+	// keeping, everything else is moved to the trash if it's enabled. Any
+	// clients that have the file open can continue to use it.
+	if fs.options.TrashRetention > 0 && !attributes.HasContent {
+		now := time.Now()
+		entry := newTrashEntryName(name, now)
+		err := fs.localFileCache.Rename(name, metadb.TrashPath(entry),
+			func() error {
+				return fs.db.MoveToTrash(name, entry, now)
+			})
 		if err != nil {
+			log.Printf("Failed to move file %s to trash: %v", name, err)
 			return fuse.EIO
 		}
-	} else {
-		// Only allow deleting files that aren't in use.
-		if fs.localFileCache.IsOpen(name) {
-			return fuse.EBUSY
-		}
 
-		err := fs.driveApi.Delete(attributes.Id)
+		return fuse.OK
+	}
+
+	attributes, err = fs.db.GetAndDeleteAttributes(name)
+	if err == metadb.DoesNotExist {
+		return fuse.ENOENT
+	} else if err != nil {
+		log.Printf("Failed to delete metadata for file %s: %v", name, err)
+		return fuse.EIO
+	}
+
+	if attributes.HasContent {
+		err := fs.db.RemoveFile(name)
 		if err != nil {
-			log.Printf("Failed to delete file %s (%s): %v", name, attributes.Id,
-				err)
 			return fuse.EIO
 		}
+
+		return fuse.OK
+	}
+
+	return fs.removeRemote(name, attributes)
+}
+
+// removeRemote deletes the remote copy of a file that has been removed from the
+// database. If the file is still open then it's deleted from the remote when
+// the last client releases it.
+func (fs *DriveFileSystem) removeRemote(name string,
+	attributes metadb.Attributes) fuse.Status {
+	if fs.localFileCache.Unlink(attributes) {
+		return fuse.OK
+	}
+
+	// This file was never uploaded, so there's nothing to delete.
+	if attributes.Id == "" {
+		return fuse.OK
+	}
+
+	err := deleteBlob(fs.driveApi, fs.db, attributes.Id)
+	if err != nil {
+		log.Printf("Failed to delete file %s (%s): %v", name, attributes.Id,
+			err)
+		return fuse.EIO
 	}
 
 	return fuse.OK
@@ -319,6 +538,14 @@ func (fs *DriveFileSystem) Unlink(name string, context *fuse.Context) (
 func (fs *DriveFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
 	log.Printf("Rmdir \"%s\"", name)
 
+	if inSnapshots(name) {
+		return fuse.EROFS
+	}
+
+	if inTrash(name) {
+		return fuse.EPERM
+	}
+
 	empty, err := fs.db.IsDirectoryEmpty(name)
 	if err == metadb.DoesNotExist {
 		return fuse.ENOENT
@@ -344,6 +571,10 @@ func (fs *DriveFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status
 
 func (fs *DriveFileSystem) Chmod(name string, mode uint32,
 	context *fuse.Context) (code fuse.Status) {
+	if inSnapshots(name) {
+		return fuse.EROFS
+	}
+
 	err := fs.db.SetMode(name, mode)
 	if err == metadb.DoesNotExist {
 		return fuse.ENOENT
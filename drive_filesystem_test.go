@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// TestOpenAfterUnlink ensures that a file whose attributes were read before it
+// was unlinked can't be opened once its remote copy has been deleted.
+func TestOpenAfterUnlink(t *testing.T) {
+	fs := newTestFileSystem(t, DriveFileSystemOptions{})
+	defer fs.Close()
+
+	attributes := fs.writeFile(t, "file", []byte("content"))
+
+	if status := fs.Unlink("file", nil); status != fuse.OK {
+		t.Fatalf("Failed to unlink: %v", status)
+	}
+	if _, ok := fs.drive.content(attributes.Id); ok {
+		t.Fatal("Expecting the remote copy to be deleted")
+	}
+
+	_, err := fs.localFileCache.Open("file", attributes, true)
+	if err != metadb.DoesNotExist {
+		t.Fatalf("Expecting an unlinked file not to open, got %v", err)
+	}
+	if fs.localFileCache.OpenStream("file", attributes) {
+		t.Fatal("Expecting an unlinked file not to be streamed")
+	}
+}
+
+// TestOpenRacingUnlink ensures that a file that's opened while it's being
+// unlinked can still be read until it's released.
+func TestOpenRacingUnlink(t *testing.T) {
+	fs := newTestFileSystem(t, DriveFileSystemOptions{})
+	defer fs.Close()
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%d", i)
+		content := []byte(name)
+		attributes := fs.writeFile(t, name, content)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if status := fs.Unlink(name, nil); status != fuse.OK {
+				t.Errorf("Failed to unlink %s: %v", name, status)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			file, status := fs.Open(name, syscall.O_RDONLY, nil)
+			if status == fuse.ENOENT {
+				return
+			} else if status != fuse.OK {
+				t.Errorf("Failed to open %s: %v", name, status)
+				return
+			}
+			defer file.Release()
+
+			data, status := read(file, 0, 100)
+			if status != fuse.OK {
+				t.Errorf("Failed to read %s: %v", name, status)
+			} else if !bytes.Equal(data, content) {
+				t.Errorf("Expecting %q, got %q", content, data)
+			}
+		}()
+		wg.Wait()
+
+		if _, ok := fs.drive.content(attributes.Id); ok {
+			t.Fatalf("Expecting the remote copy of %s to be deleted", name)
+		}
+	}
+}
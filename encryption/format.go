@@ -0,0 +1,275 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted files consist of a header followed by a sequence of chunks. The
+// header holds a random key for the file, wrapped by a data key from the
+// keyring:
+//
+//	magic (4 bytes) | data key generation (4 bytes) | wrapped file key
+//
+// Each chunk holds up to ChunkSize bytes of content encrypted with the file key:
+//
+//	nonce (12 bytes) | ciphertext | tag (16 bytes)
+//
+// The index of each chunk, and whether it's the last, are authenticated along
+// with its content so chunks can't be reordered, dropped or truncated. A file
+// always has at least one chunk, which is empty for an empty file.
+const (
+	magic = "FDE1"
+
+	// ChunkSize is the maximum amount of content in each chunk.
+	ChunkSize = 64 * 1024
+
+	// HeaderSize is the size of the file header.
+	HeaderSize = len(magic) + 4 + wrappedKeySize
+
+	// chunkOverhead is the number of bytes added to the content of each chunk.
+	chunkOverhead = nonceSize + tagSize
+)
+
+var errNoKey = errors.New("data key is not in the keyring")
+
+// CiphertextSize returns the size of an encrypted file with the given amount of
+// content.
+func CiphertextSize(size uint64) uint64 {
+	chunks := (size + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return uint64(HeaderSize) + size + chunks*chunkOverhead
+}
+
+// PlaintextSize returns the amount of content in an encrypted file of the given
+// size.
+func PlaintextSize(size uint64) (uint64, error) {
+	if size < uint64(HeaderSize+chunkOverhead) {
+		return 0, Corrupt
+	}
+
+	body := size - uint64(HeaderSize)
+	full := body / (ChunkSize + chunkOverhead)
+	remainder := body % (ChunkSize + chunkOverhead)
+
+	switch {
+	case remainder == 0:
+		return full * ChunkSize, nil
+	case remainder < chunkOverhead, remainder == chunkOverhead && full > 0:
+		return 0, Corrupt
+	}
+	return full*ChunkSize + remainder - chunkOverhead, nil
+}
+
+// chunkAdditionalData returns the data authenticated along with a chunk.
+func chunkAdditionalData(index uint64, final bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if final {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// header returns the start of the header, which is authenticated along with
+// the wrapped file key.
+func header(generation uint32) []byte {
+	h := make([]byte, len(magic)+4)
+	copy(h, magic)
+	binary.BigEndian.PutUint32(h[len(magic):], generation)
+	return h
+}
+
+// Writer encrypts everything written to it. Close must be called to write the
+// final chunk.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	index  uint64
+	closed bool
+}
+
+// NewWriter returns a Writer that encrypts content to w using a new file key,
+// protected by the current data key.
+func (k *Keyring) NewWriter(w io.Writer) (*Writer, error) {
+	dataKey, ok := k.keys[k.current]
+	if !ok {
+		return nil, errNoKey
+	}
+
+	fileKey, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	h := header(k.current)
+	wrapped, err := wrapKey(dataKey, fileKey, h)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append(h, wrapped...)); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+func (e *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Only write a full chunk once there's more content, as the last chunk
+		// is marked as final.
+		if len(e.buf) == ChunkSize {
+			if err := e.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):ChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the final chunk. It doesn't close the underlying writer.
+func (e *Writer) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.writeChunk(true)
+}
+
+func (e *Writer) writeChunk(final bool) error {
+	sealed, err := seal(e.aead, e.buf, chunkAdditionalData(e.index, final))
+	if err != nil {
+		return err
+	}
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// fileCipher returns the AEAD for the file with the given header.
+func (k *Keyring) fileCipher(h []byte) (cipher.AEAD, error) {
+	if len(h) != HeaderSize || !bytes.Equal(h[:len(magic)], []byte(magic)) {
+		return nil, Corrupt
+	}
+
+	generation := binary.BigEndian.Uint32(h[len(magic):])
+	dataKey, ok := k.keys[generation]
+	if !ok {
+		return nil, fmt.Errorf("%v: generation %d", errNoKey, generation)
+	}
+
+	fileKey, err := unwrapKey(dataKey, h[len(magic)+4:], h[:len(magic)+4])
+	if err != nil {
+		return nil, Corrupt
+	}
+
+	return newAEAD(fileKey)
+}
+
+// Generation returns the generation of the data key that protects the file
+// with the given header.
+func Generation(h []byte) (uint32, error) {
+	if len(h) < len(magic)+4 || !bytes.Equal(h[:len(magic)], []byte(magic)) {
+		return 0, Corrupt
+	}
+	return binary.BigEndian.Uint32(h[len(magic):]), nil
+}
+
+// Reader decrypts an encrypted file.
+type Reader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	chunk []byte
+	index uint64
+	done  bool
+}
+
+// NewReader returns a Reader that decrypts the file read from r.
+func (k *Keyring) NewReader(r io.Reader) (*Reader, error) {
+	h := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, Corrupt
+		}
+		return nil, err
+	}
+
+	aead, err := k.fileCipher(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		r:    bufio.NewReaderSize(r, ChunkSize+chunkOverhead),
+		aead: aead,
+		buf:  make([]byte, ChunkSize+chunkOverhead),
+	}, nil
+}
+
+func (d *Reader) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+func (d *Reader) readChunk() error {
+	n, err := io.ReadFull(d.r, d.buf)
+	final := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// A short chunk must be the last.
+		final = true
+	} else if err != nil {
+		return err
+	} else if _, err := d.r.Peek(1); err == io.EOF {
+		final = true
+	} else if err != nil {
+		return err
+	}
+
+	chunk, err := open(d.aead, d.buf[:n], chunkAdditionalData(d.index, final))
+	if err != nil {
+		return err
+	}
+
+	d.chunk = chunk
+	d.index++
+	d.done = final
+	return nil
+}
@@ -0,0 +1,144 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func newTestKeyring() *Keyring {
+	key, err := NewKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return NewKeyring(map[uint32][]byte{1: key})
+}
+
+func encrypt(t *testing.T, k *Keyring, content []byte) []byte {
+	var buf bytes.Buffer
+	w, err := k.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(k *Keyring, ciphertext []byte) ([]byte, error) {
+	r, err := k.NewReader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// TestRoundTrip ensures that content of various sizes can be decrypted and
+// that the sizes of encrypted files can be predicted.
+func TestRoundTrip(t *testing.T) {
+	k := newTestKeyring()
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1,
+		3 * ChunkSize} {
+		content, err := randomBytes(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ciphertext := encrypt(t, k, content)
+		if uint64(len(ciphertext)) != CiphertextSize(uint64(size)) {
+			t.Fatalf("Expecting %d bytes of ciphertext for %d bytes, got %d",
+				CiphertextSize(uint64(size)), size, len(ciphertext))
+		}
+
+		plaintextSize, err := PlaintextSize(uint64(len(ciphertext)))
+		if err != nil || plaintextSize != uint64(size) {
+			t.Fatalf("Expecting plaintext size %d, got %d", size,
+				plaintextSize)
+		}
+
+		actual, err := decrypt(k, ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, content) {
+			t.Fatalf("Content of %d bytes doesn't match", size)
+		}
+	}
+}
+
+// TestTampering ensures that modified, truncated and reordered files are
+// rejected.
+func TestTampering(t *testing.T) {
+	k := newTestKeyring()
+
+	content, err := randomBytes(3 * ChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := encrypt(t, k, content)
+
+	modified := append([]byte(nil), ciphertext...)
+	modified[HeaderSize+100] ^= 1
+	if _, err := decrypt(k, modified); err != Corrupt {
+		t.Fatalf("Expecting modified content to be rejected, got %v", err)
+	}
+
+	truncated := ciphertext[:len(ciphertext)-(ChunkSize+chunkOverhead)]
+	if _, err := decrypt(k, truncated); err != Corrupt {
+		t.Fatalf("Expecting truncated content to be rejected, got %v", err)
+	}
+
+	chunk := ChunkSize + chunkOverhead
+	reordered := append([]byte(nil), ciphertext[:HeaderSize]...)
+	reordered = append(reordered, ciphertext[HeaderSize+chunk:HeaderSize+2*chunk]...)
+	reordered = append(reordered, ciphertext[HeaderSize:HeaderSize+chunk]...)
+	reordered = append(reordered, ciphertext[HeaderSize+2*chunk:]...)
+	if _, err := decrypt(k, reordered); err != Corrupt {
+		t.Fatalf("Expecting reordered content to be rejected, got %v", err)
+	}
+
+	if _, err := decrypt(newTestKeyring(), ciphertext); err != Corrupt {
+		t.Fatalf("Expecting a different key to be rejected, got %v", err)
+	}
+}
+
+// TestWrapKey ensures that a wrapped key can only be unwrapped with the right
+// passphrase.
+func TestWrapKey(t *testing.T) {
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := DeriveKey([]byte("correct horse"), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := WrapKey(kek, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := UnwrapKey(kek, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Fatal("Expecting the key to be unwrapped")
+	}
+
+	wrongKek, err := DeriveKey([]byte("battery staple"), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnwrapKey(wrongKek, wrapped); err != WrongKey {
+		t.Fatalf("Expecting the wrong passphrase to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KeySize is the size in bytes of every key.
+	KeySize = 32
+
+	// SaltSize is the size in bytes of the salt used to derive a key from a
+	// passphrase.
+	SaltSize = 32
+
+	// Parameters for scrypt, as recommended for interactive logins.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	nonceSize = 12
+	tagSize   = 16
+
+	// wrappedKeySize is the size of a key once it's been wrapped.
+	wrappedKeySize = nonceSize + KeySize + tagSize
+)
+
+var (
+	// WrongKey is returned when a wrapped key can't be unwrapped, usually
+	// because the passphrase is incorrect.
+	WrongKey = errors.New("incorrect passphrase or key")
+
+	// Corrupt is returned when encrypted data fails authentication.
+	Corrupt = errors.New("encrypted data is corrupt")
+)
+
+// randomBytes returns n bytes from a cryptographically secure source.
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewSalt returns a random salt for DeriveKey.
+func NewSalt() ([]byte, error) {
+	return randomBytes(SaltSize)
+}
+
+// NewKey returns a random key.
+func NewKey() ([]byte, error) {
+	return randomBytes(KeySize)
+}
+
+// DeriveKey derives a key from a passphrase and salt.
+func DeriveKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, KeySize)
+}
+
+// DeriveSubkey returns a key for the given purpose derived from key, so that a
+// single key can protect different kinds of data.
+func DeriveSubkey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// newAEAD returns AES-256-GCM using the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates plaintext with a random nonce, which is
+// prepended to the result.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte,
+	error) {
+	nonce, err := randomBytes(nonceSize)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open reverses seal.
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < nonceSize+tagSize {
+		return nil, Corrupt
+	}
+	plaintext, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:],
+		additionalData)
+	if err != nil {
+		return nil, Corrupt
+	}
+	return plaintext, nil
+}
+
+// WrapKey encrypts key with the key encryption key kek.
+func WrapKey(kek, key []byte) ([]byte, error) {
+	return wrapKey(kek, key, nil)
+}
+
+// UnwrapKey decrypts a key that was wrapped with WrapKey.
+func UnwrapKey(kek, wrapped []byte) ([]byte, error) {
+	return unwrapKey(kek, wrapped, nil)
+}
+
+func wrapKey(kek, key, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, key, additionalData)
+}
+
+func unwrapKey(kek, wrapped, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	key, err := open(aead, wrapped, additionalData)
+	if err != nil {
+		return nil, WrongKey
+	}
+	return key, nil
+}
+
+// Keyring holds the data keys that protect the key of each file. Data keys are
+// numbered by generation and new files always use the latest generation.
+type Keyring struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewKeyring returns a keyring holding the given data keys, keyed by
+// generation.
+func NewKeyring(keys map[uint32][]byte) *Keyring {
+	k := &Keyring{keys: keys}
+	for generation := range keys {
+		if generation > k.current {
+			k.current = generation
+		}
+	}
+	return k
+}
+
+// Current returns the generation of the data key used for new files.
+func (k *Keyring) Current() uint32 {
+	return k.current
+}
@@ -0,0 +1,158 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"io"
+)
+
+// sealedChunkSize is the size of each chunk of an encrypted file, except the
+// last.
+const sealedChunkSize = ChunkSize + chunkOverhead
+
+// Decrypter decrypts individual chunks of an encrypted file of known size, so
+// any range of its content can be read without reading the rest of the file.
+type Decrypter struct {
+	aead cipher.AEAD
+
+	// size is the amount of content in the file.
+	size uint64
+
+	// chunks is the number of chunks in the file.
+	chunks uint64
+}
+
+// NewDecrypter returns a Decrypter for the encrypted file with the given header
+// and total size.
+func (k *Keyring) NewDecrypter(h []byte, ciphertextSize uint64) (*Decrypter,
+	error) {
+	size, err := PlaintextSize(ciphertextSize)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := k.fileCipher(h)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := (size + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	return &Decrypter{
+		aead:   aead,
+		size:   size,
+		chunks: chunks,
+	}, nil
+}
+
+// Size returns the amount of content in the file.
+func (d *Decrypter) Size() uint64 {
+	return d.size
+}
+
+// chunkOffset returns the offset of the chunk with the given index within the
+// encrypted file.
+func chunkOffset(index uint64) uint64 {
+	return uint64(HeaderSize) + index*sealedChunkSize
+}
+
+// sealedSize returns the size of the chunk with the given index.
+func (d *Decrypter) sealedSize(index uint64) uint64 {
+	if index < d.chunks-1 {
+		return sealedChunkSize
+	}
+	return d.size - index*ChunkSize + chunkOverhead
+}
+
+// CiphertextRange returns the offset and size of the smallest range of the
+// encrypted file that holds the given range of content. The range starts at
+// the beginning of a chunk.
+func (d *Decrypter) CiphertextRange(off, size uint64) (uint64, uint64) {
+	if off >= d.size || size == 0 {
+		last := d.chunks - 1
+		return chunkOffset(last) + d.sealedSize(last), 0
+	}
+
+	end := off + size
+	if end > d.size {
+		end = d.size
+	}
+
+	first := off / ChunkSize
+	last := (end - 1) / ChunkSize
+	start := chunkOffset(first)
+	return start, chunkOffset(last) + d.sealedSize(last) - start
+}
+
+// DecryptChunk verifies and decrypts the chunk with the given index.
+func (d *Decrypter) DecryptChunk(index uint64, sealed []byte) ([]byte,
+	error) {
+	if index >= d.chunks || uint64(len(sealed)) != d.sealedSize(index) {
+		return nil, Corrupt
+	}
+	return open(d.aead, sealed, chunkAdditionalData(index, index == d.chunks-1))
+}
+
+// NewReader returns a reader of the content of the file from off onwards. r
+// must read the encrypted file from the start of the range returned by
+// CiphertextRange for off. Only the chunks that are read are verified.
+func (d *Decrypter) NewReader(r io.Reader, off uint64) io.Reader {
+	index, skip := off/ChunkSize, off%ChunkSize
+	if off >= d.size {
+		index, skip = d.chunks, 0
+	}
+
+	return &rangeReader{
+		d:     d,
+		r:     r,
+		index: index,
+		skip:  skip,
+		buf:   make([]byte, sealedChunkSize),
+	}
+}
+
+// rangeReader decrypts consecutive chunks of a file, starting part way through.
+type rangeReader struct {
+	d     *Decrypter
+	r     io.Reader
+	buf   []byte
+	chunk []byte
+
+	// index is the index of the next chunk to read.
+	index uint64
+
+	// skip is the amount of content to discard from the start of the next
+	// chunk.
+	skip uint64
+}
+
+func (c *rangeReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.index >= c.d.chunks {
+			return 0, io.EOF
+		}
+
+		sealed := c.buf[:c.d.sealedSize(c.index)]
+		if _, err := io.ReadFull(c.r, sealed); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, Corrupt
+			}
+			return 0, err
+		}
+
+		chunk, err := c.d.DecryptChunk(c.index, sealed)
+		if err != nil {
+			return 0, err
+		}
+
+		c.chunk = chunk[c.skip:]
+		c.skip = 0
+		c.index++
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
@@ -0,0 +1,137 @@
+package encryption
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// readRange reads size bytes of content at off from an encrypted file, using
+// only the ciphertext that CiphertextRange asks for.
+func readRange(k *Keyring, ciphertext []byte, off, size uint64) ([]byte,
+	error) {
+	d, err := k.NewDecrypter(ciphertext[:HeaderSize], uint64(len(ciphertext)))
+	if err != nil {
+		return nil, err
+	}
+
+	start, length := d.CiphertextRange(off, size)
+	r := d.NewReader(bytes.NewReader(ciphertext[start:start+length]), off)
+
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// TestRanges ensures that any range of content can be read from the minimal
+// range of ciphertext.
+func TestRanges(t *testing.T) {
+	k := newTestKeyring()
+
+	for _, size := range []uint64{0, 1, ChunkSize, 2*ChunkSize + 10} {
+		content, err := randomBytes(int(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext := encrypt(t, k, content)
+
+		for _, r := range []struct{ off, size uint64 }{
+			{0, 1},
+			{0, size},
+			{1, ChunkSize},
+			{ChunkSize - 1, 2},
+			{ChunkSize, ChunkSize},
+			{size, 10},
+			{size + 10, 10},
+		} {
+			expected := []byte{}
+			if r.off < size {
+				end := r.off + r.size
+				if end > size {
+					end = size
+				}
+				expected = content[r.off:end]
+			}
+
+			actual, err := readRange(k, ciphertext, r.off, r.size)
+			if err != nil {
+				t.Fatalf("Reading %d bytes at %d of %d: %v", r.size, r.off,
+					size, err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Fatalf("Content of %d bytes at %d of %d doesn't match",
+					r.size, r.off, size)
+			}
+		}
+	}
+}
+
+// TestCiphertextRange ensures that reads only fetch the chunks they touch.
+func TestCiphertextRange(t *testing.T) {
+	k := newTestKeyring()
+
+	content, err := randomBytes(3*ChunkSize + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := encrypt(t, k, content)
+
+	d, err := k.NewDecrypter(ciphertext[:HeaderSize], uint64(len(ciphertext)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	off, size := d.CiphertextRange(ChunkSize+1, 10)
+	if off != uint64(HeaderSize+sealedChunkSize) || size != sealedChunkSize {
+		t.Fatalf("Expecting the second chunk, got %d bytes at %d", size, off)
+	}
+
+	off, size = d.CiphertextRange(3*ChunkSize, 100)
+	if off != uint64(HeaderSize+3*sealedChunkSize) ||
+		size != 10+chunkOverhead {
+		t.Fatalf("Expecting the last chunk, got %d bytes at %d", size, off)
+	}
+}
+
+// TestRangeTampering ensures that modified and reordered chunks are rejected
+// when they're read, and that other chunks can still be read.
+func TestRangeTampering(t *testing.T) {
+	k := newTestKeyring()
+
+	content, err := randomBytes(3 * ChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := encrypt(t, k, content)
+
+	modified := append([]byte(nil), ciphertext...)
+	modified[HeaderSize+sealedChunkSize+100] ^= 1
+	if _, err := readRange(k, modified, ChunkSize, 10); err != Corrupt {
+		t.Fatalf("Expecting modified chunk to be rejected, got %v", err)
+	}
+	actual, err := readRange(k, modified, 2*ChunkSize, 10)
+	if err != nil || !bytes.Equal(actual, content[2*ChunkSize:2*ChunkSize+10]) {
+		t.Fatalf("Expecting unmodified chunk to be readable, got %v", err)
+	}
+
+	// Swap the first two chunks.
+	reordered := append([]byte(nil), ciphertext[:HeaderSize]...)
+	reordered = append(reordered,
+		ciphertext[HeaderSize+sealedChunkSize:HeaderSize+2*sealedChunkSize]...)
+	reordered = append(reordered,
+		ciphertext[HeaderSize:HeaderSize+sealedChunkSize]...)
+	reordered = append(reordered,
+		ciphertext[HeaderSize+2*sealedChunkSize:]...)
+	if _, err := readRange(k, reordered, 0, 10); err != Corrupt {
+		t.Fatalf("Expecting reordered chunk to be rejected, got %v", err)
+	}
+
+	// Dropping the last chunk makes the one before it look like the last.
+	truncated := ciphertext[:len(ciphertext)-sealedChunkSize]
+	if _, err := readRange(k, truncated, ChunkSize, 10); err != Corrupt {
+		t.Fatalf("Expecting truncated file to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"google.golang.org/api/drive/v3"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ownerQuery matches a query for the files with a given owner.
+var ownerQuery = regexp.MustCompile(
+	`appProperties has \{ key='fusedrive-owner' and value='([^']*)' \}`)
+
+// fakeDrive is an in-memory stand-in for the parts of the Drive api that
+// fusedrive uses to store file content.
+type fakeDrive struct {
+	server *httptest.Server
+
+	mu    sync.Mutex
+	files map[string][]byte
+	next  int
+
+	// owners holds the owner property that each file was uploaded with.
+	owners map[string]string
+
+	// unlisted hides every file from listings, as if they were created by
+	// another client.
+	unlisted bool
+
+	// batches counts the batch requests that have been served.
+	batches int
+
+	// downloads counts the requests for file content that have been served.
+	downloads int
+}
+
+func newFakeDrive() *fakeDrive {
+	d := &fakeDrive{
+		files:  make(map[string][]byte),
+		owners: make(map[string]string),
+	}
+	d.server = httptest.NewServer(http.HandlerFunc(d.serve))
+	return d
+}
+
+func (d *fakeDrive) Close() {
+	d.server.Close()
+}
+
+// api returns a DriveApi that talks to this server.
+func (d *fakeDrive) api(t *testing.T) *api.DriveApi {
+	srv, err := drive.New(d.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.BasePath = d.server.URL + "/drive/v3/"
+	return &api.DriveApi{Service: srv, Client: d.server.Client()}
+}
+
+// content returns the content of the file with the given id, or false if it
+// doesn't exist.
+func (d *fakeDrive) content(id string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, ok := d.files[id]
+	return data, ok
+}
+
+// replace changes the content of the file with the given id, as if it had
+// been corrupted.
+func (d *fakeDrive) replace(id string, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files[id] = data
+}
+
+// remove deletes the file with the given id.
+func (d *fakeDrive) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.files, id)
+}
+
+func (d *fakeDrive) serve(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/upload/drive/v3/files" && r.Method == "POST":
+		d.mu.Lock()
+		d.next++
+		id := fmt.Sprintf("file%d", d.next)
+		d.mu.Unlock()
+		d.upload(w, r, id)
+
+	case strings.HasPrefix(r.URL.Path, "/upload/drive/v3/files/") &&
+		r.Method == "PATCH":
+		id := strings.TrimPrefix(r.URL.Path, "/upload/drive/v3/files/")
+		if _, ok := d.content(id); !ok {
+			notFound(w)
+			return
+		}
+		d.upload(w, r, id)
+
+	case r.URL.Path == "/batch/drive/v3" && r.Method == "POST":
+		d.batch(w, r)
+
+	case r.URL.Path == "/drive/v3/files" && r.Method == "GET":
+		d.list(w, r.URL.Query().Get("q"))
+
+	case strings.HasPrefix(r.URL.Path, "/drive/v3/files/"):
+		id := strings.TrimPrefix(r.URL.Path, "/drive/v3/files/")
+		data, ok := d.content(id)
+		if !ok {
+			notFound(w)
+			return
+		}
+
+		switch {
+		case r.Method == "DELETE":
+			d.mu.Lock()
+			delete(d.files, id)
+			d.mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			d.mu.Lock()
+			d.downloads++
+			d.mu.Unlock()
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		default:
+			writeFile(w, id, data)
+		}
+
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// list responds with the metadata of every file, or only those with the
+// owner that the query asks for.
+func (d *fakeDrive) list(w http.ResponseWriter, query string) {
+	owner := ""
+	if match := ownerQuery.FindStringSubmatch(query); match != nil {
+		owner = match[1]
+	}
+
+	d.mu.Lock()
+	files := make([]interface{}, 0, len(d.files))
+	for id, data := range d.files {
+		if !d.unlisted && (owner == "" || d.owners[id] == owner) {
+			files = append(files, metadata(id, data))
+		}
+	}
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"files": files})
+}
+
+// batch serves each of the requests in a batch, responding with their
+// responses.
+func (d *fakeDrive) batch(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+
+	d.mu.Lock()
+	d.batches++
+	d.mu.Unlock()
+
+	var body bytes.Buffer
+	responses := multipart.NewWriter(&body)
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		request, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recorder := httptest.NewRecorder()
+		d.serve(recorder, request)
+
+		id := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		response, err := responses.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {"<response-" + id + ">"},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recorder.Result().Write(response)
+	}
+	responses.Close()
+
+	w.Header().Set("Content-Type",
+		"multipart/mixed; boundary="+responses.Boundary())
+	w.Write(body.Bytes())
+}
+
+// upload stores the content of a multipart upload as the file with the given
+// id.
+func (d *fakeDrive) upload(w http.ResponseWriter, r *http.Request, id string) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+
+	// The first part is the metadata and the second is the content.
+	var file drive.File
+	var data []byte
+	for i := 0; i < 2; i++ {
+		part, err := parts.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err = ioutil.ReadAll(part)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if i == 0 {
+			if err := json.Unmarshal(data, &file); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	d.mu.Lock()
+	d.files[id] = data
+	if owner, ok := file.AppProperties["fusedrive-owner"]; ok {
+		d.owners[id] = owner
+	}
+	d.mu.Unlock()
+
+	writeFile(w, id, data)
+}
+
+// writeFile responds with the metadata of a file.
+func writeFile(w http.ResponseWriter, id string, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata(id, data))
+}
+
+// metadata returns the metadata of a file as Drive encodes it.
+func metadata(id string, data []byte) map[string]interface{} {
+	sum := md5.Sum(data)
+	return map[string]interface{}{
+		"id":          id,
+		"size":        strconv.Itoa(len(data)),
+		"md5Checksum": hex.EncodeToString(sum[:]),
+		"trashed":     false,
+		"createdTime": time.Now().Format(time.RFC3339),
+	}
+}
+
+func notFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, `{"error":{"code":404,"message":"File not found"}}`)
+}
+
+// testFileSystem is a filesystem backed by a fake Drive and a temporary
+// database.
+type testFileSystem struct {
+	*DriveFileSystem
+	drive *fakeDrive
+	dir   string
+}
+
+func newTestFileSystem(t *testing.T,
+	options DriveFileSystemOptions) *testFileSystem {
+	dir, err := ioutil.TempDir("", "fusedrive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := metadb.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newFakeDrive()
+	driveApi := d.api(t)
+	driveApi.Owner, err = db.OwnerId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewDriveFileSystem(driveApi, db, options).(*DriveFileSystem)
+
+	return &testFileSystem{DriveFileSystem: fs, drive: d, dir: dir}
+}
+
+func (fs *testFileSystem) Close() {
+	fs.db.Close()
+	fs.drive.Close()
+	os.RemoveAll(fs.dir)
+}
+
+// writeFile creates a file with the given content and uploads it, returning
+// its attributes.
+func (fs *testFileSystem) writeFile(t *testing.T, name string,
+	content []byte) metadb.Attributes {
+	file, status := fs.Create(name, uint32(os.O_WRONLY), 0644, nil)
+	if status != fuse.OK {
+		t.Fatalf("Failed to create %s: %v", name, status)
+	}
+	write(t, file, content)
+	file.Release()
+
+	attributes, err := fs.db.GetAttributes(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attributes
+}
+
+// write replaces the content of an open file.
+func write(t *testing.T, file nodefs.File, content []byte) {
+	if _, status := file.Write(content, 0); status != fuse.OK {
+		t.Fatalf("Failed to write %s: %v", file, status)
+	}
+}
+
+// read returns up to size bytes of an open file from off.
+func read(file nodefs.File, off int64, size int) ([]byte, fuse.Status) {
+	buf := make([]byte, size)
+	result, status := file.Read(buf, off)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return result.Bytes(buf)
+}
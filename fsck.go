@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/encryption"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"path"
+	"sort"
+	"strings"
+)
+
+// lostAndFoundDir is where fsck moves files whose content is missing from the
+// remote.
+const lostAndFoundDir = "lost+found"
+
+// Classes of inconsistency between the database and the remote.
+const (
+	// problemNotUploaded is a file with content that was never uploaded,
+	// because the upload failed or fusedrive stopped before it could finish.
+	problemNotUploaded = "not-uploaded"
+
+	// problemUploadFailed is a file whose remote copy is older than the
+	// content that was last written to it.
+	problemUploadFailed = "upload-failed"
+
+	// problemMissing is a file whose remote copy doesn't exist.
+	problemMissing = "missing"
+
+	// problemTrashed is a file whose remote copy is in the Drive trash.
+	problemTrashed = "trashed"
+
+	// problemSizeMismatch is a file whose size differs from its remote copy.
+	problemSizeMismatch = "size-mismatch"
+
+	// problemChecksumMismatch is a file whose recorded md5 differs from that
+	// of its remote copy.
+	problemChecksumMismatch = "checksum-mismatch"
+)
+
+// checker compares the database with the remote and optionally repairs any
+// differences.
+type checker struct {
+	db       *metadb.DB
+	driveApi *api.DriveApi
+
+	// remote is the metadata of every remote file, keyed by id.
+	remote map[string]api.RemoteFile
+
+	repair        bool
+	removeMissing bool
+
+	// encrypted is true if remote copies are encrypted, and so are larger
+	// than the files they hold.
+	encrypted bool
+
+	// problems counts the problems that were found of each class.
+	problems map[string]int
+}
+
+func fsck(dataDir string, args []string) error {
+	flags := newFlagSet("fsck")
+	repair := flags.Bool("repair", false, "fix any problems that are found")
+	removeMissing := flags.Bool("remove-missing", false,
+		"with -repair, remove files whose content is missing instead of "+
+			"moving them to "+lostAndFoundDir)
+	flags.Parse(args)
+
+	db, err := openDB(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	encrypted, err := db.IsEncrypted()
+	if err != nil {
+		return err
+	}
+
+	driveApi, err := newDriveApi(dataDir, db)
+	if err != nil {
+		return err
+	}
+
+	c := &checker{
+		db:            db,
+		driveApi:      driveApi,
+		repair:        *repair,
+		removeMissing: *removeMissing,
+		encrypted:     encrypted,
+		problems:      make(map[string]int),
+	}
+	return c.run()
+}
+
+// run checks every file in the database against its remote copy, and prints a
+// summary of the problems that were found.
+func (c *checker) run() error {
+	files, err := c.driveApi.ListFiles()
+	if err != nil {
+		return fmt.Errorf("unable to list remote files: %v", err)
+	}
+
+	c.remote = make(map[string]api.RemoteFile)
+	for _, file := range files {
+		c.remote[file.Id] = file
+	}
+	if err := c.getUnlisted(); err != nil {
+		return err
+	}
+
+	if err := c.db.Walk(c.check); err != nil {
+		return err
+	}
+
+	total := 0
+	classes := make([]string, 0, len(c.problems))
+	for class, count := range c.problems {
+		classes = append(classes, class)
+		total += count
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Printf("%d %s\n", c.problems[class], class)
+	}
+
+	if total > 0 && !c.repair {
+		return fmt.Errorf("found %d problems, run with -repair to fix them",
+			total)
+	}
+
+	return nil
+}
+
+// getUnlisted fetches the metadata of remote copies that the database refers
+// to but weren't listed. The listing only includes files created by this
+// client, so these are looked up directly, in batches, before declaring them
+// missing.
+func (c *checker) getUnlisted() error {
+	var ids []string
+	err := c.db.Walk(func(name string, attributes metadb.Attributes) error {
+		if !attributes.IsRegularFile || attributes.HasContent ||
+			attributes.Id == "" {
+			return nil
+		}
+		if _, ok := c.remote[attributes.Id]; !ok {
+			// Mark the id as seen so it's only requested once.
+			c.remote[attributes.Id] = api.RemoteFile{}
+			ids = append(ids, attributes.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	files, err := c.driveApi.GetFiles(ids)
+	if err != nil {
+		return fmt.Errorf("unable to get remote files: %v", err)
+	}
+	for _, id := range ids {
+		if file, ok := files[id]; ok {
+			c.remote[id] = file
+		} else {
+			delete(c.remote, id)
+		}
+	}
+	return nil
+}
+
+// report records a problem with the file at name.
+func (c *checker) report(class, name, format string, args ...interface{}) {
+	c.problems[class]++
+	fmt.Printf("%s: %s %s\n", class, name, fmt.Sprintf(format, args...))
+}
+
+// check compares a single node with its remote copy.
+func (c *checker) check(name string, attributes metadb.Attributes) error {
+	if !attributes.IsRegularFile || attributes.HasContent {
+		return nil
+	}
+
+	if attributes.Id == "" {
+		// Empty files are only uploaded once they've been written to.
+		if attributes.State == metadb.LocalOnly && attributes.Size == 0 {
+			return nil
+		}
+
+		c.report(problemNotUploaded, name, "(%d bytes, %s)", attributes.Size,
+			attributes.State)
+		if c.repair {
+			return c.relinkEmpty(name)
+		}
+		return nil
+	}
+
+	file, ok := c.remote[attributes.Id]
+	if !ok {
+		c.report(problemMissing, name, "(%s)", attributes.Id)
+		if c.repair {
+			return c.quarantine(name)
+		}
+		return nil
+	}
+
+	if file.Trashed {
+		c.report(problemTrashed, name, "(%s)", attributes.Id)
+		if c.repair {
+			if err := c.driveApi.Untrash(attributes.Id); err != nil {
+				return err
+			}
+		}
+	}
+
+	if attributes.State == metadb.UploadFailed ||
+		attributes.State == metadb.Uploading {
+		c.report(problemUploadFailed, name, "(%s)", attributes.Id)
+	}
+
+	// Files are marked as corrupt when a download doesn't match, which may
+	// have been a transient problem.
+	md5Mismatch := len(attributes.Md5) > 0 && file.Md5Checksum != "" &&
+		file.Md5Checksum != hex.EncodeToString(attributes.Md5)
+	if md5Mismatch || attributes.State == metadb.Corrupt {
+		c.report(problemChecksumMismatch, name, "(%x, remote has %s)",
+			attributes.Md5, file.Md5Checksum)
+		if c.repair && md5Mismatch {
+			// The remote copy is the only one left, so accept its content.
+			md5sum, err := hex.DecodeString(file.Md5Checksum)
+			if err != nil {
+				return err
+			}
+
+			// The sha256 of an encrypted file is of its content, which can't
+			// be decrypted here, and is unchanged if the file was only
+			// re-encrypted. Otherwise it's recomputed from the remote copy.
+			sha256sum := attributes.Sha256
+			if len(sha256sum) > 0 && !c.encrypted {
+				sha256sum, err = c.remoteSha256(attributes.Id, md5sum)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = c.db.SetSynced(name, attributes.Id, attributes.Size, md5sum,
+				sha256sum)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	remoteSize := attributes.Size
+	if c.encrypted {
+		remoteSize = encryption.CiphertextSize(attributes.Size)
+	}
+	if file.Size != remoteSize {
+		c.report(problemSizeMismatch, name, "(%d bytes, remote has %d bytes)",
+			remoteSize, file.Size)
+		if c.repair {
+			size := file.Size
+			if c.encrypted {
+				var err error
+				size, err = encryption.PlaintextSize(file.Size)
+				if err != nil {
+					// The remote copy can't be decrypted, so leave the file
+					// to be flagged as corrupt when it's read.
+					fmt.Printf("%s: can't repair size: %v\n", name, err)
+					return nil
+				}
+			}
+			if err := c.db.SetSize(name, size); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The database now describes the remote copy, which is all that's left of
+	// a failed upload.
+	if c.repair && attributes.State != metadb.Synced {
+		return c.db.SetState(name, metadb.Synced)
+	}
+
+	return nil
+}
+
+// relinkEmpty gives a file that was never uploaded an empty remote copy, which
+// matches the size it has in the database.
+func (c *checker) relinkEmpty(name string) error {
+	// An empty remote copy of an encrypted file would need the keys to write,
+	// so the file is left empty without one, as newly created files are.
+	if c.encrypted {
+		if err := c.db.SetSize(name, 0); err != nil {
+			return err
+		}
+		return c.db.SetState(name, metadb.LocalOnly)
+	}
+
+	remote, err := c.driveApi.Create(bytes.NewReader(nil))
+	if err != nil {
+		return err
+	}
+
+	md5sum := md5.Sum(nil)
+	return c.db.SetSynced(name, remote.Id, 0, md5sum[:], nil)
+}
+
+// remoteSha256 downloads the remote file with the given id and returns its
+// sha256, checking that its content has the given md5.
+func (c *checker) remoteSha256(id string, md5sum []byte) ([]byte, error) {
+	body, err := c.driveApi.Download(id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s: %v", id, err)
+	}
+	defer body.Close()
+
+	actualMd5, sha256sum, err := checksumReader(body, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", id, err)
+	}
+	if !bytes.Equal(actualMd5, md5sum) {
+		return nil, fmt.Errorf("content of %s changed while it was read", id)
+	}
+	return sha256sum, nil
+}
+
+// quarantine moves a file whose content is missing to lostAndFoundDir, or
+// removes it entirely if requested. Files in the trash are always removed.
+func (c *checker) quarantine(name string) error {
+	if entry, ok := trashEntryName(name); ok {
+		_, err := c.db.RemoveFromTrash(entry)
+		return err
+	}
+
+	if c.removeMissing {
+		_, err := c.db.GetAndDeleteAttributes(name)
+		return err
+	}
+
+	// Leave files that were quarantined by an earlier run where they are.
+	if strings.HasPrefix(name, lostAndFoundDir+"/") {
+		return c.db.SetState(name, metadb.RemoteMissing)
+	}
+
+	target := path.Join(lostAndFoundDir, name)
+	if err := mkdirAll(c.db, path.Dir(target)); err != nil {
+		return err
+	}
+
+	err := c.db.Rename(name, target)
+	if err == metadb.AlreadyExists {
+		fmt.Printf("unable to move %s to %s as it already exists\n", name,
+			target)
+		return c.db.SetState(name, metadb.RemoteMissing)
+	} else if err != nil {
+		return err
+	}
+	return c.db.SetState(target, metadb.RemoteMissing)
+}
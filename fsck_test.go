@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/simonhorlick/fusedrive/metadb"
+	"testing"
+)
+
+// newTestChecker returns a checker that repairs the problems it finds in fs.
+func newTestChecker(fs *testFileSystem) *checker {
+	return &checker{
+		db:       fs.db,
+		driveApi: fs.driveApi,
+		repair:   true,
+		problems: make(map[string]int),
+	}
+}
+
+// TestQuarantineSiblingSharingPrefix ensures that quarantining a file whose
+// content is missing leaves alone a sibling whose name starts with its name.
+func TestQuarantineSiblingSharingPrefix(t *testing.T) {
+	fs := newTestFileSystem(t, DriveFileSystemOptions{})
+	defer fs.Close()
+
+	missing := fs.writeFile(t, "foo", []byte("missing"))
+	healthy := fs.writeFile(t, "foobar", []byte("healthy"))
+	fs.drive.remove(missing.Id)
+
+	c := newTestChecker(fs)
+	if err := c.run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.problems[problemMissing] != 1 {
+		t.Fatalf("Expecting 1 missing file, got %v", c.problems)
+	}
+
+	if _, err := fs.db.GetAttributes("foo"); err != metadb.DoesNotExist {
+		t.Fatalf("Expecting foo to be moved, got %v", err)
+	}
+	quarantined, err := fs.db.GetAttributes(lostAndFoundDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quarantined.State != metadb.RemoteMissing {
+		t.Fatalf("Expecting foo to be marked as missing, got %s",
+			quarantined.State)
+	}
+
+	attributes, err := fs.db.GetAttributes("foobar")
+	if err != nil {
+		t.Fatalf("Expecting foobar to be left in place, got %v", err)
+	}
+	if attributes.Id != healthy.Id || attributes.State != metadb.Synced {
+		t.Fatalf("Expecting foobar to be unchanged, got %+v", attributes)
+	}
+	if _, err := fs.db.GetAttributes(lostAndFoundDir + "/foobar"); err !=
+		metadb.DoesNotExist {
+		t.Fatalf("Expecting foobar not to be quarantined, got %v", err)
+	}
+}
+
+// TestFsckBatchesUnlistedFiles ensures that files missing from the listing of
+// remote files are looked up together rather than one at a time.
+func TestFsckBatchesUnlistedFiles(t *testing.T) {
+	fs := newTestFileSystem(t, DriveFileSystemOptions{})
+	defer fs.Close()
+
+	fs.writeFile(t, "a", []byte("a"))
+	fs.writeFile(t, "b", []byte("b"))
+	missing := fs.writeFile(t, "c", []byte("c"))
+	fs.drive.remove(missing.Id)
+
+	fs.drive.mu.Lock()
+	fs.drive.unlisted = true
+	fs.drive.mu.Unlock()
+
+	c := newTestChecker(fs)
+	if err := c.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.problems) != 1 || c.problems[problemMissing] != 1 {
+		t.Fatalf("Expecting only c to be missing, got %v", c.problems)
+	}
+	if fs.drive.batches != 1 {
+		t.Fatalf("Expecting 1 batch request, got %d", fs.drive.batches)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"time"
+)
+
+// gc finds remote files that nothing in the database references and deletes
+// them. These are left behind when fusedrive stops between uploading a file and
+// recording its id, or when deleting a file from the remote fails.
+func gc(dataDir string, args []string) error {
+	flags := newFlagSet("gc")
+	dryRun := flags.Bool("dry-run", false,
+		"report unreferenced files without removing them")
+	grace := flags.Duration("grace", 24*time.Hour,
+		"only remove files that were created at least this long ago")
+	trash := flags.Bool("trash", false,
+		"move unreferenced files to the Drive trash instead of deleting them")
+	flags.Parse(args)
+
+	db, err := openDB(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	driveApi, err := newDriveApi(dataDir, db)
+	if err != nil {
+		return err
+	}
+
+	c := &collector{
+		db:       db,
+		driveApi: driveApi,
+		dryRun:   *dryRun,
+		grace:    *grace,
+		trash:    *trash,
+	}
+	return c.run()
+}
+
+// collector removes remote files that nothing in the database references.
+type collector struct {
+	db       *metadb.DB
+	driveApi *api.DriveApi
+
+	dryRun bool
+	grace  time.Duration
+	trash  bool
+}
+
+// run removes the unreferenced files and prints a summary of them. Only the
+// files that belong to this filesystem are listed, so files uploaded for
+// another filesystem that shares the account are left alone.
+func (c *collector) run() error {
+	if c.driveApi.Owner == "" {
+		return fmt.Errorf("the filesystem has no owner id, so the files " +
+			"that belong to it can't be told apart")
+	}
+
+	files, err := c.driveApi.ListFiles()
+	if err != nil {
+		return fmt.Errorf("unable to list remote files: %v", err)
+	}
+
+	// Read the references after listing so that any file created in between
+	// is within the grace period rather than unreferenced.
+	referenced, err := c.db.ReferencedIds()
+	if err != nil {
+		return err
+	}
+
+	var count, bytes uint64
+	for _, file := range files {
+		if referenced[file.Id] {
+			continue
+		}
+
+		// Already moved to the Drive trash by an earlier run.
+		if c.trash && file.Trashed {
+			continue
+		}
+
+		if time.Since(file.CreatedTime) < c.grace {
+			fmt.Printf("skipping %s (%d bytes, created %s): within grace "+
+				"period\n", file.Id, file.Size,
+				file.CreatedTime.Format(time.RFC3339))
+			continue
+		}
+
+		fmt.Printf("unreferenced: %s (%d bytes, created %s)\n", file.Id,
+			file.Size, file.CreatedTime.Format(time.RFC3339))
+		count++
+		bytes += file.Size
+
+		if c.dryRun {
+			continue
+		}
+
+		if c.trash {
+			err = c.driveApi.Trash(file.Id)
+		} else {
+			err = c.driveApi.Delete(file.Id)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to remove %s: %v", file.Id, err)
+		}
+	}
+
+	switch {
+	case c.dryRun:
+		fmt.Printf("%d unreferenced files using %d bytes would be removed\n",
+			count, bytes)
+	case c.trash:
+		fmt.Printf("moved %d unreferenced files using %d bytes to the trash\n",
+			count, bytes)
+	default:
+		fmt.Printf("deleted %d unreferenced files using %d bytes\n", count,
+			bytes)
+	}
+
+	return nil
+}
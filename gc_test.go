@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestGcIgnoresOtherOwners ensures that gc only removes unreferenced files that
+// were uploaded for the same filesystem, and leaves alone those of another
+// filesystem that shares the account.
+func TestGcIgnoresOtherOwners(t *testing.T) {
+	fs := newTestFileSystem(t, DriveFileSystemOptions{})
+	defer fs.Close()
+
+	referenced := fs.writeFile(t, "file", []byte("referenced"))
+	orphan, err := fs.driveApi.Create(bytes.NewReader([]byte("orphan")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := fs.drive.api(t)
+	other.Owner = "another-filesystem"
+	foreign, err := other.Create(bytes.NewReader([]byte("foreign")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &collector{db: fs.db, driveApi: fs.driveApi}
+	if err := c.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fs.drive.content(orphan.Id); ok {
+		t.Fatal("Expecting the unreferenced file to be deleted")
+	}
+	if _, ok := fs.drive.content(referenced.Id); !ok {
+		t.Fatal("Expecting the referenced file to be kept")
+	}
+	if _, ok := fs.drive.content(foreign.Id); !ok {
+		t.Fatal("Expecting another filesystem's file to be kept")
+	}
+}
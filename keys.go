@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/simonhorlick/fusedrive/encryption"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+)
+
+// passphraseEnv is the environment variable that may hold the passphrase.
+const passphraseEnv = "FUSEDRIVE_PASSPHRASE"
+
+// readPassphrase returns the passphrase read from file if it's set, or from the
+// environment, and otherwise prompts for it. A prompted passphrase must be
+// entered twice if confirm is set.
+func readPassphrase(file string, confirm bool) ([]byte, error) {
+	if file != "" {
+		passphrase, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(passphrase, "\r\n"), nil
+	}
+
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	passphrase, err := promptPassphrase("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if confirm {
+		again, err := promptPassphrase("Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+
+	return passphrase, nil
+}
+
+// promptPassphrase reads a line from the terminal without echoing it.
+func promptPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prompt for passphrase: %v", err)
+	}
+	defer tty.Close()
+
+	fd := int(tty.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+		return nil, err
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadBytes('\n')
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase := bytes.TrimRight(line, "\r\n")
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase must not be empty")
+	}
+	return passphrase, nil
+}
+
+// initEncryption creates a master key protected by the passphrase, and the first
+// data key protected by the master key. It returns the master key.
+func initEncryption(db *metadb.DB, passphrase []byte) ([]byte, error) {
+	salt, err := encryption.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	kek, err := encryption.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey, err := encryption.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	wrappedMasterKey, err := encryption.WrapKey(kek, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := encryption.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	wrappedDataKey, err := encryption.WrapKey(masterKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.PutSalt(salt); err != nil {
+		return nil, err
+	}
+	if err := db.PutDataKey(1, wrappedDataKey); err != nil {
+		return nil, err
+	}
+
+	// The master key is written last as it marks the filesystem as encrypted.
+	if err := db.PutMasterKey(wrappedMasterKey); err != nil {
+		return nil, err
+	}
+	return masterKey, nil
+}
+
+// metadataKey returns the key that encrypts the metadata in the database.
+func metadataKey(masterKey []byte) []byte {
+	return encryption.DeriveSubkey(masterKey, "metadata")
+}
+
+// unlockMasterKey returns the master key protected by the passphrase.
+func unlockMasterKey(db *metadb.DB, passphrase []byte) ([]byte, error) {
+	salt, err := db.GetSalt()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := db.GetMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	kek, err := encryption.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.UnwrapKey(kek, wrapped)
+}
+
+// unlock returns the keyring of an encrypted filesystem, and unlocks the
+// metadata in the database if it's encrypted.
+func unlock(db *metadb.DB, passphrase []byte) (*encryption.Keyring, error) {
+	masterKey, err := unlockMasterKey(db, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypted, err := db.IsMetadataEncrypted(); err != nil {
+		return nil, err
+	} else if encrypted {
+		if err := db.UnlockMetadata(metadataKey(masterKey)); err != nil {
+			return nil, err
+		}
+	}
+
+	wrapped, err := db.GetDataKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[uint32][]byte)
+	for generation, key := range wrapped {
+		keys[generation], err = encryption.UnwrapKey(masterKey, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unwrap data key %d: %v",
+				generation, err)
+		}
+	}
+
+	return encryption.NewKeyring(keys), nil
+}
+
+// openDB opens the database in dataDir, asking for the passphrase if its
+// metadata is encrypted.
+func openDB(dataDir string) (*metadb.DB, error) {
+	db, err := metadb.Open(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := db.IsMetadataEncrypted()
+	if err == nil && encrypted {
+		var passphrase []byte
+		passphrase, err = readPassphrase("", false)
+		if err == nil {
+			_, err = unlock(db, passphrase)
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// encrypt enables encryption on a filesystem that has no files, or encrypts the
+// metadata of an encrypted filesystem.
+func encrypt(dataDir string, args []string) error {
+	flags := newFlagSet("encrypt")
+	passphraseFile := flags.String("passphrase-file", "",
+		"read the passphrase from this file")
+	metadata := flags.Bool("metadata", false,
+		"also encrypt the names, attributes and small files in the database")
+	flags.Parse(args)
+
+	db, err := metadb.Open(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if encrypted, err := db.IsEncrypted(); err != nil {
+		return err
+	} else if encrypted {
+		if !*metadata {
+			return errors.New("filesystem is already encrypted")
+		}
+		return encryptMetadata(db, *passphraseFile)
+	}
+
+	// Existing files would be left unencrypted.
+	files, _, err := db.FilesystemStats()
+	if err != nil {
+		return err
+	}
+	snapshots, err := db.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	if files > 0 || len(snapshots) > 0 {
+		return errors.New("encryption can only be enabled on an empty " +
+			"filesystem")
+	}
+
+	passphrase, err := readPassphrase(*passphraseFile, true)
+	if err != nil {
+		return err
+	}
+
+	masterKey, err := initEncryption(db, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if *metadata {
+		if err := db.EncryptMetadata(metadataKey(masterKey)); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Encryption enabled")
+	return nil
+}
+
+// encryptMetadata encrypts the metadata of a filesystem whose content is
+// already encrypted.
+func encryptMetadata(db *metadb.DB, passphraseFile string) error {
+	if encrypted, err := db.IsMetadataEncrypted(); err != nil {
+		return err
+	} else if encrypted {
+		return errors.New("metadata is already encrypted")
+	}
+
+	passphrase, err := readPassphrase(passphraseFile, false)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockMasterKey(db, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := db.EncryptMetadata(metadataKey(masterKey)); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Metadata encrypted")
+	return nil
+}
+
+// readNewPassphrase returns the passphrase read from file if it's set, and
+// otherwise prompts for it twice. Unlike readPassphrase it ignores the
+// environment, which is likely to hold the passphrase being replaced.
+func readNewPassphrase(file string) ([]byte, error) {
+	if file != "" {
+		return readPassphrase(file, false)
+	}
+
+	passphrase, err := promptPassphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := promptPassphrase("Confirm new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+// rekey changes the passphrase of an encrypted filesystem, and optionally adds
+// a new data key that remote files are re-encrypted with while it's mounted.
+func rekey(dataDir string, args []string) error {
+	flags := newFlagSet("rekey")
+	passphraseFile := flags.String("passphrase-file", "",
+		"read the current passphrase from this file")
+	newPassphraseFile := flags.String("new-passphrase-file", "",
+		"read the new passphrase from this file")
+	rotate := flags.Bool("rotate", false,
+		"add a new data key and re-encrypt every file with it")
+	keepPassphrase := flags.Bool("keep-passphrase", false,
+		"don't change the passphrase")
+	flags.Parse(args)
+
+	if *keepPassphrase && !*rotate {
+		return errors.New("nothing to do")
+	}
+
+	db, err := metadb.Open(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if encrypted, err := db.IsEncrypted(); err != nil {
+		return err
+	} else if !encrypted {
+		return errors.New("filesystem isn't encrypted")
+	}
+
+	passphrase, err := readPassphrase(*passphraseFile, false)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockMasterKey(db, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if *rotate {
+		if err := rotateDataKey(db, masterKey); err != nil {
+			return err
+		}
+	}
+
+	if !*keepPassphrase {
+		newPassphrase, err := readNewPassphrase(*newPassphraseFile)
+		if err != nil {
+			return err
+		}
+		if err := changePassphrase(db, masterKey, newPassphrase); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Passphrase changed")
+	}
+
+	return nil
+}
+
+// rotateDataKey adds a data key with the next generation, which is used for new
+// files, and records that existing remote files are to be re-encrypted with it.
+func rotateDataKey(db *metadb.DB, masterKey []byte) error {
+	wrapped, err := db.GetDataKeys()
+	if err != nil {
+		return err
+	}
+
+	var generation uint32
+	for g := range wrapped {
+		if g > generation {
+			generation = g
+		}
+	}
+	generation++
+
+	dataKey, err := encryption.NewKey()
+	if err != nil {
+		return err
+	}
+	wrappedDataKey, err := encryption.WrapKey(masterKey, dataKey)
+	if err != nil {
+		return err
+	}
+
+	if err := db.PutDataKey(generation, wrappedDataKey); err != nil {
+		return err
+	}
+	if err := db.StartRotation(generation); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Added data key %d, files will be re-encrypted "+
+		"with it while the filesystem is mounted\n", generation)
+	return nil
+}
+
+// changePassphrase wraps the master key with a key derived from a new
+// passphrase. The master key itself, and so the data keys and metadata key, are
+// unchanged, so nothing else needs to be re-encrypted.
+func changePassphrase(db *metadb.DB, masterKey, passphrase []byte) error {
+	salt, err := encryption.NewSalt()
+	if err != nil {
+		return err
+	}
+	kek, err := encryption.DeriveKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	wrapped, err := encryption.WrapKey(kek, masterKey)
+	if err != nil {
+		return err
+	}
+	return db.ReplaceMasterKey(salt, wrapped)
+}
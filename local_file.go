@@ -15,9 +15,12 @@ import (
 type FileReference struct {
 	file *os.File
 	cache *LocalFileCache
-	name string
+	inode uint64
 	isReader bool
 
+	// refs is the entry in the file table shared by all clients of this file.
+	refs *refcountedFile
+
 	db *metadb.DB
 
 	// We embed a nodefs.NewDefaultFile() that returns ENOSYS for every
@@ -30,12 +33,18 @@ func (f *FileReference) SetInode(*nodefs.Inode) {
 }
 
 
+// name returns the current path of this file, which changes if the file is
+// renamed while it's open.
+func (f *FileReference) name() string {
+	return f.cache.Name(f)
+}
+
 func (f *FileReference) String() string {
-	return fmt.Sprintf("FileReference(%s)", f.name)
+	return fmt.Sprintf("FileReference(%s)", f.name())
 }
 
 func (f *FileReference) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse.Status) {
-	log.Printf("Read for %s at offset %d bufsize %d", f.name, off, len(buf))
+	log.Printf("Read for %s at offset %d bufsize %d", f.name(), off, len(buf))
 	err := f.cache.EnsureLocal(f)
 	if err != nil {
 		return nil, fuse.EIO
@@ -46,7 +55,7 @@ func (f *FileReference) Read(buf []byte, off int64) (res fuse.ReadResult, code f
 }
 
 func (f *FileReference) Write(data []byte, off int64) (uint32, fuse.Status) {
-	log.Printf("Write for %s at offset %d bufsize %d", f.name, off, len(data))
+	log.Printf("Write for %s at offset %d bufsize %d", f.name(), off, len(data))
 
 	if f.isReader {
 		return 0, fuse.EPERM
@@ -63,7 +72,7 @@ func (f *FileReference) Write(data []byte, off int64) (uint32, fuse.Status) {
 }
 
 func (f *FileReference) Flush() fuse.Status {
-	log.Printf("Flush for %s", f.name)
+	log.Printf("Flush for %s", f.name())
 
 	// Since Flush() may be called for each dup'd fd, we don't
 	// want to really close the file, we just want to flush. This
@@ -78,13 +87,13 @@ func (f *FileReference) Flush() fuse.Status {
 }
 
 func (f *FileReference) Fsync(flags int) (code fuse.Status) {
-	log.Printf("Fsync for %s", f.name)
+	log.Printf("Fsync for %s", f.name())
 	r := fuse.ToStatus(syscall.Fsync(int(f.file.Fd())))
 	return r
 }
 
 func (f *FileReference) Truncate(size uint64) fuse.Status {
-	log.Printf("Truncate for %s", f.name)
+	log.Printf("Truncate for %s", f.name())
 
 	err := f.cache.EnsureLocal(f)
 	if err != nil {
@@ -96,8 +105,8 @@ func (f *FileReference) Truncate(size uint64) fuse.Status {
 }
 
 func (f *FileReference) Chmod(mode uint32) fuse.Status {
-	log.Printf("Chmod for %s", f.name)
-	err := f.db.SetMode(f.name, mode)
+	log.Printf("Chmod for %s", f.name())
+	err := f.db.SetMode(f.name(), mode)
 	if err != nil {
 		return fuse.EPERM
 	}
@@ -109,14 +118,35 @@ func (f *FileReference) Chown(uid uint32, gid uint32) fuse.Status {
 }
 
 func (f *FileReference) GetAttr(out *fuse.Attr) fuse.Status {
-	log.Printf("GetAttr for %s", f.name)
+	name := f.name()
+	log.Printf("GetAttr for %s", name)
+
+	// If the file has been unlinked then it no longer exists in the database,
+	// but the local copy is still available.
+	if attributes, unlinked := f.cache.UnlinkedAttributes(f); unlinked {
+		err := f.cache.EnsureLocal(f)
+		if err != nil {
+			return fuse.EIO
+		}
+
+		info, err := f.file.Stat()
+		if err != nil {
+			log.Printf("failed to stat local file for %s: %v", name, err)
+			return fuse.EIO
+		}
+
+		attributes.Size = uint64(info.Size())
+		toFuseAttributes(attributes, out)
+
+		return fuse.OK
+	}
 
-	attributes, err := f.db.GetAttributes(f.name)
+	attributes, err := f.db.GetAttributes(name)
 
 	if err == metadb.DoesNotExist {
 		return fuse.ENOENT
 	} else if err != nil {
-		log.Printf("failed to read file metadata %s: %v", f.name, err)
+		log.Printf("failed to read file metadata %s: %v", name, err)
 		return fuse.ENODATA
 	}
 
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/encryption"
 	"github.com/simonhorlick/fusedrive/metadb"
 	"github.com/simonhorlick/fusedrive/multimutex"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 func (f *FileReference) Release() {
@@ -21,6 +29,30 @@ type refcountedFile struct {
 	count   int
 	dirty   bool
 	fetched bool
+
+	// name is the current path of this file. It's updated when the file, or
+	// one of its ancestor directories, is renamed while the file is open.
+	name string
+
+	// unlinked is true once the file has been removed from the filesystem
+	// while clients still held it open. The remote copy is deleted when the
+	// last client releases the file.
+	unlinked bool
+
+	// attributes are the attributes the file had when it was unlinked.
+	attributes metadb.Attributes
+}
+
+// stream counts the clients streaming a remote copy of a file.
+type stream struct {
+	id    string
+	count int
+
+	// unlinked is true once the remote copy is no longer part of the
+	// filesystem, because the file was removed or its content was replaced,
+	// while clients were streaming it. The remote copy is deleted when the
+	// last client releases the file.
+	unlinked bool
 }
 
 // LocalFileCache copies files locally and re-uploads them when all clients have
@@ -30,52 +62,76 @@ type LocalFileCache struct {
 
 	db *metadb.DB
 
-	// files lists all currently open files, their reference counts and whether
-	// they've been written to.
-	files   map[string]*refcountedFile
+	// files lists all currently open files keyed by inode number, their
+	// reference counts and whether they've been written to.
+	files map[uint64]*refcountedFile
 
-	// filesMu synchronizes access to the files map.
+	// streams lists the remote copies of files that are open for streaming
+	// directly from the remote, keyed by inode number. They aren't copied
+	// locally, but their remote copy mustn't be replaced or deleted while
+	// they're open. A file has more than one if its content was replaced while
+	// it was being streamed.
+	streams map[uint64][]*stream
+
+	// filesMu synchronizes access to the files and streams maps and the names
+	// of the files within them.
 	filesMu sync.Mutex
 
-	// locks provides fine-grained locking over individual path names.
+	// locks provides fine-grained locking over individual inodes.
 	locks *multimutex.KeyedMutex
+
+	options DriveFileSystemOptions
 }
 
-func NewLocalFileCache(api *api.DriveApi, db *metadb.DB) *LocalFileCache {
+func NewLocalFileCache(api *api.DriveApi, db *metadb.DB,
+	options DriveFileSystemOptions) *LocalFileCache {
 	return &LocalFileCache{
-		api:   api,
-		db:    db,
-		files: make(map[string]*refcountedFile),
-		locks: multimutex.NewKeyedMutex(),
+		api:     api,
+		db:      db,
+		files:   make(map[uint64]*refcountedFile),
+		streams: make(map[uint64][]*stream),
+		locks:   multimutex.NewKeyedMutex(),
+		options: options,
 	}
 }
 
+// lockKey returns the name used to lock the given inode.
+func lockKey(inode uint64) string {
+	return strconv.FormatUint(inode, 10)
+}
+
 // MarkDirty ensures the given file is marked as changed and put back to the
 // remote when all clients have released it.
 func (c *LocalFileCache) MarkDirty(file *FileReference) {
 	c.filesMu.Lock()
 	defer c.filesMu.Unlock()
 
-	info, ok := c.files[file.name]
-	if !ok {
-		panic(fmt.Sprintf("expected entry for %s in file table", file.name))
-	}
+	info := file.refs
 
 	if !info.dirty {
-		log.Printf("Marking file %s as dirty", file.name)
+		log.Printf("Marking file %s as dirty", info.name)
 	}
 
 	info.dirty = true
 }
 
 // Open returns the local file that backs this fuse file. If the file does not
-// exist locally then it is created first.
-func (c *LocalFileCache) Open(name, id string, isReader bool) *FileReference {
-	log.Printf("Open for file %s, read is %s", name, isReader)
-
-	// Take out a lock on this name.
-	c.locks.Lock(name)
-	defer c.locks.Unlock(name)
+// exist locally then it is created first. Returns metadb.DoesNotExist if the
+// file has been removed since attributes were read.
+func (c *LocalFileCache) Open(name string, attributes metadb.Attributes,
+	isReader bool) (*FileReference, error) {
+	log.Printf("Open for file %s, read is %t", name, isReader)
+
+	// Take out a lock on this inode.
+	c.locks.Lock(lockKey(attributes.Inode))
+	defer c.locks.Unlock(lockKey(attributes.Inode))
+
+	// The file may have been unlinked before the lock was taken, in which case
+	// its remote copy may already be gone.
+	if !c.exists(name, attributes) {
+		log.Printf("File %s was removed before it was opened", name)
+		return nil, metadb.DoesNotExist
+	}
 
 	// First check if the file already exists, if we're the first reader then
 	// grab the file from gdrive and update the map again. This is safe because
@@ -83,7 +139,7 @@ func (c *LocalFileCache) Open(name, id string, isReader bool) *FileReference {
 	c.filesMu.Lock()
 	defer c.filesMu.Unlock()
 
-	info, ok := c.files[name]
+	info, ok := c.files[attributes.Inode]
 
 	// If this is the first reference to the file then grab the file from gdrive
 	// and write it locally.
@@ -92,138 +148,678 @@ func (c *LocalFileCache) Open(name, id string, isReader bool) *FileReference {
 
 		f, err := ioutil.TempFile("", "")
 		if err != nil {
-			return nil
+			return nil, err
 		}
 
 		// Fetch the file lazily. Some application will Open a file and never
 		// issue reads or writes.
 		info = &refcountedFile{
-			file: f,
-			count: 1,
-			dirty: false,
-			id: id,
+			file:    f,
+			count:   1,
+			dirty:   false,
+			id:      attributes.Id,
 			fetched: false,
+			name:    name,
 		}
-		c.files[name] = info
+		c.files[attributes.Inode] = info
 	} else {
 		log.Printf("File %s is currently open %d times", name, info.count)
 		info.count++
 	}
 
 	return &FileReference{
-		db: c.db,
-		cache: c,
-		name: name,
-		file: info.file,
+		db:       c.db,
+		cache:    c,
+		inode:    attributes.Inode,
+		file:     info.file,
+		refs:     info,
 		isReader: isReader,
+	}, nil
+}
+
+// exists returns true if the database still holds the node with the given
+// attributes at name. The inode must be locked, so that the node can't be
+// removed before it's opened.
+func (c *LocalFileCache) exists(name string, attributes metadb.Attributes) bool {
+	current, err := c.db.GetAttributes(name)
+	if err != nil {
+		if err != metadb.DoesNotExist {
+			log.Printf("failed to read attributes for %s: %v", name, err)
+		}
+		return false
 	}
+	return current.Inode == attributes.Inode
 }
 
-func (c *LocalFileCache) IsOpen(name string) bool {
+// IsOpen returns true if any client has the given inode open.
+func (c *LocalFileCache) IsOpen(inode uint64) bool {
 	c.filesMu.Lock()
 	defer c.filesMu.Unlock()
 
-	_, isOpen := c.files[name]
+	_, isOpen := c.files[inode]
 
-	return isOpen
+	return isOpen || len(c.streams[inode]) > 0
 }
 
-func (c *LocalFileCache) Release(file *FileReference) {
-	log.Printf("Release %s", file.name)
+// isStreamed returns true if any client is streaming the remote file with the
+// given id. c.filesMu must be held.
+func (c *LocalFileCache) isStreamed(id string) bool {
+	for _, streams := range c.streams {
+		for _, s := range streams {
+			if s.id == id {
+				return true
+			}
+		}
+	}
+	return false
+}
 
+// unlinkStreams marks the streams of the remote file with the given id as
+// unlinked, so that it's deleted once the last of them is released. Returns
+// false if it isn't being streamed. c.filesMu must be held.
+func (c *LocalFileCache) unlinkStreams(id string) bool {
+	unlinked := false
+	for _, streams := range c.streams {
+		for _, s := range streams {
+			if s.id == id {
+				log.Printf("File %s is no longer reachable but streamed %d "+
+					"times, deferring deletion", s.id, s.count)
+				s.unlinked = true
+				unlinked = true
+			}
+		}
+	}
+	return unlinked
+}
+
+// OpenStream records that a client is streaming the file with the given
+// attributes directly from the remote. It returns false if the file is already
+// open locally, in which case the client must use the local copy as it may have
+// changes that haven't been uploaded, or if it has since been removed.
+func (c *LocalFileCache) OpenStream(name string,
+	attributes metadb.Attributes) bool {
+	c.locks.Lock(lockKey(attributes.Inode))
+	defer c.locks.Unlock(lockKey(attributes.Inode))
+
+	// Leave it to Open to report files that have been removed.
+	if !c.exists(name, attributes) {
+		return false
+	}
+
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	if _, ok := c.files[attributes.Inode]; ok {
+		log.Printf("File %s is open locally, not streaming", name)
+		return false
+	}
+
+	var s *stream
+	for _, other := range c.streams[attributes.Inode] {
+		if other.id == attributes.Id {
+			s = other
+		}
+	}
+	if s == nil {
+		s = &stream{id: attributes.Id}
+		c.streams[attributes.Inode] = append(c.streams[attributes.Inode], s)
+	}
+	s.count++
+
+	log.Printf("Streaming %s, now streamed %d times", name, s.count)
+
+	return true
+}
+
+// ReleaseStream records that a client has stopped streaming the remote file
+// with the given id, which holds the content of the given inode.
+func (c *LocalFileCache) ReleaseStream(inode uint64, id string) {
+	c.locks.Lock(lockKey(inode))
+	defer c.locks.Unlock(lockKey(inode))
+
+	c.filesMu.Lock()
+	streams := c.streams[inode]
+	i := 0
+	for i < len(streams) && streams[i].id != id {
+		i++
+	}
+	if i == len(streams) {
+		c.filesMu.Unlock()
+		return
+	}
+	s := streams[i]
+	s.count--
+	if s.count > 0 {
+		c.filesMu.Unlock()
+		return
+	}
+	streams = append(streams[:i], streams[i+1:]...)
+	if len(streams) == 0 {
+		delete(c.streams, inode)
+	} else {
+		c.streams[inode] = streams
+	}
+
+	// If the file is also open locally then the remote copy is deleted when
+	// the local copy is released.
+	refs, isOpen := c.files[inode]
+	deleteRemote := s.unlinked && !(isOpen && refs.id == s.id)
+	c.filesMu.Unlock()
+
+	// This was the last reference to an unlinked file, so the remote copy is
+	// no longer reachable.
+	if deleteRemote && s.id != "" {
+		log.Printf("Deleting unlinked file %s from remote", s.id)
+		if err := deleteBlob(c.api, c.db, s.id); err != nil {
+			log.Printf("failed to delete file %s: %v", s.id, err)
+		}
+	}
+}
+
+// RunIfClosed runs fn while none of the given inodes are open, and prevents them
+// from being opened until it returns. It returns false without running fn if
+// any of them are already open.
+func (c *LocalFileCache) RunIfClosed(inodes []uint64, fn func() error) (bool,
+	error) {
+	// Always take the locks in the same order to avoid deadlock.
+	sorted := append([]uint64(nil), inodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for i, inode := range sorted {
+		if i > 0 && inode == sorted[i-1] {
+			continue
+		}
+		c.locks.Lock(lockKey(inode))
+		defer c.locks.Unlock(lockKey(inode))
+	}
+
+	for _, inode := range sorted {
+		if c.IsOpen(inode) {
+			return false, nil
+		}
+	}
+
+	return true, fn()
+}
+
+// RunLocked runs fn while holding the lock of the given inode, so that it
+// doesn't overlap with the file being opened, unlinked or purged.
+func (c *LocalFileCache) RunLocked(inode uint64, fn func() error) error {
+	c.locks.Lock(lockKey(inode))
+	defer c.locks.Unlock(lockKey(inode))
+
+	return fn()
+}
+
+// Name returns the current path of the given file.
+func (c *LocalFileCache) Name(file *FileReference) string {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	return file.refs.name
+}
+
+// Rename calls rename, which is expected to rename oldName to newName in the
+// database, and updates the names of any open files at or below oldName. The
+// file table is locked throughout so that open files never observe a name that
+// doesn't match the database.
+func (c *LocalFileCache) Rename(oldName, newName string,
+	rename func() error) error {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	if err := rename(); err != nil {
+		return err
+	}
+
+	for _, info := range c.files {
+		if info.unlinked {
+			continue
+		}
+
+		if info.name == oldName {
+			info.name = newName
+		} else if strings.HasPrefix(info.name, oldName+"/") {
+			info.name = newName + strings.TrimPrefix(info.name, oldName)
+		} else {
+			continue
+		}
+
+		log.Printf("Open file renamed to %s", info.name)
+	}
+
+	return nil
+}
+
+// Unlink marks the open or streamed file with the given attributes as removed
+// from the filesystem. Existing clients can continue to use the file and the
+// remote copy is deleted when the last of them releases it. Returns false if
+// the file is not currently open.
+func (c *LocalFileCache) Unlink(attributes metadb.Attributes) bool {
+	c.locks.Lock(lockKey(attributes.Inode))
+	defer c.locks.Unlock(lockKey(attributes.Inode))
+
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	// A file can be streamed and open locally at the same time, in which case
+	// both must be marked so neither deletes the remote copy from under the
+	// other.
+	streamed := attributes.Id != "" && c.unlinkStreams(attributes.Id)
+
+	refs, ok := c.files[attributes.Inode]
+	if !ok {
+		return streamed
+	}
+
+	log.Printf("File %s is unlinked but open %d times, deferring deletion",
+		refs.name, refs.count)
+
+	refs.unlinked = true
+	refs.attributes = attributes
+
+	return true
+}
+
+// UnlinkedAttributes returns the attributes the file had when it was unlinked,
+// or false if the file is still present in the filesystem.
+func (c *LocalFileCache) UnlinkedAttributes(file *FileReference) (
+	metadb.Attributes, bool) {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	return file.refs.attributes, file.refs.unlinked
+}
+
+func (c *LocalFileCache) Release(file *FileReference) {
 	// If this was the last reference then delete the file from the
 	// local filesystem and upload it back to gdrive.
-	c.locks.Lock(file.name)
-	defer c.locks.Unlock(file.name)
+	c.locks.Lock(lockKey(file.inode))
+	defer c.locks.Unlock(lockKey(file.inode))
 
 	// If there are no more references, and if this file is dirty, then
 	// re-upload it now. We hold the file lock for the duration to prevent any
 	// other clients opening this file while it's being uploaded.
 	c.filesMu.Lock()
-	refs, ok := c.files[file.name]
-	if !ok {
-		panic("Expected file to have a reference count!")
-	}
+	refs := file.refs
+	name := refs.name
+
+	log.Printf("Release %s", name)
 
 	refs.count--
 
 	if refs.count == 0 {
 		log.Printf("Reference count for %s is zero, will remove local file",
-			file.name)
-		delete(c.files, file.name)
+			name)
+		delete(c.files, file.inode)
 	} else {
-		log.Printf("Reference count for %s is %d", file.name, refs.count)
+		log.Printf("Reference count for %s is %d", name, refs.count)
 	}
+	unlinked := refs.unlinked
+
+	// Clients streaming the remote copy delete it once they're done with it.
+	deleteRemote := unlinked && refs.count == 0 && !c.isStreamed(refs.id)
 	c.filesMu.Unlock()
 
-	if refs.dirty {
-		log.Printf("Local file %s is dirty, uploading changes", file.name)
+	// Changes to an unlinked file can never be observed once it's closed, so
+	// there's no point uploading them.
+	if refs.dirty && !unlinked {
+		log.Printf("Local file %s is dirty, uploading changes", name)
+
+		c.sync(refs, name)
+	}
+
+	if refs.count == 0 {
+		log.Printf("Deleting local file %s", name)
 
-		_, err := refs.file.Seek(0, 0)
+		// Close and remove local file
+		localPath := refs.file.Name()
+		err := refs.file.Close()
 		if err != nil {
-			log.Printf("failed to seek local file: %v", err)
+			log.Printf("failed to close local file: %v", err)
+		}
+		err = os.Remove(localPath)
+		if err != nil {
+			log.Printf("failed to remove local file: %v", err)
 		}
 
-		if refs.id == EmptyId {
-			log.Printf("Creating new file on remote for %s", file.name)
-			id, err := c.api.Create(refs.file)
-			if err != nil {
-				log.Printf("error creating file %s: %v", file.name, err)
-			}
-			err = c.db.SetId(file.name, id)
+		// This was the last reference to an unlinked file, so the remote copy
+		// is no longer reachable.
+		if deleteRemote && refs.id != "" {
+			log.Printf("Deleting unlinked file %s (%s) from remote", name,
+				refs.id)
+			err := deleteBlob(c.api, c.db, refs.id)
 			if err != nil {
-				log.Printf("failed to set id for file %s: %v", file.name, err)
+				log.Printf("failed to delete file %s (%s): %v", name,
+					refs.id, err)
 			}
-		} else {
-			log.Printf("Updating existing file on remote for %s", file.name)
+		}
+	}
+}
 
-			err := c.api.Update(refs.id, refs.file)
-			if err != nil {
-				log.Printf("error updating file %s: %v", file.name, err)
-			}
+// sync writes the content of the given file back to the remote, unless it's
+// the same as the content that's already there.
+func (c *LocalFileCache) sync(refs *refcountedFile, name string) {
+	// Encrypted files are compared by their sha256, as the md5 is of the
+	// encrypted copy.
+	md5sum, sha256sum, err := computeChecksums(refs.file,
+		c.options.Sha256Checksums || c.options.Dedup ||
+			c.options.Keyring != nil)
+	if err != nil {
+		log.Printf("failed to checksum local file %s: %v", name, err)
+		c.setState(refs, metadb.UploadFailed)
+		return
+	}
+
+	info, err := refs.file.Stat()
+	if err != nil {
+		log.Printf("failed to stat local file %s: %v", name, err)
+		c.setState(refs, metadb.UploadFailed)
+		return
+	}
+
+	// Tools often rewrite files in place without changing them.
+	if c.isUnchanged(refs, md5sum, sha256sum) {
+		log.Printf("Content of %s is unchanged, skipping upload", name)
+		c.touch(refs)
+		return
+	}
+
+	c.setState(refs, metadb.Uploading)
+
+	remote, remoteMd5, err := c.upload(refs, name, md5sum, sha256sum)
+	if err != nil {
+		log.Printf("error uploading file %s: %v", name, err)
+
+		// The remote still has the previous content, if any, so the database
+		// is left describing that.
+		c.setState(refs, metadb.UploadFailed)
+		return
+	}
+
+	// The file may have been renamed while it was being uploaded, so look up
+	// its current name and hold the table lock while updating it.
+	c.filesMu.Lock()
+	name = refs.name
+	err = c.db.SetSynced(name, remote.Id, uint64(info.Size()), remoteMd5,
+		sha256sum)
+	if err != nil {
+		log.Printf("failed to update file %s after upload: %v", name, err)
+	}
+	if err := c.db.SetMtime(name, time.Now()); err != nil {
+		log.Printf("failed to set mtime for file %s: %v", name, err)
+	}
+	previousId := refs.id
+	refs.id = remote.Id
+
+	// Clients streaming the previous remote copy delete it once they're done
+	// with it.
+	previousStreamed := previousId != remote.Id && c.unlinkStreams(previousId)
+	c.filesMu.Unlock()
+
+	if len(sha256sum) > 0 {
+		if err := c.db.IndexBlob(remote.Id, sha256sum); err != nil {
+			log.Printf("failed to index file %s: %v", name, err)
 		}
+	}
 
-		// Update size.
-		info, err := refs.file.Stat()
-		err = c.db.SetSize(file.name, uint64(info.Size()))
+	// The file no longer uses its previous remote copy, which can be deleted
+	// if nothing else shares it.
+	if previousId != "" && previousId != remote.Id && !previousStreamed {
+		err := deleteBlob(c.api, c.db, previousId)
 		if err != nil {
-			log.Printf("error setting size for file %s: %v", file.name, err)
+			log.Printf("failed to delete previous remote copy of %s (%s): %v",
+				name, previousId, err)
 		}
 	}
+}
+
+// isUnchanged returns true if the remote copy of the given file is up to date
+// and has the given checksums.
+func (c *LocalFileCache) isUnchanged(refs *refcountedFile, md5sum,
+	sha256sum []byte) bool {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	attributes, err := c.db.GetAttributes(refs.name)
+	if err != nil {
+		log.Printf("failed to read attributes for %s: %v", refs.name, err)
+		return false
+	}
 
-	if refs.count == 0 {
-		log.Printf("Deleting local file %s", file.name)
+	if refs.id == "" || attributes.Id != refs.id ||
+		attributes.State != metadb.Synced {
+		return false
+	}
 
-		// Close and remove local file
-		localPath := refs.file.Name()
-		err := refs.file.Close()
+	if len(sha256sum) > 0 && len(attributes.Sha256) > 0 {
+		return bytes.Equal(sha256sum, attributes.Sha256)
+	}
+
+	// The md5 of an encrypted file is of the encrypted copy.
+	if c.options.Keyring != nil {
+		return false
+	}
+	return len(attributes.Md5) > 0 && bytes.Equal(md5sum, attributes.Md5)
+}
+
+// touch records that the given file was modified now.
+func (c *LocalFileCache) touch(refs *refcountedFile) {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	if err := c.db.SetMtime(refs.name, time.Now()); err != nil {
+		log.Printf("failed to set mtime for file %s: %v", refs.name, err)
+	}
+}
+
+// upload writes the content of the given file, which has the given checksums,
+// to the remote. It returns the metadata of the remote copy and its md5, which
+// differs from the md5 of the content if the file is encrypted.
+func (c *LocalFileCache) upload(refs *refcountedFile, name string, md5sum,
+	sha256sum []byte) (api.RemoteFile, []byte, error) {
+	// Files with the same content share a single remote copy.
+	if c.options.Dedup {
+		remote, remoteMd5, ok := c.findDuplicate(name, md5sum, sha256sum)
+		if ok {
+			return remote, remoteMd5, nil
+		}
+	}
+
+	var content io.Reader = refs.file
+	if c.options.Keyring != nil {
+		blob, blobMd5, err := encryptFile(c.options.Keyring, refs.file)
 		if err != nil {
-			log.Printf("failed to close local file: %v", err)
+			return api.RemoteFile{}, nil, err
 		}
-		err = os.Remove(localPath)
+		defer removeTempFile(blob)
+
+		content = blob
+		md5sum = blobMd5
+	}
+
+	// A remote file that's shared with another file or a snapshot, or that's
+	// being streamed, must not be modified, so the new content is uploaded as
+	// a new file instead. The new file starts without the revisions of the
+	// old one.
+	var err error
+	shared := false
+	if refs.id != "" {
+		shared, err = c.isShared(refs.id)
 		if err != nil {
-			log.Printf("failed to remove local file: %v", err)
+			log.Printf("failed to check references to %s: %v", name, err)
+			shared = true
+		}
+
+		c.filesMu.Lock()
+		shared = shared || c.isStreamed(refs.id)
+		c.filesMu.Unlock()
+	}
+
+	var remote api.RemoteFile
+	if refs.id == "" || shared {
+		log.Printf("Creating new file on remote for %s", name)
+		remote, err = c.api.Create(content)
+	} else {
+		log.Printf("Updating existing file on remote for %s", name)
+
+		// Nothing may share the old content once it's been replaced.
+		if err := c.db.UnindexBlob(refs.id); err != nil {
+			return api.RemoteFile{}, nil, err
 		}
+		remote, err = c.api.Update(refs.id, content)
+	}
+	if err != nil {
+		return remote, nil, err
 	}
+
+	// Make sure the remote received the content that was written.
+	if remote.Md5Checksum != "" &&
+		remote.Md5Checksum != hex.EncodeToString(md5sum) {
+		return remote, nil, fmt.Errorf("remote md5 %s doesn't match "+
+			"local md5 %x", remote.Md5Checksum, md5sum)
+	}
+
+	return remote, md5sum, nil
 }
 
-func (c *LocalFileCache) EnsureLocal(file *FileReference) error {
-	c.locks.Lock(file.name)
-	defer c.locks.Unlock(file.name)
+// findDuplicate returns the remote file that has the given content, along with
+// its md5, or false if there isn't one.
+func (c *LocalFileCache) findDuplicate(name string, md5sum, sha256sum []byte) (
+	api.RemoteFile, []byte, bool) {
+	id, ok, err := c.db.FindBlob(sha256sum)
+	if err != nil {
+		log.Printf("failed to look up content of %s: %v", name, err)
+		return api.RemoteFile{}, nil, false
+	} else if !ok {
+		return api.RemoteFile{}, nil, false
+	}
 
+	// Make sure the remote file still exists, and find its md5 as it differs
+	// from the md5 of the content if it's encrypted.
+	remote, err := c.api.GetFile(id)
+	if err != nil {
+		log.Printf("failed to get duplicate %s of %s: %v", id, name, err)
+		return api.RemoteFile{}, nil, false
+	}
+	if remote.Trashed {
+		return api.RemoteFile{}, nil, false
+	}
+
+	remoteMd5, err := hex.DecodeString(remote.Md5Checksum)
+	if err != nil || (c.options.Keyring == nil &&
+		!bytes.Equal(remoteMd5, md5sum)) {
+		log.Printf("Duplicate %s of %s has unexpected md5 %s", id, name,
+			remote.Md5Checksum)
+		return api.RemoteFile{}, nil, false
+	}
+
+	log.Printf("Content of %s matches remote file %s", name, id)
+	return remote, remoteMd5, true
+}
+
+// isShared returns true if the remote file with the given id is referenced by
+// a snapshot or by more than one node.
+func (c *LocalFileCache) isShared(id string) (bool, error) {
+	snapshotted, err := c.db.IsSnapshotted(id)
+	if err != nil || snapshotted {
+		return snapshotted, err
+	}
+
+	refs, err := c.db.BlobRefs(id)
+	return refs > 1, err
+}
+
+// setState records the sync state of the given file under its current name.
+func (c *LocalFileCache) setState(refs *refcountedFile, state metadb.SyncState) {
 	c.filesMu.Lock()
 	defer c.filesMu.Unlock()
 
-	refs, ok := c.files[file.name]
-	if !ok {
-		panic(fmt.Sprintf("expected files entry for %s", file.name))
+	err := c.db.SetState(refs.name, state)
+	if err != nil {
+		log.Printf("failed to set state for file %s: %v", refs.name, err)
+	}
+}
+
+// fetch downloads the remote copy of the given file into its local file and
+// checks it against the checksums recorded when it was uploaded. Files that
+// don't match are marked as corrupt.
+func (c *LocalFileCache) fetch(refs *refcountedFile) error {
+	attributes := refs.attributes
+	if !refs.unlinked {
+		var err error
+		attributes, err = c.db.GetAttributes(refs.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Reading entire file %s (%s) from remote", refs.name, refs.id)
+
+	// Encrypted files are downloaded to a temporary file and decrypted from
+	// there.
+	blob := refs.file
+	if c.options.Keyring != nil {
+		var err error
+		blob, err = ioutil.TempFile("", "")
+		if err != nil {
+			return err
+		}
+		defer removeTempFile(blob)
 	}
 
+	err := c.api.ReadAll(refs.id, blob)
+	if api.IsNotFound(err) && !refs.unlinked {
+		log.Printf("File %s (%s) is missing from remote", refs.name, refs.id)
+		if err := c.db.SetState(refs.name, metadb.RemoteMissing); err != nil {
+			log.Printf("failed to set state for file %s: %v", refs.name, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// The md5 is of the remote copy, and the sha256 is of the content.
+	err = verifyChecksums(blob, attributes.Md5, nil)
+	if err == nil && c.options.Keyring != nil {
+		err = decryptFile(c.options.Keyring, blob, refs.file)
+	}
+	if err == nil {
+		err = verifyChecksums(refs.file, nil, attributes.Sha256)
+	}
+
+	if err == errChecksumMismatch || err == encryption.Corrupt {
+		log.Printf("File %s (%s) is corrupt: %v", refs.name, refs.id, err)
+		if !refs.unlinked {
+			if err := c.db.SetState(refs.name, metadb.Corrupt); err != nil {
+				log.Printf("failed to set state for file %s: %v", refs.name,
+					err)
+			}
+		}
+	}
+	if err != nil {
+		// Don't leave the corrupt content where it could be read.
+		if err := refs.file.Truncate(0); err != nil {
+			log.Printf("failed to truncate local file: %v", err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (c *LocalFileCache) EnsureLocal(file *FileReference) error {
+	c.locks.Lock(lockKey(file.inode))
+	defer c.locks.Unlock(lockKey(file.inode))
+
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	refs := file.refs
+
 	if !refs.fetched {
-		if refs.id != EmptyId {
-			log.Printf("Reading entire file %s (%s) from remote", file.name, refs.id)
-			err := c.api.ReadAll(refs.id, file.file)
-			if err != nil {
+		if refs.id != "" {
+			if err := c.fetch(refs); err != nil {
 				log.Printf("Error reading file: %v", err)
 				return err
 			}
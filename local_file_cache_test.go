@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"syscall"
+	"testing"
+)
+
+// streamingOptions streams every file that's opened read-only.
+var streamingOptions = DriveFileSystemOptions{
+	Reads:     DefaultReadOptions,
+	Streaming: StreamPolicy{MinSize: 1},
+}
+
+// openStream opens a file for streaming.
+func (fs *testFileSystem) openStream(t *testing.T, name string) nodefs.File {
+	file, status := fs.Open(name, syscall.O_RDONLY, nil)
+	if status != fuse.OK {
+		t.Fatalf("Failed to open %s: %v", name, status)
+	}
+	if _, ok := file.(*DriveFile); !ok {
+		t.Fatalf("Expecting %s to be streamed, got %v", name, file)
+	}
+	return file
+}
+
+// expectRead ensures that reading an open file at off returns content.
+func expectRead(t *testing.T, file nodefs.File, off int64, content []byte) {
+	data, status := read(file, off, len(content))
+	if status != fuse.OK {
+		t.Fatalf("Failed to read at %d: %v", off, status)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Expecting %q at %d, got %q", content, off, data)
+	}
+}
+
+// TestWriteWhileStreamed ensures that writing to a file that's being streamed
+// uploads a new remote copy, and leaves the streamed copy until it's released.
+func TestWriteWhileStreamed(t *testing.T) {
+	fs := newTestFileSystem(t, streamingOptions)
+	defer fs.Close()
+
+	original := bytes.Repeat([]byte("a"), 100)
+	attributes := fs.writeFile(t, "file", original)
+
+	streamed := fs.openStream(t, "file")
+	expectRead(t, streamed, 0, original[:10])
+
+	writer, status := fs.Open("file", syscall.O_RDWR, nil)
+	if status != fuse.OK {
+		t.Fatalf("Failed to open for writing: %v", status)
+	}
+	updated := bytes.Repeat([]byte("b"), 100)
+	write(t, writer, updated)
+	writer.Release()
+
+	current, err := fs.db.GetAttributes("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Id == attributes.Id {
+		t.Fatal("Expecting a streamed remote copy not to be replaced")
+	}
+	if data, _ := fs.drive.content(current.Id); !bytes.Equal(data, updated) {
+		t.Fatalf("Expecting the new content to be uploaded, got %q", data)
+	}
+	if data, _ := fs.drive.content(attributes.Id); !bytes.Equal(data,
+		original) {
+		t.Fatalf("Expecting the streamed copy to be kept, got %q", data)
+	}
+
+	// The stream carries on reading the content it was opened with.
+	expectRead(t, streamed, 10, original[10:])
+	streamed.Release()
+
+	if _, ok := fs.drive.content(attributes.Id); ok {
+		t.Fatal("Expecting the previous remote copy to be deleted")
+	}
+	if _, ok := fs.drive.content(current.Id); !ok {
+		t.Fatal("Expecting the new remote copy to be kept")
+	}
+}
+
+// TestUnlinkWhileStreamedAndOpen ensures that a file that's both streamed and
+// open locally when it's unlinked keeps its remote copy until both are
+// released.
+func TestUnlinkWhileStreamedAndOpen(t *testing.T) {
+	fs := newTestFileSystem(t, streamingOptions)
+	defer fs.Close()
+
+	content := []byte("content")
+	attributes := fs.writeFile(t, "file", content)
+
+	streamed := fs.openStream(t, "file")
+	local, status := fs.Open("file", syscall.O_RDWR, nil)
+	if status != fuse.OK {
+		t.Fatalf("Failed to open: %v", status)
+	}
+
+	if status := fs.Unlink("file", nil); status != fuse.OK {
+		t.Fatalf("Failed to unlink: %v", status)
+	}
+
+	expectRead(t, local, 0, content)
+	local.Release()
+	if _, ok := fs.drive.content(attributes.Id); !ok {
+		t.Fatal("Expecting the remote copy to be kept while it's streamed")
+	}
+
+	expectRead(t, streamed, 0, content)
+	streamed.Release()
+	if _, ok := fs.drive.content(attributes.Id); ok {
+		t.Fatal("Expecting the remote copy to be deleted")
+	}
+}
@@ -7,12 +7,19 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/blockcache"
+	"github.com/simonhorlick/fusedrive/encryption"
 	"github.com/simonhorlick/fusedrive/metadb"
+	"github.com/simonhorlick/fusedrive/serialize_reads"
 	"log"
 	"os"
 	"path"
+	"time"
 )
 
+// blockCacheDir is the directory within the datadir that holds the block cache.
+const blockCacheDir = "blocks"
+
 func main() {
 	log.SetFlags(log.Lmicroseconds)
 	// Scans the arg list and sets up flags
@@ -20,18 +27,93 @@ func main() {
 	other := flag.Bool("allow-other", false, "mount with -o allowother.")
 	dataDir := flag.String("datadir", "/var/fusedrive",
 		"directory to store meta database and credentials file")
+	keepRevisions := flag.Duration("keep-revisions", 0,
+		"keep a revision of each file forever at most this often, or 0 to "+
+			"let Drive expire old revisions")
+	trashRetention := flag.Duration("trash-retention", 0,
+		"how long deleted files are kept in the trash, or 0 to delete "+
+			"immediately")
+	capToStaging := flag.Bool("cap-to-staging-disk", false,
+		"limit the reported free space to the free space on the local disk "+
+			"used to stage uploads")
+	sha256Checksums := flag.Bool("sha256", false,
+		"record the sha256 of uploaded files and verify it on download")
+	dedup := flag.Bool("dedup", false,
+		"store files with identical content as a single file on Google Drive")
+	scrubBandwidth := flag.Int64("scrub-bandwidth", 0,
+		"bytes per second used to verify files in the background, or 0 to "+
+			"disable")
+	scrubInterval := flag.Duration("scrub-interval", 30*24*time.Hour,
+		"how often each file is verified in the background")
+	passphraseFile := flag.String("passphrase-file", "",
+		"file containing the passphrase of an encrypted filesystem, instead "+
+			"of prompting for it or reading $"+passphraseEnv)
+	readQueueDepth := flag.Int("read-queue-depth",
+		serialize_reads.DefaultOptions.QueueDepth,
+		"maximum number of concurrent reads of a file held back to be "+
+			"reordered, or 0 to disable reordering")
+	readWindow := flag.Duration("read-window",
+		serialize_reads.DefaultOptions.Window,
+		"how long to wait for further reads of a file before issuing the "+
+			"one with the lowest offset")
+	readTimeout := flag.Duration("read-timeout",
+		serialize_reads.DefaultOptions.Timeout,
+		"how long a slow read of a file may hold up the reads queued behind "+
+			"it, or 0 to wait indefinitely")
+	readStreams := flag.Int("read-streams", DefaultReadOptions.MaxStreams,
+		"number of sequential streams of reads followed through each file, "+
+			"such as the tracks of a film")
+	readStreamIdle := flag.Duration("read-stream-idle",
+		DefaultReadOptions.StreamIdleTimeout,
+		"how long a stream of reads is kept without being read")
+	readahead := flag.Int("readahead", 4,
+		"number of range requests kept in flight ahead of each sequential "+
+			"reader of a streamed file, or 0 to issue one large request at "+
+			"a time")
+	readaheadSize := flag.Uint64("readahead-size", api.DefaultReadaheadSize,
+		"largest size in bytes of each readahead request")
+	blockCacheSize := flag.Int64("block-cache-size", 0,
+		"maximum size in bytes of the cache of streamed content kept in the "+
+			"datadir, or 0 to disable it")
+	streamMinSize := flag.Uint64("stream-min-size", 32<<20,
+		"stream files at least this many bytes from Google Drive when "+
+			"they're opened read-only, instead of downloading them first, "+
+			"or 0 to only stream files in -stream-dirs")
+	streamDirs := flag.String("stream-dirs", "",
+		"comma-separated directories whose files are always streamed when "+
+			"opened read-only")
 
 	flag.Parse()
 	if flag.NArg() < 1 {
-		fmt.Printf("usage: %s MOUNTPOINT\n", path.Base(os.Args[0]))
+		fmt.Printf("usage: %s [options] MOUNTPOINT\n", path.Base(os.Args[0]))
+		printCommands(path.Base(os.Args[0]))
 		fmt.Printf("\noptions:\n")
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
 
+	if cmd := findCommand(flag.Arg(0)); cmd != nil {
+		if err := cmd.run(*dataDir, flag.Args()[1:]); err != nil {
+			log.Fatalf("%s: %v", cmd.name, err)
+		}
+		return
+	}
+
 	opts := nodefs.NewOptions()
 
 	driveApi := api.NewDriveApi(*dataDir)
+	driveApi.KeepRevisionInterval = *keepRevisions
+	driveApi.Readahead = *readahead
+	driveApi.ReadaheadSize = *readaheadSize
+
+	if *blockCacheSize > 0 {
+		cache, err := blockcache.Open(path.Join(*dataDir, blockCacheDir),
+			blockcache.DefaultBlockSize, *blockCacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		driveApi.BlockCache = cache
+	}
 
 	db, err := metadb.Open(*dataDir)
 	if err != nil {
@@ -39,8 +121,64 @@ func main() {
 	}
 	defer db.Close()
 
-	pathFs := pathfs.NewPathNodeFs(NewDriveFileSystem(driveApi, db),
-		&pathfs.PathNodeFsOptions{})
+	driveApi.Owner, err = db.OwnerId()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The keys of an encrypted filesystem are only ever held in memory. The
+	// database can't be read until they're unlocked if its metadata is
+	// encrypted.
+	var keyring *encryption.Keyring
+	encrypted, err := db.IsEncrypted()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if encrypted {
+		passphrase, err := readPassphrase(*passphraseFile, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyring, err = unlock(db, passphrase)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Any uploads that were in progress when fusedrive last stopped have lost
+	// their local copy.
+	interrupted, err := db.RecoverInterruptedUploads()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range interrupted {
+		log.Printf("Upload of %s was interrupted, marking as failed", name)
+	}
+
+	fs := NewDriveFileSystem(driveApi, db, DriveFileSystemOptions{
+		TrashRetention:   *trashRetention,
+		CapToStagingDisk: *capToStaging,
+		Sha256Checksums:  *sha256Checksums,
+		Dedup:            *dedup,
+		ScrubBandwidth:   *scrubBandwidth,
+		ScrubInterval:    *scrubInterval,
+		Keyring:          keyring,
+		Reads: ReadOptions{
+			Serializer: serialize_reads.Options{
+				QueueDepth: *readQueueDepth,
+				Window:     *readWindow,
+				Timeout:    *readTimeout,
+			},
+			MaxStreams:        *readStreams,
+			StreamIdleTimeout: *readStreamIdle,
+		},
+		Streaming: StreamPolicy{
+			MinSize: *streamMinSize,
+			Dirs:    splitList(*streamDirs),
+		},
+	})
+
+	pathFs := pathfs.NewPathNodeFs(fs, &pathfs.PathNodeFsOptions{})
 	conn := nodefs.NewFileSystemConnector(pathFs.Root(), opts)
 	mountPoint := flag.Arg(0)
 	mOpts := &fuse.MountOptions{
@@ -0,0 +1,180 @@
+package metadb
+
+import (
+	"bytes"
+	"encoding/binary"
+	bolt "go.etcd.io/bbolt"
+	"log"
+)
+
+// readBlob returns the number of nodes that reference the remote file with the
+// given id, and the key its content is indexed under if it's known.
+func readBlob(tx *bolt.Tx, id string) (uint32, []byte) {
+	v := tx.Bucket(blobsBucket).Get([]byte(id))
+	if v == nil {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint32(v), append([]byte(nil), v[4:]...)
+}
+
+// writeBlob stores the reference count and content index key of the remote
+// file with the given id.
+func writeBlob(tx *bolt.Tx, id string, refs uint32, key []byte) error {
+	v := make([]byte, 4, 4+len(key))
+	binary.LittleEndian.PutUint32(v, refs)
+	v = append(v, key...)
+	return tx.Bucket(blobsBucket).Put([]byte(id), v)
+}
+
+// unindex removes the content index entry under key if it refers to id.
+func unindex(tx *bolt.Tx, id string, key []byte) error {
+	if len(key) == 0 {
+		return nil
+	}
+
+	index := tx.Bucket(blobIndexBucket)
+	if string(index.Get(key)) != id {
+		return nil
+	}
+	return index.Delete(key)
+}
+
+// addBlobRef adjusts the number of nodes that reference the remote file with
+// the given id by delta. Files that are no longer referenced are removed from
+// the content index.
+func addBlobRef(tx *bolt.Tx, id string, delta int) error {
+	refs, key := readBlob(tx, id)
+
+	refs = uint32(int(refs) + delta)
+
+	if refs == 0 {
+		if err := unindex(tx, id, key); err != nil {
+			return err
+		}
+		return tx.Bucket(blobsBucket).Delete([]byte(id))
+	}
+
+	return writeBlob(tx, id, refs, key)
+}
+
+// updateBlobRefs adjusts the reference counts of remote files when a node's
+// attributes change from before to after. Either may be nil if the node is
+// being created or deleted.
+func updateBlobRefs(tx *bolt.Tx, before, after *Attributes) error {
+	if before != nil && after != nil && before.HasRemoteCopy() &&
+		after.HasRemoteCopy() && before.Id == after.Id {
+		return nil
+	}
+
+	if before != nil && before.HasRemoteCopy() {
+		if err := addBlobRef(tx, before.Id, -1); err != nil {
+			return err
+		}
+	}
+
+	if after != nil && after.HasRemoteCopy() {
+		if err := addBlobRef(tx, after.Id, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countBlobRefs fills in the reference counts of every remote file, and indexes
+// the content of files that have a sha256. This is needed for databases created
+// before reference counts existed, which never have encrypted metadata.
+func countBlobRefs(tx *bolt.Tx) error {
+	log.Print("Counting references to remote files")
+	return tx.Bucket(pathsBucket).ForEach(func(k, v []byte) error {
+		attributes, err := readAttributes(bytes.NewReader(v))
+		if err != nil {
+			return err
+		}
+
+		if err := updateBlobRefs(tx, nil, &attributes); err != nil {
+			return err
+		}
+
+		if attributes.State != Synced || len(attributes.Sha256) == 0 {
+			return nil
+		}
+		return indexBlob(tx, attributes.Id, attributes.Sha256)
+	})
+}
+
+// BlobRefs returns the number of nodes, including those in the trash, that
+// reference the remote file with the given id.
+func (d *DB) BlobRefs(id string) (uint32, error) {
+	var refs uint32
+	err := d.View(func(tx *bolt.Tx) error {
+		refs, _ = readBlob(tx, id)
+		return nil
+	})
+	return refs, err
+}
+
+// IsReferenced returns true if any node or snapshot references the remote file
+// with the given id.
+func (d *DB) IsReferenced(id string) (bool, error) {
+	var referenced bool
+	err := d.View(func(tx *bolt.Tx) error {
+		refs, _ := readBlob(tx, id)
+		referenced = refs > 0 ||
+			tx.Bucket(snapshotRefsBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return referenced, err
+}
+
+// indexBlob records the key that the content of the remote file with the given
+// id is indexed under, which is its sha256 unless the metadata is encrypted.
+func indexBlob(tx *bolt.Tx, id string, key []byte) error {
+	refs, previous := readBlob(tx, id)
+	if refs == 0 {
+		return nil
+	}
+
+	if err := unindex(tx, id, previous); err != nil {
+		return err
+	}
+	if err := writeBlob(tx, id, refs, key); err != nil {
+		return err
+	}
+
+	if len(key) == 0 {
+		return nil
+	}
+	return tx.Bucket(blobIndexBucket).Put(key, []byte(id))
+}
+
+// IndexBlob records that the remote file with the given id has content with
+// the given sha256, so that files with identical content can share it. Files
+// that aren't referenced by any node aren't indexed.
+func (d *DB) IndexBlob(id string, sha256 []byte) error {
+	log.Printf("IndexBlob %s: %x", id, sha256)
+	return d.Update(func(tx *bolt.Tx) error {
+		return indexBlob(tx, id, d.codec.serialiseSha256(sha256))
+	})
+}
+
+// UnindexBlob removes the remote file with the given id from the content index.
+// This must be done before its content is replaced.
+func (d *DB) UnindexBlob(id string) error {
+	log.Printf("UnindexBlob %s", id)
+	return d.Update(func(tx *bolt.Tx) error {
+		return indexBlob(tx, id, nil)
+	})
+}
+
+// FindBlob returns the id of a remote file whose content has the given sha256,
+// or false if there isn't one.
+func (d *DB) FindBlob(sha256 []byte) (string, bool, error) {
+	var id string
+	err := d.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket(blobIndexBucket).Get(
+			d.codec.serialiseSha256(sha256)))
+		return nil
+	})
+	return id, id != "", err
+}
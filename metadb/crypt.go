@@ -0,0 +1,528 @@
+package metadb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/go-errors/errors"
+	"github.com/simonhorlick/fusedrive/encryption"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// The metadata in the database can be encrypted with a key that's only held in
+// memory. Each component of a path is encrypted deterministically, using a
+// synthetic IV computed from the name and its parent directory, so that the
+// descendants of a directory still share its prefix. Values are encrypted with
+// AES-256-GCM. Checksums and ids that are used as keys are replaced with an
+// HMAC, so they can still be looked up but not read.
+
+var (
+	// metadataCheckKey stores a value encrypted with the metadata key within
+	// keysBucket. It marks the metadata as encrypted and detects a wrong key.
+	metadataCheckKey = []byte("metadata-check")
+
+	metadataCheckValue = []byte("fusedrive metadata")
+
+	// Locked is returned by operations on a database with encrypted metadata
+	// that hasn't been unlocked.
+	Locked = errors.New("metadata is encrypted and hasn't been unlocked")
+
+	// WrongKey is returned when unlocking with the wrong key.
+	WrongKey = errors.New("wrong metadata key")
+
+	errInvalidName = errors.New("invalid encrypted name")
+)
+
+const (
+	// metadataKeySize is the size of the key used to encrypt metadata.
+	metadataKeySize = 32
+
+	// ivSize is the size of the synthetic IV that starts each encrypted name.
+	ivSize = aes.BlockSize
+)
+
+// codec converts paths and values to and from the form that's stored in the
+// database. A nil codec stores them unencrypted.
+type codec struct {
+	names    cipher.Block
+	macKey   []byte
+	values   cipher.AEAD
+	indexKey []byte
+	idKey    []byte
+}
+
+func newCodec(key []byte) (*codec, error) {
+	if len(key) != metadataKeySize {
+		return nil, errors.Errorf("metadata key must be %d bytes",
+			metadataKeySize)
+	}
+
+	names, err := aes.NewCipher(encryption.DeriveSubkey(key, "names"))
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(encryption.DeriveSubkey(key, "values"))
+	if err != nil {
+		return nil, err
+	}
+	values, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &codec{
+		names:    names,
+		macKey:   encryption.DeriveSubkey(key, "names-iv"),
+		values:   values,
+		indexKey: encryption.DeriveSubkey(key, "blob-index"),
+		idKey:    encryption.DeriveSubkey(key, "ids"),
+	}, nil
+}
+
+// hash returns the HMAC of v under key.
+func hash(key, v []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(v)
+	return mac.Sum(nil)
+}
+
+// serialiseSha256 returns the key that content with the given sha256 is
+// indexed under.
+func (c *codec) serialiseSha256(sha256 []byte) []byte {
+	if c == nil || len(sha256) == 0 {
+		return sha256
+	}
+	return hash(c.indexKey, sha256)
+}
+
+// serialiseId returns the key that facts about the remote file with the given
+// id are stored under, where they don't need to be listed by id.
+func (c *codec) serialiseId(id string) []byte {
+	if c == nil {
+		return []byte(id)
+	}
+	return hash(c.idKey, []byte(id))
+}
+
+// nameIV returns the synthetic IV of name within the directory parent.
+func (c *codec) nameIV(parent, name string) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(parent))
+	mac.Write([]byte{0})
+	mac.Write([]byte(name))
+	return mac.Sum(nil)[:ivSize]
+}
+
+// encryptName encrypts a single component of a path.
+func (c *codec) encryptName(parent, name string) string {
+	iv := c.nameIV(parent, name)
+	sealed := make([]byte, ivSize+len(name))
+	copy(sealed, iv)
+	cipher.NewCTR(c.names, iv).XORKeyStream(sealed[ivSize:], []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// decryptName reverses encryptName.
+func (c *codec) decryptName(parent, token string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(sealed) < ivSize {
+		return "", errInvalidName
+	}
+
+	iv := sealed[:ivSize]
+	name := make([]byte, len(sealed)-ivSize)
+	cipher.NewCTR(c.names, iv).XORKeyStream(name, sealed[ivSize:])
+
+	if !hmac.Equal(iv, c.nameIV(parent, string(name))) {
+		return "", errInvalidName
+	}
+	return string(name), nil
+}
+
+// serialisePath returns the key that path is stored under.
+func (c *codec) serialisePath(path string) []byte {
+	if c == nil || path == "" {
+		return []byte(path)
+	}
+
+	components := strings.Split(path, "/")
+	parent := ""
+	for i, name := range components {
+		components[i] = c.encryptName(parent, name)
+		if parent != "" {
+			parent += "/"
+		}
+		parent += name
+	}
+	return []byte(strings.Join(components, "/"))
+}
+
+// readPath returns the path that's stored under the key k.
+func (c *codec) readPath(k []byte) (string, error) {
+	if c == nil || len(k) == 0 {
+		return string(k), nil
+	}
+
+	components := strings.Split(string(k), "/")
+	parent := ""
+	for i, token := range components {
+		name, err := c.decryptName(parent, token)
+		if err != nil {
+			return "", err
+		}
+		components[i] = name
+		if parent != "" {
+			parent += "/"
+		}
+		parent += name
+	}
+	return strings.Join(components, "/"), nil
+}
+
+// seal encrypts a value.
+func (c *codec) seal(v []byte) ([]byte, error) {
+	if c == nil {
+		return v, nil
+	}
+
+	nonce := make([]byte, c.values.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.values.Seal(nonce, nonce, v, nil), nil
+}
+
+// open decrypts a value that was encrypted with seal.
+func (c *codec) open(v []byte) ([]byte, error) {
+	if c == nil {
+		return v, nil
+	}
+
+	nonceSize := c.values.NonceSize()
+	if len(v) < nonceSize {
+		return nil, WrongKey
+	}
+	plaintext, err := c.values.Open(nil, v[:nonceSize], v[nonceSize:], nil)
+	if err != nil {
+		return nil, WrongKey
+	}
+	return plaintext, nil
+}
+
+// serialiseAttributes returns the stored form of attributes.
+func (c *codec) serialiseAttributes(attributes Attributes) ([]byte, error) {
+	v, err := serialiseAttributes(attributes)
+	if err != nil {
+		return nil, err
+	}
+	return c.seal(v)
+}
+
+// readAttributes parses attributes stored by serialiseAttributes.
+func (c *codec) readAttributes(v []byte) (Attributes, error) {
+	v, err := c.open(v)
+	if err != nil {
+		return Attributes{}, err
+	}
+	return readAttributes(bytes.NewReader(v))
+}
+
+// View runs fn in a read-only transaction. It fails if the metadata is
+// encrypted and hasn't been unlocked.
+func (d *DB) View(fn func(*bolt.Tx) error) error {
+	if d.locked {
+		return Locked
+	}
+	return d.DB.View(fn)
+}
+
+// Update runs fn in a read-write transaction. It fails if the metadata is
+// encrypted and hasn't been unlocked.
+func (d *DB) Update(fn func(*bolt.Tx) error) error {
+	if d.locked {
+		return Locked
+	}
+	return d.DB.Update(fn)
+}
+
+// IsMetadataEncrypted returns true if the metadata in the database is
+// encrypted, in which case it must be unlocked before it can be used.
+func (d *DB) IsMetadataEncrypted() (bool, error) {
+	var encrypted bool
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		encrypted = tx.Bucket(keysBucket).Get(metadataCheckKey) != nil
+		return nil
+	})
+	return encrypted, err
+}
+
+// UnlockMetadata allows encrypted metadata to be used with the given key.
+func (d *DB) UnlockMetadata(key []byte) error {
+	c, err := newCodec(key)
+	if err != nil {
+		return err
+	}
+
+	err = d.DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(keysBucket).Get(metadataCheckKey)
+		if v == nil {
+			return errors.New("metadata isn't encrypted")
+		}
+		check, err := c.open(v)
+		if err != nil || !bytes.Equal(check, metadataCheckValue) {
+			return WrongKey
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.codec = c
+	d.locked = false
+
+	return d.initialise()
+}
+
+// EncryptMetadata encrypts every path and value in the filesystem, the trash
+// and snapshots, and the names of snapshots, with the given key. The checksums
+// and ids that index other facts are replaced with their HMAC. The database
+// remains unlocked.
+func (d *DB) EncryptMetadata(key []byte) error {
+	if d.codec != nil {
+		return errors.New("metadata is already encrypted")
+	}
+
+	c, err := newCodec(key)
+	if err != nil {
+		return err
+	}
+
+	err = d.Update(func(tx *bolt.Tx) error {
+		buckets := []*bolt.Bucket{tx.Bucket(pathsBucket),
+			tx.Bucket(contentBucket), tx.Bucket(trashBucket)}
+
+		err := tx.Bucket(snapshotsBucket).ForEach(func(k, v []byte) error {
+			if snapshot := tx.Bucket(snapshotsBucket).Bucket(k); snapshot != nil {
+				buckets = append(buckets, snapshot.Bucket(pathsBucket),
+					snapshot.Bucket(contentBucket))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, b := range buckets {
+			if err := encryptBucket(b, c); err != nil {
+				return err
+			}
+		}
+
+		if err := encryptSnapshotNames(tx.Bucket(snapshotsBucket),
+			c); err != nil {
+			return err
+		}
+		if err := encryptBlobs(tx, c); err != nil {
+			return err
+		}
+		err = rekeyBucket(tx.Bucket(scrubBucket), func(k []byte) []byte {
+			return c.serialiseId(string(k))
+		})
+		if err != nil {
+			return err
+		}
+
+		check, err := c.seal(metadataCheckValue)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(keysBucket).Put(metadataCheckKey, check)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.codec = c
+
+	// The unencrypted metadata is still in the pages that were freed.
+	return d.compact()
+}
+
+// compact rewrites the database into a new file, leaving out freed pages, and
+// replaces the original with it.
+func (d *DB) compact() error {
+	path := d.DB.Path()
+	compactPath := path + ".compact"
+
+	dst, err := bolt.Open(compactPath, dbFilePermission, nil)
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(dst, d.DB, 0)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+
+	if err := d.DB.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(compactPath, path); err != nil {
+		return err
+	}
+
+	d.DB, err = bolt.Open(path, dbFilePermission,
+		&bolt.Options{Timeout: openTimeout})
+	return err
+}
+
+// encryptBucket replaces every key and value in b, which are paths and
+// unencrypted values, with their encrypted form.
+func encryptBucket(b *bolt.Bucket, c *codec) error {
+	var keys, values [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		values = append(values, append([]byte(nil), v...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Encrypting %d entries", len(keys))
+
+	// Modifying the bucket while iterating over it is not permitted.
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	for i, k := range keys {
+		v, err := c.seal(values[i])
+		if err != nil {
+			return err
+		}
+		if err := b.Put(c.serialisePath(string(k)), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encryptSnapshotNames moves each snapshot in b to a bucket with its encrypted
+// name.
+func encryptSnapshotNames(b *bolt.Bucket, c *codec) error {
+	var names [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			names = append(names, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		dst, err := b.CreateBucket(c.serialisePath(string(name)))
+		if err != nil {
+			return err
+		}
+		if err := copyBucket(dst, b.Bucket(name)); err != nil {
+			return err
+		}
+		if err := b.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyBucket copies every key, value and nested bucket in src into dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, src.Bucket(k))
+	})
+}
+
+// encryptBlobs replaces the sha256 that each remote file's content is indexed
+// under with its HMAC.
+func encryptBlobs(tx *bolt.Tx, c *codec) error {
+	err := rekeyBucket(tx.Bucket(blobIndexBucket), func(k []byte) []byte {
+		return c.serialiseSha256(k)
+	})
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket(blobsBucket)
+	updated := make(map[string][]byte)
+	err = b.ForEach(func(k, v []byte) error {
+		if len(v) > 4 {
+			updated[string(k)] = append(append([]byte(nil), v[:4]...),
+				c.serialiseSha256(v[4:])...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Modifying the bucket while iterating over it is not permitted.
+	for k, v := range updated {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeyBucket replaces every key in b with the result of calling key with it,
+// keeping the values.
+func rekeyBucket(b *bolt.Bucket, key func([]byte) []byte) error {
+	var keys, values [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		values = append(values, append([]byte(nil), v...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Modifying the bucket while iterating over it is not permitted.
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	for i, k := range keys {
+		if err := b.Put(key(k), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
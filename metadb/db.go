@@ -2,7 +2,9 @@ package metadb
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/go-errors/errors"
 	bolt "go.etcd.io/bbolt"
@@ -11,11 +13,20 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
 	dbName           = "drive.db"
 	dbFilePermission = 0600
+
+	// openTimeout is how long to wait for another process to release the
+	// database before giving up.
+	openTimeout = time.Second
+
+	// TrashDir is the directory that deleted files are moved to. It's named
+	// so that it's unlikely to clash with a directory created by the user.
+	TrashDir = ".fusedrive-trash"
 )
 
 var (
@@ -28,11 +39,104 @@ var (
 	// keysBucket stores data related to encryption
 	keysBucket = []byte("keys-bucket")
 
+	// trashBucket maps the names of entries in TrashDir to where they were
+	// deleted from and when
+	trashBucket = []byte("trash-bucket")
+
+	// snapshotsBucket holds a bucket for each snapshot, named like a path,
+	// containing a copy of pathsBucket and contentBucket at the time the
+	// snapshot was taken
+	snapshotsBucket = []byte("snapshots-bucket")
+
+	// snapshotRefsBucket maps Google Drive ids to the number of snapshots that
+	// reference them
+	snapshotRefsBucket = []byte("snapshot-refs-bucket")
+
+	// scrubBucket maps Google Drive ids, or their HMAC if the metadata is
+	// encrypted, to when their content was last verified
+	scrubBucket = []byte("scrub-bucket")
+
+	// blobsBucket maps Google Drive ids to the number of nodes that reference
+	// them and the key their content is indexed under
+	blobsBucket = []byte("blobs-bucket")
+
+	// blobIndexBucket maps the sha256 of file content, or its HMAC if the
+	// metadata is encrypted, to the Google Drive id of a file with that
+	// content
+	blobIndexBucket = []byte("blob-index-bucket")
+
+	// infoBucket stores facts about the filesystem as a whole
+	infoBucket = []byte("info-bucket")
+
+	// ownerIdKey stores the random id that marks the files on the remote that
+	// belong to this filesystem within infoBucket
+	ownerIdKey = []byte("owner-id")
+
+	// masterKeyKey stores the wrapped master key within keysBucket
+	masterKeyKey = []byte("master-key")
+
+	// dataKeysBucket maps generations to wrapped data keys within keysBucket
+	dataKeysBucket = []byte("data-keys")
+
 	DoesNotExist = errors.New("does not exist")
 
 	AlreadyExists = errors.New("already exists")
+
+	InUse = errors.New("database is in use by another process")
 )
 
+// SyncState describes whether the content of a file is stored on the remote.
+// It's only meaningful for regular files that don't have HasContent set.
+type SyncState uint8
+
+const (
+	// LocalOnly files have never been uploaded and have no id.
+	LocalOnly SyncState = iota
+
+	// Uploading files are being written to the remote. A file that's still in
+	// this state when the filesystem is mounted was interrupted by a crash.
+	Uploading
+
+	// Synced files have their latest content stored on the remote.
+	Synced
+
+	// UploadFailed files couldn't be written to the remote. If the file has an
+	// id then the remote holds an older version of its content.
+	UploadFailed
+
+	// RemoteMissing files have an id that no longer exists on the remote.
+	RemoteMissing
+
+	// Corrupt files have a remote copy that doesn't match their checksum.
+	Corrupt
+
+	// legacyState marks attributes that were written before SyncState existed.
+	// It's never stored.
+	legacyState SyncState = 0xff
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case LocalOnly:
+		return "local-only"
+	case Uploading:
+		return "uploading"
+	case Synced:
+		return "synced"
+	case UploadFailed:
+		return "upload-failed"
+	case RemoteMissing:
+		return "remote-missing"
+	case Corrupt:
+		return "corrupt"
+	}
+	return fmt.Sprintf("SyncState(%d)", uint8(s))
+}
+
+// legacyEmptyId is the id that was given to files that hadn't been uploaded
+// before SyncState existed.
+var legacyEmptyId = string(bytes.Repeat([]byte{0x00}, 33))
+
 type Upload struct {
 	// Id is the Google Drive id for this file
 	Id string
@@ -57,6 +161,28 @@ type Attributes struct {
 
 	// True if the file content is stored in the db.
 	HasContent bool
+
+	// Inode uniquely identifies this node. It's assigned when the node is
+	// created and doesn't change when the node is renamed.
+	Inode uint64
+
+	// State records whether the content of this file is stored on the remote.
+	State SyncState
+
+	// Md5 and Sha256 are the checksums of the content that was last uploaded,
+	// or empty if they aren't known. Sha256 is only recorded if enabled.
+	Md5    []byte
+	Sha256 []byte
+
+	// Mtime is when the content of this node was last changed, or the zero
+	// time if it isn't known.
+	Mtime time.Time
+}
+
+// HasRemoteCopy returns true if the node is a file with content stored on the
+// remote, which may be out of date if State isn't Synced.
+func (a Attributes) HasRemoteCopy() bool {
+	return a.IsRegularFile && !a.HasContent && a.Id != ""
 }
 
 func serialiseAttributes(attributes Attributes) ([]byte, error) {
@@ -90,10 +216,64 @@ func writeAttributes(w io.Writer, attributes Attributes) error {
 	if err := binary.Write(w, binary.LittleEndian, attributes.HasContent); err != nil {
 		return err
 	}
+	if err := binary.Write(w, binary.LittleEndian, attributes.Inode); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, attributes.State); err != nil {
+		return err
+	}
+	if err := writeBytes(w, attributes.Md5); err != nil {
+		return err
+	}
+	if err := writeBytes(w, attributes.Sha256); err != nil {
+		return err
+	}
+	var mtime int64
+	if !attributes.Mtime.IsZero() {
+		mtime = attributes.Mtime.UnixNano()
+	}
+	if err := binary.Write(w, binary.LittleEndian, mtime); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// writeBytes writes data prefixed with its length.
+func writeBytes(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readOptionalBytes reads data written by writeBytes. If the value is missing
+// then nil is returned.
+func readOptionalBytes(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := readOptional(r, &length); err != nil || length == 0 {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readOptional reads a field that was added to the serialised attributes after
+// the initial format. Values written before the field existed end early, in
+// which case data is left unchanged.
+func readOptional(r io.Reader, data interface{}) error {
+	err := binary.Read(r, binary.LittleEndian, data)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
 // readAttributes ...
 func readAttributes(r io.Reader) (Attributes, error) {
 	var attributes Attributes
@@ -121,6 +301,41 @@ func readAttributes(r io.Reader) (Attributes, error) {
 	if err := binary.Read(r, binary.LittleEndian, &attributes.HasContent); err != nil {
 		return attributes, err
 	}
+	if err := readOptional(r, &attributes.Inode); err != nil {
+		return attributes, err
+	}
+
+	attributes.State = legacyState
+	if err := readOptional(r, &attributes.State); err != nil {
+		return attributes, err
+	}
+
+	var err error
+	if attributes.Md5, err = readOptionalBytes(r); err != nil {
+		return attributes, err
+	}
+	if attributes.Sha256, err = readOptionalBytes(r); err != nil {
+		return attributes, err
+	}
+	var mtime int64
+	if err := readOptional(r, &mtime); err != nil {
+		return attributes, err
+	}
+	if mtime != 0 {
+		attributes.Mtime = time.Unix(0, mtime)
+	}
+
+	// Files used to be marked as not uploaded with a special id.
+	if attributes.State == legacyState {
+		if attributes.Id == legacyEmptyId {
+			attributes.Id = ""
+			attributes.State = LocalOnly
+		} else if attributes.IsRegularFile && !attributes.HasContent {
+			attributes.State = Synced
+		} else {
+			attributes.State = LocalOnly
+		}
+	}
 
 	return attributes, nil
 }
@@ -130,6 +345,13 @@ func readAttributes(r io.Reader) (Attributes, error) {
 type DB struct {
 	*bolt.DB
 	dbPath string
+
+	// codec encrypts paths and values, or is nil if the metadata isn't
+	// encrypted.
+	codec *codec
+
+	// locked is true if the metadata is encrypted and hasn't been unlocked.
+	locked bool
 }
 
 // fileExists returns true if the file exists, and false otherwise.
@@ -191,20 +413,180 @@ func Open(dbPath string) (*DB, error) {
 		}
 	}
 
-	db, err := bolt.Open(path, dbFilePermission, nil)
+	db, err := bolt.Open(path, dbFilePermission,
+		&bolt.Options{Timeout: openTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, InUse
+	} else if err != nil {
+		return nil, err
+	}
+
+	d := &DB{DB: db, dbPath: dbPath}
+
+	if err := d.createMissing(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Encrypted metadata can't be read until it's unlocked.
+	d.locked, err = d.IsMetadataEncrypted()
 	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if d.locked {
+		return d, nil
+	}
+
+	if err := d.initialise(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &DB{DB: db, dbPath: dbPath}, nil
+	return d, nil
 }
 
-func (d *DB) Close() error {
-	return d.DB.Close()
+// initialise updates the nodes in the filesystem once the database can be read.
+func (d *DB) initialise() error {
+	if err := d.createTrashDir(); err != nil {
+		return err
+	}
+	return d.assignInodes()
+}
+
+// createMissing creates any buckets that were added after the database was
+// created.
+func (d *DB) createMissing() error {
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		countRefs := tx.Bucket(blobsBucket) == nil
+
+		for _, bucket := range [][]byte{trashBucket, snapshotsBucket,
+			snapshotRefsBucket, scrubBucket, blobsBucket, blobIndexBucket,
+			infoBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		if countRefs {
+			if err := countBlobRefs(tx); err != nil {
+				return err
+			}
+		}
+
+		return createOwnerId(tx)
+	})
+}
+
+// createOwnerId gives the filesystem a random owner id if it doesn't have one.
+func createOwnerId(tx *bolt.Tx) error {
+	b := tx.Bucket(infoBucket)
+	if b.Get(ownerIdKey) != nil {
+		return nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return err
+	}
+	return b.Put(ownerIdKey, []byte(hex.EncodeToString(id)))
+}
+
+// OwnerId returns the random id that marks the files on the remote that
+// belong to this filesystem. It's readable even while the metadata is locked.
+func (d *DB) OwnerId() (string, error) {
+	var id string
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket(infoBucket).Get(ownerIdKey))
+		return nil
+	})
+	return id, err
+}
+
+// createTrashDir creates TrashDir if it doesn't exist. It fails if there's
+// already a node at TrashDir that was created by the user, rather than taking
+// it over as the trash.
+func (d *DB) createTrashDir() error {
+	return d.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pathsBucket)
+		if v := b.Get(d.codec.serialisePath(TrashDir)); v != nil {
+			attributes, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+
+			// Directories created by the user are always given an id.
+			if attributes.IsRegularFile || attributes.Id != "" {
+				return fmt.Errorf("%s already exists and isn't the trash "+
+					"directory, move it elsewhere to continue", TrashDir)
+			}
+			return nil
+		}
+
+		inode, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		v, err := d.codec.serialiseAttributes(Attributes{
+			Mode:  0755,
+			Inode: inode,
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(d.codec.serialisePath(TrashDir), v)
+	})
+}
+
+// assignInodes gives an inode number to every node that was created before
+// inode numbers existed.
+func (d *DB) assignInodes() error {
+	return d.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pathsBucket)
+
+		updated := make(map[string][]byte)
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			attributes, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+
+			if attributes.Inode != 0 {
+				continue
+			}
+
+			attributes.Inode, err = b.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			v, err := d.codec.serialiseAttributes(attributes)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = v
+		}
+
+		if len(updated) > 0 {
+			log.Printf("Assigning inode numbers to %d nodes", len(updated))
+		}
+
+		// Modifying the bucket while iterating over it is not permitted.
+		for k, v := range updated {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
-func serialisePath(path string) []byte {
-	return []byte(path)
+func (d *DB) Close() error {
+	return d.DB.Close()
 }
 
 func (d *DB) GetAttributes(path string) (Attributes, error) {
@@ -213,11 +595,11 @@ func (d *DB) GetAttributes(path string) (Attributes, error) {
 	var err error
 	err = d.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(pathsBucket)
-		v := b.Get(serialisePath(path))
+		v := b.Get(d.codec.serialisePath(path))
 		if v == nil {
 			return DoesNotExist
 		}
-		attributes, err = readAttributes(bytes.NewReader(v))
+		attributes, err = d.codec.readAttributes(v)
 		return err
 	})
 	if err != nil {
@@ -227,15 +609,38 @@ func (d *DB) GetAttributes(path string) (Attributes, error) {
 	return attributes, nil
 }
 
+// SetAttributes stores the attributes for the node at path. If the attributes
+// don't have an inode number then a new one is assigned.
 func (d *DB) SetAttributes(path string, attributes Attributes) error {
 	log.Printf("SetAttributes %s: %v", path, attributes)
 	return d.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(pathsBucket)
-		v, err := serialiseAttributes(attributes)
+
+		if attributes.Inode == 0 {
+			inode, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			attributes.Inode = inode
+		}
+
+		var before *Attributes
+		if v := b.Get(d.codec.serialisePath(path)); v != nil {
+			previous, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+			before = &previous
+		}
+		if err := updateBlobRefs(tx, before, &attributes); err != nil {
+			return err
+		}
+
+		v, err := d.codec.serialiseAttributes(attributes)
 		if err != nil {
 			return err
 		}
-		return b.Put(serialisePath(path), v)
+		return b.Put(d.codec.serialisePath(path), v)
 	})
 }
 
@@ -245,12 +650,18 @@ func (d *DB) GetAndDeleteAttributes(path string) (Attributes, error) {
 	var err error
 	err = d.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(pathsBucket)
-		k := serialisePath(path)
+		k := d.codec.serialisePath(path)
 		v := b.Get(k)
 		if v == nil {
 			return DoesNotExist
 		}
-		attributes, err = readAttributes(bytes.NewReader(v))
+		attributes, err = d.codec.readAttributes(v)
+		if err != nil {
+			return err
+		}
+		if err := updateBlobRefs(tx, &attributes, nil); err != nil {
+			return err
+		}
 		return b.Delete(k)
 	})
 
@@ -266,51 +677,119 @@ func (d *DB) List(path string) ([]Entry, error) {
 	log.Printf("List %s", path)
 	var entries []Entry
 	err := d.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(pathsBucket).Cursor()
+		var err error
+		entries, err = d.codec.listBucket(tx.Bucket(pathsBucket), path)
+		return err
+	})
+
+	return entries, err
+}
+
+// isWithin returns true if k is the key prefix or the key of something inside
+// the directory it names. Siblings that merely share the prefix, such as "ab"
+// for "a", aren't within it.
+func isWithin(k, prefix []byte) bool {
+	if !bytes.HasPrefix(k, prefix) {
+		return false
+	}
+	return len(prefix) == 0 || len(k) == len(prefix) || k[len(prefix)] == '/'
+}
+
+// listBucket returns the entries in the directory at path within b, which maps
+// paths to attributes.
+func (c *codec) listBucket(b *bolt.Bucket, path string) ([]Entry, error) {
+	var entries []Entry
+
+	var exists bool
+
+	// The root directory always exists.
+	if path == "" {
+		exists = true
+	}
 
-		var exists bool
+	prefix := c.serialisePath(path)
+	cursor := b.Cursor()
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		if !isWithin(k, prefix) {
+			continue
+		}
 
-		// The root directory always exists.
-		if path == "" {
+		// Skip the directory we're listing.
+		if bytes.Equal(k, prefix) {
 			exists = true
+			continue
 		}
 
-		prefix := serialisePath(path)
-		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			// Skip the directory we're listing.
-			if bytes.Equal(k, prefix) {
-				exists = true
-				continue
-			}
+		name, err := c.readPath(k)
+		if err != nil {
+			return nil, err
+		}
 
-			// Find the path of this entry relative to path.
-			relativePath := strings.TrimPrefix(string(k), path)
-			relativePath = strings.TrimPrefix(relativePath, "/")
+		// Find the path of this entry relative to path.
+		relativePath := strings.TrimPrefix(name, path)
+		relativePath = strings.TrimPrefix(relativePath, "/")
 
-			// If the path contains further separators then it's part of a sub-
-			// directory and we can exclude it.
-			if strings.Contains(relativePath, "/") {
-				continue
-			}
+		// If the path contains further separators then it's part of a sub-
+		// directory and we can exclude it.
+		if strings.Contains(relativePath, "/") {
+			continue
+		}
+
+		// The trash is hidden from listings of the root directory.
+		if path == "" && relativePath == TrashDir {
+			continue
+		}
 
-			attributes, err := readAttributes(bytes.NewReader(v))
+		attributes, err := c.readAttributes(v)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{
+			Path:       relativePath,
+			Attributes: attributes,
+		})
+	}
+
+	if !exists {
+		return nil, DoesNotExist
+	}
+
+	return entries, nil
+}
+
+// Walk calls fn with the full path and attributes of every node in the
+// filesystem, including the trash. The nodes are read up front so fn is free to
+// modify the database.
+func (d *DB) Walk(fn func(path string, attributes Attributes) error) error {
+	var entries []Entry
+	err := d.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pathsBucket).ForEach(func(k, v []byte) error {
+			attributes, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+			path, err := d.codec.readPath(k)
 			if err != nil {
 				return err
 			}
 			entries = append(entries, Entry{
-				Path:       relativePath,
+				Path:       path,
 				Attributes: attributes,
 			})
-		}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
 
-		if !exists {
-			return DoesNotExist
+	for _, entry := range entries {
+		if err := fn(entry.Path, entry.Attributes); err != nil {
+			return err
 		}
+	}
 
-		return nil
-	})
-
-	return entries, err
+	return nil
 }
 
 func (d *DB) IsDirectoryEmpty(path string) (bool, error) {
@@ -318,25 +797,30 @@ func (d *DB) IsDirectoryEmpty(path string) (bool, error) {
 	return len(entries) == 0, err
 }
 
-func (d *DB) SetSize(path string, size uint64) error {
-	log.Printf("SetSize %s: %d", path, size)
+// updateAttributes calls fn to modify the attributes of the node at path.
+func (d *DB) updateAttributes(path string, fn func(*Attributes)) error {
 	return d.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(pathsBucket)
 
-		k := serialisePath(path)
+		k := d.codec.serialisePath(path)
 		v := b.Get(k)
 		if v == nil {
 			return DoesNotExist
 		}
 
-		attributes, err := readAttributes(bytes.NewReader(v))
+		attributes, err := d.codec.readAttributes(v)
 		if err != nil {
 			return err
 		}
 
-		attributes.Size = size
+		before := attributes
+		fn(&attributes)
 
-		updated, err := serialiseAttributes(attributes)
+		if err := updateBlobRefs(tx, &before, &attributes); err != nil {
+			return err
+		}
+
+		updated, err := d.codec.serialiseAttributes(attributes)
 		if err != nil {
 			return err
 		}
@@ -344,18 +828,25 @@ func (d *DB) SetSize(path string, size uint64) error {
 	})
 }
 
+func (d *DB) SetSize(path string, size uint64) error {
+	log.Printf("SetSize %s: %d", path, size)
+	return d.updateAttributes(path, func(attributes *Attributes) {
+		attributes.Size = size
+	})
+}
+
 func (d *DB) Rename(oldName string, newName string) error {
 	log.Printf("Rename %s -> %s", oldName, newName)
 	return d.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(pathsBucket)
 
-		k := serialisePath(oldName)
+		k := d.codec.serialisePath(oldName)
 		v := b.Get(k)
 		if v == nil {
 			return DoesNotExist
 		}
 
-		k2 := serialisePath(newName)
+		k2 := d.codec.serialisePath(newName)
 		v2 := b.Get(k2)
 		if v2 != nil {
 			return AlreadyExists
@@ -363,22 +854,40 @@ func (d *DB) Rename(oldName string, newName string) error {
 
 		c := b.Cursor()
 
-		prefix := serialisePath(oldName)
-		newPrefix := serialisePath(newName)
+		prefix := d.codec.serialisePath(oldName)
 
-		// Rename all children.
+		// Rename all children. Encrypted names depend on their parent
+		// directory, so each key is computed from the new path.
+		var oldKeys [][]byte
+		renamed := make(map[string][]byte)
 		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			unPrefixed := k[len(prefix):]
-			newKey := append(newPrefix, unPrefixed...)
+			if !isWithin(k, prefix) {
+				continue
+			}
 
-			log.Printf("Renaming key %s -> %s", k, newKey)
-			if err := b.Put(newKey, v); err != nil {
+			path, err := d.codec.readPath(k)
+			if err != nil {
 				return err
 			}
+			newPath := newName + strings.TrimPrefix(path, oldName)
+
+			log.Printf("Renaming key %s -> %s", path, newPath)
+			oldKeys = append(oldKeys, append([]byte(nil), k...))
+			renamed[string(d.codec.serialisePath(newPath))] =
+				append([]byte(nil), v...)
+		}
+
+		// Modifying the bucket while iterating over it is not permitted.
+		for _, k := range oldKeys {
 			if err := b.Delete(k); err != nil {
 				return err
 			}
 		}
+		for k, v := range renamed {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
 
 		return nil
 	})
@@ -390,8 +899,13 @@ func (d *DB) GetFile(path string) ([]byte, error) {
 	var err error
 	err = d.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(contentBucket)
-		v := b.Get(serialisePath(path))
+		v := b.Get(d.codec.serialisePath(path))
+		if v == nil {
+			content = []byte{}
+			return nil
+		}
 
+		v, err = d.codec.open(v)
 		content = make([]byte, len(v))
 		copy(content, v)
 
@@ -408,7 +922,11 @@ func (d *DB) PutFile(path string, data []byte) error {
 	log.Printf("PutFile %s", path)
 	return d.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(contentBucket)
-		return b.Put(serialisePath(path), data)
+		v, err := d.codec.seal(data)
+		if err != nil {
+			return err
+		}
+		return b.Put(d.codec.serialisePath(path), v)
 	})
 }
 
@@ -417,32 +935,14 @@ func (d *DB) RemoveFile(path string) error {
 	log.Printf("RemoveFile %s", path)
 	return d.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(contentBucket)
-		return b.Delete(serialisePath(path))
+		return b.Delete(d.codec.serialisePath(path))
 	})
 }
 
 func (d *DB) SetMode(path string, mode uint32) error {
 	log.Printf("SetMode %s: %d", path, mode)
-	return d.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(pathsBucket)
-		k := serialisePath(path)
-		v := b.Get(k)
-		if v == nil {
-			return DoesNotExist
-		}
-
-		attributes, err := readAttributes(bytes.NewReader(v))
-		if err != nil {
-			return err
-		}
-
+	return d.updateAttributes(path, func(attributes *Attributes) {
 		attributes.Mode = mode
-
-		newAttributes, err := serialiseAttributes(attributes)
-		if err != nil {
-			return err
-		}
-		return b.Put(k, newAttributes)
 	})
 }
 
@@ -461,32 +961,94 @@ func (d *DB) GetUploadQueue() []Upload {
 
 func (d *DB) SetId(path, id string) error {
 	log.Printf("SetId %s: %s", path, id)
-	return d.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(pathsBucket)
-		k := serialisePath(path)
-		v := b.Get(k)
-		if v == nil {
-			return DoesNotExist
-		}
+	return d.updateAttributes(path, func(attributes *Attributes) {
+		attributes.Id = id
+	})
+}
 
-		attributes, err := readAttributes(bytes.NewReader(v))
-		if err != nil {
-			return err
-		}
+// SetMtime records when the content of the node at path was last changed.
+func (d *DB) SetMtime(path string, mtime time.Time) error {
+	log.Printf("SetMtime %s: %s", path, mtime)
+	return d.updateAttributes(path, func(attributes *Attributes) {
+		attributes.Mtime = mtime
+	})
+}
+
+// SetState records a transition of the file at path to the given sync state.
+func (d *DB) SetState(path string, state SyncState) error {
+	log.Printf("SetState %s: %s", path, state)
+	return d.updateAttributes(path, func(attributes *Attributes) {
+		attributes.State = state
+	})
+}
 
+// SetSynced records that the file at path was uploaded to the remote with the
+// given id, size and checksums.
+func (d *DB) SetSynced(path, id string, size uint64, md5,
+	sha256 []byte) error {
+	log.Printf("SetSynced %s: %s (%d bytes, md5 %x)", path, id, size, md5)
+	return d.updateAttributes(path, func(attributes *Attributes) {
 		attributes.Id = id
+		attributes.Size = size
+		attributes.State = Synced
+		attributes.Md5 = md5
+		attributes.Sha256 = sha256
+	})
+}
 
-		newAttributes, err := serialiseAttributes(attributes)
+// RecoverInterruptedUploads marks every file that was still being uploaded as
+// having failed, which happens when fusedrive stops mid-upload. It returns the
+// paths of the files that were changed.
+func (d *DB) RecoverInterruptedUploads() ([]string, error) {
+	var paths []string
+	err := d.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pathsBucket)
+
+		updated := make(map[string][]byte)
+
+		err := b.ForEach(func(k, v []byte) error {
+			attributes, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+
+			if attributes.State != Uploading {
+				return nil
+			}
+
+			attributes.State = UploadFailed
+
+			v, err = d.codec.serialiseAttributes(attributes)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = v
+			return nil
+		})
 		if err != nil {
 			return err
 		}
-		return b.Put(k, newAttributes)
+
+		// Modifying the bucket while iterating over it is not permitted.
+		for k, v := range updated {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+			path, err := d.codec.readPath([]byte(k))
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+		}
+
+		return nil
 	})
+	return paths, err
 }
 
 func (d *DB) GetSalt() ([]byte, error) {
 	var res []byte
-	err := d.View(func(tx *bolt.Tx) error {
+	err := d.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(keysBucket)
 		v := b.Get([]byte("salt"))
 		if v == nil {
@@ -500,18 +1062,90 @@ func (d *DB) GetSalt() ([]byte, error) {
 }
 
 func (d *DB) PutSalt(salt []byte) error {
-	return d.Update(func(tx *bolt.Tx) error {
+	return d.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(keysBucket)
 		return b.Put([]byte("salt"), salt)
 	})
 }
 
+// IsEncrypted returns true if file content is encrypted, which is the case
+// once a master key has been stored.
+func (d *DB) IsEncrypted() (bool, error) {
+	key, err := d.GetMasterKey()
+	return key != nil, err
+}
+
+// GetMasterKey returns the wrapped master key, or nil if there isn't one.
+func (d *DB) GetMasterKey() ([]byte, error) {
+	var key []byte
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(keysBucket).Get(masterKeyKey); v != nil {
+			key = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return key, err
+}
+
+// PutMasterKey stores the wrapped master key.
+func (d *DB) PutMasterKey(key []byte) error {
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Put(masterKeyKey, key)
+	})
+}
+
+// ReplaceMasterKey stores the master key wrapped with a different key, along
+// with the salt that key was derived with. Both are replaced together so the
+// master key can't be lost part way through changing the passphrase.
+func (d *DB) ReplaceMasterKey(salt, key []byte) error {
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+		if b.Get(masterKeyKey) == nil {
+			return errors.New("there's no master key to replace")
+		}
+		if err := b.Put([]byte("salt"), salt); err != nil {
+			return err
+		}
+		return b.Put(masterKeyKey, key)
+	})
+}
+
+// GetDataKeys returns every wrapped data key, keyed by generation.
+func (d *DB) GetDataKeys() (map[uint32][]byte, error) {
+	keys := make(map[uint32][]byte)
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket).Bucket(dataKeysBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			keys[binary.BigEndian.Uint32(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// PutDataKey stores the wrapped data key with the given generation.
+func (d *DB) PutDataKey(generation uint32, key []byte) error {
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(keysBucket).CreateBucketIfNotExists(dataKeysBucket)
+		if err != nil {
+			return err
+		}
+
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, generation)
+		return b.Put(k, key)
+	})
+}
+
 func (d *DB) FilesystemStats() (files uint64, usedBytes uint64, err error) {
 	// Scan the entire database working out the space usage.
 	err = d.View(func(tx *bolt.Tx) error {
 		c := tx.Bucket(pathsBucket).Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			attributes, err := readAttributes(bytes.NewReader(v))
+			attributes, err := d.codec.readAttributes(v)
 			if err != nil {
 				return err
 			}
@@ -527,39 +1161,208 @@ func (d *DB) FilesystemStats() (files uint64, usedBytes uint64, err error) {
 	return files, usedBytes, err
 }
 
-var EmptyId = string(bytes.Repeat([]byte{0x00}, 33))
+// TrashEntry describes a file that has been moved to the trash.
+type TrashEntry struct {
+	// Name is the name of the file within TrashDir.
+	Name string
+
+	// Path is where the file was before it was deleted.
+	Path string
+
+	// DeletedAt is when the file was moved to the trash.
+	DeletedAt time.Time
+}
+
+// TrashPath returns the path of the trash entry with the given name.
+func TrashPath(name string) string {
+	return TrashDir + "/" + name
+}
+
+// The key and value of a trash entry are encrypted along with other metadata.
+func (c *codec) serialiseTrashEntry(entry TrashEntry) ([]byte, []byte,
+	error) {
+	v, err := serialiseTrashEntry(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err = c.seal(v)
+	return c.serialisePath(entry.Name), v, err
+}
+
+func (c *codec) readTrashEntry(k []byte, v []byte) (TrashEntry, error) {
+	name, err := c.readPath(k)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	v, err = c.open(v)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	return readTrashEntry([]byte(name), v)
+}
+
+func serialiseTrashEntry(entry TrashEntry) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	path := []byte(entry.Path)
+	if err := binary.Write(buf, binary.LittleEndian, uint32(len(path))); err != nil {
+		return nil, err
+	}
+	if _, err := buf.Write(path); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, entry.DeletedAt.UnixNano()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readTrashEntry(name []byte, v []byte) (TrashEntry, error) {
+	entry := TrashEntry{Name: string(name)}
+	r := bytes.NewReader(v)
 
-// RemoveBadFiles goes through the database looking for files that have not been
-// created properly and removing them.
-func (d *DB) RemoveBadFiles() error {
-	var badFiles []string
+	var pathlen uint32
+	if err := binary.Read(r, binary.LittleEndian, &pathlen); err != nil {
+		return entry, err
+	}
+	path := make([]byte, pathlen)
+	if _, err := io.ReadFull(r, path); err != nil {
+		return entry, err
+	}
+	entry.Path = string(path)
 
-	// Scan the entire database looking for hanging files.
+	var deletedAt int64
+	if err := binary.Read(r, binary.LittleEndian, &deletedAt); err != nil {
+		return entry, err
+	}
+	entry.DeletedAt = time.Unix(0, deletedAt)
+
+	return entry, nil
+}
+
+// MoveToTrash moves the node at path into TrashDir with the given name, and
+// records where it came from so that it can be restored.
+func (d *DB) MoveToTrash(path string, name string, deletedAt time.Time) error {
+	log.Printf("MoveToTrash %s -> %s", path, name)
+	return d.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pathsBucket)
+
+		k := d.codec.serialisePath(path)
+		v := b.Get(k)
+		if v == nil {
+			return DoesNotExist
+		}
+
+		trashKey := d.codec.serialisePath(TrashPath(name))
+		if b.Get(trashKey) != nil {
+			return AlreadyExists
+		}
+
+		if err := b.Put(trashKey, v); err != nil {
+			return err
+		}
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+
+		entryKey, entry, err := d.codec.serialiseTrashEntry(TrashEntry{
+			Name:      name,
+			Path:      path,
+			DeletedAt: deletedAt,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(trashBucket).Put(entryKey, entry)
+	})
+}
+
+// ListTrash returns all of the entries in the trash.
+func (d *DB) ListTrash() ([]TrashEntry, error) {
+	var entries []TrashEntry
 	err := d.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(pathsBucket).Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			attributes, err := readAttributes(bytes.NewReader(v))
+		return tx.Bucket(trashBucket).ForEach(func(k, v []byte) error {
+			entry, err := d.codec.readTrashEntry(k, v)
 			if err != nil {
 				return err
 			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
 
-			if attributes.IsRegularFile && attributes.Id == EmptyId {
-				badFiles = append(badFiles, string(k))
-			}
+// GetTrashEntry returns the trash entry with the given name.
+func (d *DB) GetTrashEntry(name string) (TrashEntry, error) {
+	var entry TrashEntry
+	err := d.View(func(tx *bolt.Tx) error {
+		k := d.codec.serialisePath(name)
+		v := tx.Bucket(trashBucket).Get(k)
+		if v == nil {
+			return DoesNotExist
 		}
-		return nil
-	})
-	if err != nil {
+		var err error
+		entry, err = d.codec.readTrashEntry(k, v)
 		return err
-	}
+	})
+	return entry, err
+}
 
-	for _, file := range badFiles {
-		log.Printf("File %s is invalid, will remove fs entry", file)
-		_, err := d.GetAndDeleteAttributes(file)
+// RestoreFromTrash moves the trash entry with the given name back into the
+// filesystem at path.
+func (d *DB) RestoreFromTrash(name string, path string) error {
+	log.Printf("RestoreFromTrash %s -> %s", name, path)
+	return d.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pathsBucket)
+
+		trashKey := d.codec.serialisePath(TrashPath(name))
+		v := b.Get(trashKey)
+		if v == nil {
+			return DoesNotExist
+		}
+
+		k := d.codec.serialisePath(path)
+		if b.Get(k) != nil {
+			return AlreadyExists
+		}
+
+		if err := b.Put(k, v); err != nil {
+			return err
+		}
+		if err := b.Delete(trashKey); err != nil {
+			return err
+		}
+		return tx.Bucket(trashBucket).Delete(d.codec.serialisePath(name))
+	})
+}
+
+// RemoveFromTrash permanently removes the trash entry with the given name and
+// returns the attributes of the file it held.
+func (d *DB) RemoveFromTrash(name string) (Attributes, error) {
+	log.Printf("RemoveFromTrash %s", name)
+	var attributes Attributes
+	err := d.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pathsBucket)
+
+		trashKey := d.codec.serialisePath(TrashPath(name))
+		v := b.Get(trashKey)
+		if v == nil {
+			return DoesNotExist
+		}
+
+		var err error
+		attributes, err = d.codec.readAttributes(v)
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		if err := updateBlobRefs(tx, &attributes, nil); err != nil {
+			return err
+		}
+		if err := b.Delete(trashKey); err != nil {
+			return err
+		}
+		return tx.Bucket(trashBucket).Delete(d.codec.serialisePath(name))
+	})
+	return attributes, err
 }
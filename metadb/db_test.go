@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestAttributesDoesNotExist(t *testing.T) {
@@ -165,6 +166,87 @@ func TestListSubDirectory(t *testing.T) {
 	}
 }
 
+// TestListSiblingSharingPrefix ensures that listing a directory doesn't include
+// the children of a sibling whose name starts with the directory's name.
+func TestListSiblingSharingPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestListSiblingSharingPrefix")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	directory := Attributes{Mode: 0755}
+	file := Attributes{IsRegularFile: true, Mode: 0644}
+	for path, attributes := range map[string]Attributes{
+		"dir":     directory,
+		"dir/a":   file,
+		"dirx":    file,
+		"dir-b":   directory,
+		"dir-b/c": file,
+	} {
+		if err := db.SetAttributes(path, attributes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := db.List("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != "a" {
+		t.Fatalf("Expecting only a to be listed, got %v", entries)
+	}
+}
+
+// TestRenameSiblingSharingPrefix ensures that renaming a file or directory
+// doesn't also rename siblings whose names start with its name.
+func TestRenameSiblingSharingPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRenameSiblingSharingPrefix")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	directory := Attributes{Mode: 0755}
+	file := Attributes{IsRegularFile: true, Mode: 0644}
+	for path, attributes := range map[string]Attributes{
+		"a":     directory,
+		"a/b":   file,
+		"ab":    file,
+		"a-c":   directory,
+		"a-c/d": file,
+	} {
+		if err := db.SetAttributes(path, attributes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Rename("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"c", "c/b", "ab", "a-c", "a-c/d"} {
+		if _, err := db.GetAttributes(path); err != nil {
+			t.Errorf("Expecting %s to exist, got %v", path, err)
+		}
+	}
+	for _, path := range []string{"a", "a/b", "cb", "c-c", "c-c/d"} {
+		if _, err := db.GetAttributes(path); err != DoesNotExist {
+			t.Errorf("Expecting %s not to exist, got %v", path, err)
+		}
+	}
+}
+
 // TestListDoesntExist ensures calling List on a directory that doesn't exist
 // returns the correct error code.
 func TestListDoesntExist(t *testing.T) {
@@ -247,3 +329,1046 @@ func TestPutFile(t *testing.T) {
 		t.Fatal("file contents do not match")
 	}
 }
+
+// TestSetAttributesAssignsInode ensures that new nodes are given distinct inode
+// numbers and that renaming a node keeps its inode number.
+func TestSetAttributesAssignsInode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSetAttributesAssignsInode")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	attributes := Attributes{
+		Id:            "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		IsRegularFile: true,
+		Mode:          0644,
+	}
+
+	if err := db.SetAttributes("a", attributes); err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+	if err := db.SetAttributes("b", attributes); err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+
+	a, err := db.GetAttributes("a")
+	if err != nil {
+		t.Fatal("Failed to get attributes")
+	}
+	b, err := db.GetAttributes("b")
+	if err != nil {
+		t.Fatal("Failed to get attributes")
+	}
+
+	if a.Inode == 0 || b.Inode == 0 {
+		t.Fatal("Expecting inode to be assigned")
+	}
+	if a.Inode == b.Inode {
+		t.Fatal("Expecting distinct inodes")
+	}
+
+	if err := db.Rename("a", "c"); err != nil {
+		t.Fatal("Failed to rename")
+	}
+
+	c, err := db.GetAttributes("c")
+	if err != nil {
+		t.Fatal("Failed to get attributes")
+	}
+	if c.Inode != a.Inode {
+		t.Fatal("Expecting inode to be preserved by rename")
+	}
+}
+
+// TestReadAttributesWithoutInode ensures that attributes serialised before
+// inode numbers existed can still be read.
+func TestReadAttributesWithoutInode(t *testing.T) {
+	attributes := Attributes{
+		Id:            "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		Size:          1234,
+		IsRegularFile: true,
+		Mode:          0644,
+		Inode:         7,
+	}
+
+	v, err := serialiseAttributes(attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Strip the trailing inode number, sync state, empty checksums and mtime.
+	actual, err := readAttributes(bytes.NewReader(v[:len(v)-25]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual.Size != attributes.Size {
+		t.Fatal("Size doesn't match")
+	}
+	if actual.Inode != 0 {
+		t.Fatal("Expecting no inode")
+	}
+}
+
+// TestChecksumsRoundTrip ensures that checksums and the mtime are serialised
+// along with the other attributes.
+func TestChecksumsRoundTrip(t *testing.T) {
+	attributes := Attributes{
+		Id:            "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		Size:          1234,
+		IsRegularFile: true,
+		Mode:          0644,
+		Inode:         7,
+		State:         Synced,
+		Md5:           []byte{0xd4, 0x1d, 0x8c, 0xd9},
+		Sha256:        []byte{0xe3, 0xb0, 0xc4, 0x42, 0x98},
+		Mtime:         time.Unix(1546300800, 0),
+	}
+
+	v, err := serialiseAttributes(attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := readAttributes(bytes.NewReader(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(actual.Md5, attributes.Md5) {
+		t.Fatalf("Expecting md5 %x, got %x", attributes.Md5, actual.Md5)
+	}
+	if !bytes.Equal(actual.Sha256, attributes.Sha256) {
+		t.Fatalf("Expecting sha256 %x, got %x", attributes.Sha256,
+			actual.Sha256)
+	}
+	if !actual.Mtime.Equal(attributes.Mtime) {
+		t.Fatalf("Expecting mtime %s, got %s", attributes.Mtime, actual.Mtime)
+	}
+}
+
+// TestReadLegacyEmptyId ensures that attributes written before sync states
+// existed are given one based on their id.
+func TestReadLegacyEmptyId(t *testing.T) {
+	for _, test := range []struct {
+		attributes Attributes
+		id         string
+		state      SyncState
+	}{
+		{
+			attributes: Attributes{Id: legacyEmptyId, IsRegularFile: true},
+			id:         "",
+			state:      LocalOnly,
+		},
+		{
+			attributes: Attributes{
+				Id:            "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+				IsRegularFile: true,
+			},
+			id:    "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+			state: Synced,
+		},
+	} {
+		v, err := serialiseAttributes(test.attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Strip the trailing sync state, empty checksums and mtime.
+		actual, err := readAttributes(bytes.NewReader(v[:len(v)-17]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Id != test.id {
+			t.Fatalf("Expecting id %q, got %q", test.id, actual.Id)
+		}
+		if actual.State != test.state {
+			t.Fatalf("Expecting state %s, got %s", test.state, actual.State)
+		}
+	}
+}
+
+// TestRecoverInterruptedUploads ensures that only files that were being
+// uploaded are marked as failed.
+func TestRecoverInterruptedUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRecoverInterruptedUploads")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for path, state := range map[string]SyncState{
+		"a": Uploading, "b": Synced, "c": LocalOnly} {
+		err := db.SetAttributes(path, Attributes{
+			IsRegularFile: true,
+			Mode:          0644,
+			State:         state,
+		})
+		if err != nil {
+			t.Fatal("Failed to set attributes")
+		}
+	}
+
+	paths, err := db.RecoverInterruptedUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "a" {
+		t.Fatalf("Expecting only a to be recovered, got %v", paths)
+	}
+
+	for path, state := range map[string]SyncState{
+		"a": UploadFailed, "b": Synced, "c": LocalOnly} {
+		attributes, err := db.GetAttributes(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attributes.State != state {
+			t.Fatalf("Expecting %s to be %s, got %s", path, state,
+				attributes.State)
+		}
+	}
+
+	if err := db.SetSynced("a", "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		1234, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	attributes, err := db.GetAttributes("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.State != Synced || attributes.Size != 1234 {
+		t.Fatal("Expecting a to be synced")
+	}
+}
+
+// TestMoveToTrashAndRestore ensures that a file moved to the trash can be
+// listed and then restored to its original location.
+func TestMoveToTrashAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMoveToTrashAndRestore")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	attributes := Attributes{
+		Id:            "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		Size:          1234,
+		IsRegularFile: true,
+		Mode:          0644,
+	}
+
+	err = db.SetAttributes("a", attributes)
+	if err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+
+	deletedAt := time.Unix(1500000000, 0)
+	err = db.MoveToTrash("a", "1-a", deletedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetAttributes("a")
+	if err != DoesNotExist {
+		t.Fatal("Expecting file to be removed")
+	}
+
+	trashed, err := db.GetAttributes(TrashPath("1-a"))
+	if err != nil {
+		t.Fatal("Expecting file to be in the trash")
+	}
+	if trashed.Id != attributes.Id {
+		t.Fatal("Id doesn't match")
+	}
+
+	entries, err := db.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal("Expecting one trash entry")
+	}
+	if entries[0].Path != "a" || !entries[0].DeletedAt.Equal(deletedAt) {
+		t.Fatal("Trash entry doesn't match")
+	}
+
+	err = db.RestoreFromTrash("1-a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetAttributes("a")
+	if err != nil {
+		t.Fatal("Expecting file to be restored")
+	}
+
+	entries, err = db.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatal("Expecting trash to be empty")
+	}
+}
+
+// TestRemoveFromTrash ensures that removing an entry from the trash deletes it
+// permanently.
+func TestRemoveFromTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRemoveFromTrash")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	attributes := Attributes{
+		Id:            "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		IsRegularFile: true,
+		Mode:          0644,
+	}
+
+	err = db.SetAttributes("a", attributes)
+	if err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+
+	err = db.MoveToTrash("a", "1-a", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := db.RemoveFromTrash("1-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed.Id != attributes.Id {
+		t.Fatal("Id doesn't match")
+	}
+
+	_, err = db.GetAttributes(TrashPath("1-a"))
+	if err != DoesNotExist {
+		t.Fatal("Expecting file to be removed")
+	}
+
+	_, err = db.GetTrashEntry("1-a")
+	if err != DoesNotExist {
+		t.Fatal("Expecting trash entry to be removed")
+	}
+}
+
+// TestTrashDirClash ensures that a node created by the user at TrashDir isn't
+// taken over as the trash.
+func TestTrashDirClash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTrashDirClash")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Reopening the database keeps the trash it created.
+	db.Close()
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.GetAndDeleteAttributes(TrashDir); err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetAttributes(TrashDir, Attributes{
+		Id:   "user-directory",
+		Mode: 0755,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := Open(dir); err == nil {
+		t.Fatal("Expecting a user directory at TrashDir to be refused")
+	}
+}
+
+// TestSnapshot ensures that a snapshot keeps a copy of the filesystem and that
+// deleting it releases the remote files that only it referenced.
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSnapshot")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	attributes := Attributes{
+		Id:            "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		Size:          1234,
+		IsRegularFile: true,
+		Mode:          0644,
+	}
+	attributes2 := Attributes{
+		Id:            "1vBQErMm1EY6M1Ur2C8XfrGapB6nUq1LO",
+		Size:          1234,
+		IsRegularFile: true,
+		Mode:          0644,
+	}
+
+	if err := db.SetAttributes("a", attributes); err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+	if err := db.SetAttributes("b", attributes2); err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+
+	err = db.CreateSnapshot("snap", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.CreateSnapshot("snap", time.Now())
+	if err != AlreadyExists {
+		t.Fatal("Expecting snapshot to already exist")
+	}
+
+	snapshotted, err := db.IsSnapshotted(attributes.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshotted {
+		t.Fatal("Expecting file to be referenced by snapshot")
+	}
+
+	// Replace the content of a so that only the snapshot references the
+	// original.
+	if err := db.SetId("a", "1Z9m0xkdLqVx4fO2TUy3oa8bpf2wn0Zq7"); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := db.GetSnapshotAttributes("snap", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.Id != attributes.Id {
+		t.Fatal("Expecting snapshot to keep original id")
+	}
+
+	entries, err := db.ListSnapshot("snap", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatal("Expecting two files in snapshot")
+	}
+
+	released, err := db.DeleteSnapshot("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0] != attributes.Id {
+		t.Fatalf("Expecting only the replaced file to be released, got %v",
+			released)
+	}
+
+	snapshotted, err = db.IsSnapshotted(attributes.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshotted {
+		t.Fatal("Expecting file to no longer be referenced")
+	}
+
+	snapshots, err := db.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 0 {
+		t.Fatal("Expecting no snapshots")
+	}
+}
+
+// TestWalk ensures that every node is visited with its full path.
+func TestWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWalk")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	attributes := Attributes{
+		Id:            "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		IsRegularFile: true,
+		Mode:          0644,
+	}
+
+	if err := db.SetAttributes("a", Attributes{Mode: 0755}); err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+	if err := db.SetAttributes("a/b", attributes); err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+
+	visited := make(map[string]bool)
+	err = db.Walk(func(path string, attributes Attributes) error {
+		visited[path] = attributes.IsRegularFile
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isFile, ok := visited["a/b"]; !ok || !isFile {
+		t.Fatal("Expecting a/b to be visited")
+	}
+	if isFile, ok := visited["a"]; !ok || isFile {
+		t.Fatal("Expecting a to be visited")
+	}
+}
+
+// TestReferencedIds ensures that files in the filesystem, the trash and
+// snapshots are all considered referenced.
+func TestReferencedIds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReferencedIds")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	live := "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo"
+	trashed := "1vBQErMm1EY6M1Ur2C8XfrGapB6nUq1LO"
+	snapshotted := "1Z9m0xkdLqVx4fO2TUy3oa8bpf2wn0Zq7"
+
+	for path, id := range map[string]string{
+		"a": live, "b": trashed, "c": snapshotted, "d": ""} {
+		err := db.SetAttributes(path, Attributes{
+			Id:            id,
+			IsRegularFile: true,
+			Mode:          0644,
+		})
+		if err != nil {
+			t.Fatal("Failed to set attributes")
+		}
+	}
+
+	if err := db.MoveToTrash("b", "1-b", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSnapshot("snap", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetAndDeleteAttributes("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := db.ReferencedIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ids[live] || !ids[trashed] || !ids[snapshotted] {
+		t.Fatalf("Expecting all files to be referenced, got %v", ids)
+	}
+	if ids[""] {
+		t.Fatal("Expecting files that were never uploaded to be ignored")
+	}
+}
+
+// TestFilesystemStats ensures that only regular files are counted.
+func TestFilesystemStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFilesystemStats")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := db.SetAttributes("dir", Attributes{Mode: 0755}); err != nil {
+		t.Fatal("Failed to set attributes")
+	}
+	for path, size := range map[string]uint64{"dir/a": 1000, "dir/b": 234} {
+		err := db.SetAttributes(path, Attributes{
+			Size:          size,
+			IsRegularFile: true,
+			Mode:          0644,
+		})
+		if err != nil {
+			t.Fatal("Failed to set attributes")
+		}
+	}
+
+	files, usedBytes, err := db.FilesystemStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 {
+		t.Fatalf("Expecting 2 files, got %d", files)
+	}
+	if usedBytes != 1234 {
+		t.Fatalf("Expecting 1234 bytes, got %d", usedBytes)
+	}
+}
+
+// TestListUnverified ensures that files are listed least recently verified
+// first and that recently verified files are skipped.
+func TestListUnverified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestListUnverified")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for path, id := range map[string]string{
+		"a": "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo",
+		"b": "1vBQErMm1EY6M1Ur2C8XfrGapB6nUq1LO",
+		"c": "1Z9m0xkdLqVx4fO2TUy3oa8bpf2wn0Zq7",
+	} {
+		err := db.SetAttributes(path, Attributes{
+			Id:            id,
+			IsRegularFile: true,
+			Mode:          0644,
+			State:         Synced,
+			Md5:           []byte{0xd4, 0x1d, 0x8c, 0xd9},
+		})
+		if err != nil {
+			t.Fatal("Failed to set attributes")
+		}
+	}
+
+	now := time.Now()
+	if err := db.SetLastVerified("1vBQErMm1EY6M1Ur2C8XfrGapB6nUq1LO",
+		now.Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetLastVerified("1Z9m0xkdLqVx4fO2TUy3oa8bpf2wn0Zq7",
+		now); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.ListUnverified(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("Expecting 2 entries, got %d", len(entries))
+	}
+	if entries[0].Path != "a" || !entries[0].LastVerified.IsZero() {
+		t.Fatal("Expecting the unverified file first")
+	}
+	if entries[1].Path != "b" {
+		t.Fatal("Expecting the least recently verified file second")
+	}
+}
+
+// TestBlobRefs ensures that remote files are reference counted across the
+// nodes that share them and are dropped from the content index once they're
+// no longer referenced.
+func TestBlobRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBlobRefs")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id := "1kgcI9l0qzeB8LtmUd0RxTO_hjQYbdjoo"
+	sha256 := []byte{0xe3, 0xb0, 0xc4, 0x42, 0x98}
+
+	for _, path := range []string{"a", "b"} {
+		err := db.SetAttributes(path, Attributes{
+			IsRegularFile: true,
+			Mode:          0644,
+		})
+		if err != nil {
+			t.Fatal("Failed to set attributes")
+		}
+		if err := db.SetSynced(path, id, 1234, nil, sha256); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if refs, err := db.BlobRefs(id); err != nil || refs != 2 {
+		t.Fatalf("Expecting 2 references, got %d", refs)
+	}
+
+	if err := db.IndexBlob(id, sha256); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok, err := db.FindBlob(sha256); err != nil || !ok ||
+		found != id {
+		t.Fatal("Expecting to find the indexed file")
+	}
+
+	if _, err := db.GetAndDeleteAttributes("a"); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := db.BlobRefs(id); err != nil || refs != 1 {
+		t.Fatalf("Expecting 1 reference, got %d", refs)
+	}
+
+	// Moving to the trash keeps the reference, removing from it drops it.
+	if err := db.MoveToTrash("b", "1-b", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if referenced, err := db.IsReferenced(id); err != nil || !referenced {
+		t.Fatal("Expecting the trash to reference the file")
+	}
+	if _, err := db.RemoveFromTrash("1-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if referenced, err := db.IsReferenced(id); err != nil || referenced {
+		t.Fatal("Expecting the file to be unreferenced")
+	}
+	if _, ok, err := db.FindBlob(sha256); err != nil || ok {
+		t.Fatal("Expecting the file to be removed from the index")
+	}
+}
+
+// TestKeys ensures that the master key and data keys can be stored.
+func TestKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestKeys")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if encrypted, err := db.IsEncrypted(); err != nil || encrypted {
+		t.Fatal("Expecting a new database not to be encrypted")
+	}
+
+	if err := db.PutMasterKey([]byte("master")); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted, err := db.IsEncrypted(); err != nil || !encrypted {
+		t.Fatal("Expecting the database to be encrypted")
+	}
+
+	for generation, key := range map[uint32]string{1: "one", 2: "two"} {
+		if err := db.PutDataKey(generation, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := db.GetDataKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys[1]) != "one" || string(keys[2]) != "two" {
+		t.Fatalf("Unexpected data keys %v", keys)
+	}
+}
+
+func TestEncryptedMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEncryptedMetadata")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for path, attributes := range map[string]Attributes{
+		"secret-dir":                 {Mode: 0755},
+		"secret-dir/secret-file":     {IsRegularFile: true, Id: "1", Size: 10},
+		"secret-dir/secret-note":     {IsRegularFile: true, HasContent: true},
+		"secret-dir/secret-trashed":  {IsRegularFile: true, Id: "2"},
+		"secret-dir/secret-subdir":   {Mode: 0755},
+		"secret-dir/secret-subdir/a": {IsRegularFile: true, Id: "3"},
+	} {
+		if err := db.SetAttributes(path, attributes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutFile("secret-dir/secret-note", []byte("secret content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MoveToTrash("secret-dir/secret-trashed", "secret-entry",
+		time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetAttributes("secret-dir/secret-file", Attributes{
+		IsRegularFile: true, Id: "1", Size: 10, State: Synced,
+		Md5: []byte("md5")}); err != nil {
+		t.Fatal(err)
+	}
+	sha256 := []byte("secret-sha256-of-the-file-content")
+	if err := db.IndexBlob("1", sha256); err != nil {
+		t.Fatal(err)
+	}
+	verified := time.Now()
+	if err := db.SetLastVerified("1", verified); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSnapshot("secret-snapshot", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	key := bytes.Repeat([]byte{1}, 32)
+	if err := db.EncryptMetadata(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(dir + "/" + dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Fatal("Expecting no names, checksums or content to be stored " +
+			"unencrypted")
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.GetAttributes("secret-dir"); err != Locked {
+		t.Fatalf("Expecting the database to be locked, got %v", err)
+	}
+	if err := db.UnlockMetadata(bytes.Repeat([]byte{2}, 32)); err != WrongKey {
+		t.Fatalf("Expecting the wrong key to be rejected, got %v", err)
+	}
+	if err := db.UnlockMetadata(key); err != nil {
+		t.Fatal(err)
+	}
+
+	attributes, err := db.GetAttributes("secret-dir/secret-file")
+	if err != nil || attributes.Id != "1" || attributes.Size != 10 {
+		t.Fatalf("Unexpected attributes %v: %v", attributes, err)
+	}
+
+	content, err := db.GetFile("secret-dir/secret-note")
+	if err != nil || string(content) != "secret content" {
+		t.Fatalf("Unexpected content %q: %v", content, err)
+	}
+
+	entries, err := db.List("secret-dir")
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expecting 3 entries, got %v: %v", entries, err)
+	}
+
+	trash, err := db.ListTrash()
+	if err != nil || len(trash) != 1 || trash[0].Name != "secret-entry" ||
+		trash[0].Path != "secret-dir/secret-trashed" {
+		t.Fatalf("Unexpected trash %v: %v", trash, err)
+	}
+
+	if id, ok, err := db.FindBlob(sha256); err != nil || !ok || id != "1" {
+		t.Fatalf("Expecting indexed content to be found, got %q: %v", id, err)
+	}
+
+	unverified, err := db.ListUnverified(verified)
+	if err != nil || len(unverified) != 0 {
+		t.Fatalf("Expecting verified file to be remembered, got %v: %v",
+			unverified, err)
+	}
+
+	snapshots, err := db.ListSnapshots()
+	if err != nil || len(snapshots) != 1 ||
+		snapshots[0].Name != "secret-snapshot" {
+		t.Fatalf("Unexpected snapshots %v: %v", snapshots, err)
+	}
+	attributes, err = db.GetSnapshotAttributes("secret-snapshot",
+		"secret-dir/secret-file")
+	if err != nil || attributes.Id != "1" {
+		t.Fatalf("Unexpected snapshot attributes %v: %v", attributes, err)
+	}
+	if err := db.CreateSnapshot("secret-snapshot", time.Now()); err != AlreadyExists {
+		t.Fatalf("Expecting snapshot to already exist, got %v", err)
+	}
+	if _, err := db.DeleteSnapshot("secret-snapshot"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renamed children must be found under their new parent.
+	if err := db.Rename("secret-dir/secret-subdir", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetAttributes("moved/a"); err != nil {
+		t.Fatalf("Expecting renamed child to exist: %v", err)
+	}
+	if _, err := db.GetAttributes("secret-dir/secret-subdir/a"); err != DoesNotExist {
+		t.Fatalf("Expecting old child to be gone, got %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRotation")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for path, attributes := range map[string]Attributes{
+		"a":    {IsRegularFile: true, Id: "1", Md5: []byte("old")},
+		"b":    {IsRegularFile: true, Id: "2"},
+		"note": {IsRegularFile: true, HasContent: true},
+	} {
+		if err := db.SetAttributes(path, attributes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CreateSnapshot("snap", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := db.Rotation(); err != nil || ok {
+		t.Fatal("Expecting no rotation to be in progress")
+	}
+
+	if err := db.StartRotation(2); err != nil {
+		t.Fatal(err)
+	}
+	if generation, ok, err := db.Rotation(); err != nil || !ok ||
+		generation != 2 {
+		t.Fatalf("Expecting rotation to generation 2, got %d", generation)
+	}
+
+	if err := db.SetBlobMd5("1", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetRotated("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, get := range []func() (Attributes, error){
+		func() (Attributes, error) { return db.GetAttributes("a") },
+		func() (Attributes, error) { return db.GetSnapshotAttributes("snap", "a") },
+	} {
+		attributes, err := get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(attributes.Md5) != "new" {
+			t.Fatalf("Expecting md5 to be updated, got %q", attributes.Md5)
+		}
+	}
+
+	unrotated, err := db.ListUnrotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unrotated) != 1 || unrotated[0] != "2" {
+		t.Fatalf("Expecting only 2 to be unrotated, got %v", unrotated)
+	}
+
+	if err := db.FinishRotation(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := db.Rotation(); err != nil || ok {
+		t.Fatal("Expecting rotation to be finished")
+	}
+
+	if err := db.PutMasterKey([]byte("master")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReplaceMasterKey([]byte("salt"), []byte("rewrapped")); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := db.GetMasterKey(); err != nil || string(key) != "rewrapped" {
+		t.Fatalf("Expecting master key to be replaced, got %q", key)
+	}
+}
+
+// TestOwnerId ensures that a database is given an owner id that's kept when
+// it's opened again.
+func TestOwnerId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestOwnerId")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	id, err := db.OwnerId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("Expecting an owner id")
+	}
+	db.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if reopened, err := db.OwnerId(); err != nil || reopened != id {
+		t.Fatalf("Expecting owner id %s, got %s (%v)", id, reopened, err)
+	}
+}
@@ -0,0 +1,159 @@
+package metadb
+
+import (
+	"encoding/binary"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"sort"
+)
+
+var (
+	// rotationKey stores the generation of the data key that remote files are
+	// being re-encrypted with, within keysBucket. It's only present while a
+	// rotation is in progress.
+	rotationKey = []byte("rotation")
+
+	// rotatedBucket holds the ids of the remote files that have been
+	// re-encrypted during the current rotation.
+	rotatedBucket = []byte("rotated-bucket")
+)
+
+// StartRotation records that every remote file is to be re-encrypted with the
+// data key of the given generation. Any previous rotation is abandoned.
+func (d *DB) StartRotation(generation uint32) error {
+	log.Printf("StartRotation %d", generation)
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(rotatedBucket) != nil {
+			if err := tx.DeleteBucket(rotatedBucket); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket(rotatedBucket); err != nil {
+			return err
+		}
+
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, generation)
+		return tx.Bucket(keysBucket).Put(rotationKey, v)
+	})
+}
+
+// Rotation returns the generation of the data key that remote files are being
+// re-encrypted with, or false if there's no rotation in progress.
+func (d *DB) Rotation() (uint32, bool, error) {
+	var generation uint32
+	var ok bool
+	err := d.DB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(keysBucket).Get(rotationKey); v != nil {
+			generation = binary.BigEndian.Uint32(v)
+			ok = true
+		}
+		return nil
+	})
+	return generation, ok, err
+}
+
+// ListUnrotated returns the ids of the referenced remote files that haven't
+// been re-encrypted during the current rotation.
+func (d *DB) ListUnrotated() ([]string, error) {
+	var unrotated []string
+	err := d.View(func(tx *bolt.Tx) error {
+		ids, err := d.referencedIds(tx)
+		if err != nil {
+			return err
+		}
+
+		rotated := tx.Bucket(rotatedBucket)
+		for id := range ids {
+			if rotated == nil || rotated.Get([]byte(id)) == nil {
+				unrotated = append(unrotated, id)
+			}
+		}
+		return nil
+	})
+
+	sort.Strings(unrotated)
+	return unrotated, err
+}
+
+// SetRotated records that the remote file with the given id has been
+// re-encrypted during the current rotation.
+func (d *DB) SetRotated(id string) error {
+	return d.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(rotatedBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), []byte{})
+	})
+}
+
+// FinishRotation forgets about the current rotation once every remote file has
+// been re-encrypted.
+func (d *DB) FinishRotation() error {
+	log.Printf("FinishRotation")
+	return d.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(rotatedBucket) != nil {
+			if err := tx.DeleteBucket(rotatedBucket); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(keysBucket).Delete(rotationKey)
+	})
+}
+
+// SetBlobMd5 records a new md5 for the remote file with the given id in every
+// node that references it, including those in the trash and snapshots. This is
+// needed when the remote file is rewritten without changing its content.
+func (d *DB) SetBlobMd5(id string, md5 []byte) error {
+	log.Printf("SetBlobMd5 %s: %x", id, md5)
+	return d.Update(func(tx *bolt.Tx) error {
+		buckets := []*bolt.Bucket{tx.Bucket(pathsBucket)}
+
+		snapshots := tx.Bucket(snapshotsBucket)
+		err := snapshots.ForEach(func(k, v []byte) error {
+			if snapshot := snapshots.Bucket(k); snapshot != nil {
+				buckets = append(buckets, snapshot.Bucket(pathsBucket))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, b := range buckets {
+			updated := make(map[string][]byte)
+
+			err := b.ForEach(func(k, v []byte) error {
+				attributes, err := d.codec.readAttributes(v)
+				if err != nil {
+					return err
+				}
+
+				if !attributes.HasRemoteCopy() || attributes.Id != id {
+					return nil
+				}
+
+				attributes.Md5 = md5
+				v, err = d.codec.serialiseAttributes(attributes)
+				if err != nil {
+					return err
+				}
+				updated[string(k)] = v
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			// Modifying the bucket while iterating over it is not permitted.
+			for k, v := range updated {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
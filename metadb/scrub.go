@@ -0,0 +1,110 @@
+package metadb
+
+import (
+	"encoding/binary"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"time"
+)
+
+// ScrubEntry describes a remote file that's due to be verified.
+type ScrubEntry struct {
+	Path       string
+	Attributes Attributes
+
+	// LastVerified is when the remote copy was last verified, or the zero time
+	// if it never has been.
+	LastVerified time.Time
+}
+
+// lastVerified returns when the remote file with the given id was last
+// verified.
+func (c *codec) lastVerified(tx *bolt.Tx, id string) time.Time {
+	v := tx.Bucket(scrubBucket).Get(c.serialiseId(id))
+	if v == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(v)))
+}
+
+// SetLastVerified records that the remote file with the given id was verified
+// at the given time.
+func (d *DB) SetLastVerified(id string, verified time.Time) error {
+	return d.Update(func(tx *bolt.Tx) error {
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, uint64(verified.UnixNano()))
+		return tx.Bucket(scrubBucket).Put(d.codec.serialiseId(id), v)
+	})
+}
+
+// ListUnverified returns the synced remote files that have checksums and
+// haven't been verified since before, least recently verified first. Entries
+// for files that no longer exist are removed.
+func (d *DB) ListUnverified(before time.Time) ([]ScrubEntry, error) {
+	var entries []ScrubEntry
+	err := d.Update(func(tx *bolt.Tx) error {
+		ids := make(map[string]bool)
+
+		err := tx.Bucket(pathsBucket).ForEach(func(k, v []byte) error {
+			attributes, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+
+			if !attributes.HasRemoteCopy() {
+				return nil
+			}
+			ids[string(d.codec.serialiseId(attributes.Id))] = true
+
+			if attributes.State != Synced || len(attributes.Md5) == 0 {
+				return nil
+			}
+
+			verified := d.codec.lastVerified(tx, attributes.Id)
+			if !verified.Before(before) {
+				return nil
+			}
+
+			path, err := d.codec.readPath(k)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, ScrubEntry{
+				Path:         path,
+				Attributes:   attributes,
+				LastVerified: verified,
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Forget about files that have been deleted.
+		var stale [][]byte
+		b := tx.Bucket(scrubBucket)
+		err = b.ForEach(func(k, v []byte) error {
+			if !ids[string(k)] {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastVerified.Before(entries[j].LastVerified)
+	})
+
+	return entries, err
+}
@@ -0,0 +1,322 @@
+package metadb
+
+import (
+	"encoding/binary"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+var (
+	// createdKey stores the time a snapshot was taken within its bucket.
+	createdKey = []byte("created")
+)
+
+// Snapshot describes a read-only copy of the filesystem.
+type Snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+// addSnapshotRef adjusts the number of snapshots that reference the given id by
+// delta and returns the new count.
+func addSnapshotRef(tx *bolt.Tx, id string, delta int) (uint32, error) {
+	b := tx.Bucket(snapshotRefsBucket)
+	k := []byte(id)
+
+	var count uint32
+	if v := b.Get(k); v != nil {
+		count = binary.LittleEndian.Uint32(v)
+	}
+
+	count = uint32(int(count) + delta)
+
+	if count == 0 {
+		return 0, b.Delete(k)
+	}
+
+	v := make([]byte, 4)
+	binary.LittleEndian.PutUint32(v, count)
+	return count, b.Put(k, v)
+}
+
+// CreateSnapshot copies the current filesystem, excluding the trash, into a new
+// snapshot with the given name.
+func (d *DB) CreateSnapshot(name string, created time.Time) error {
+	log.Printf("CreateSnapshot %s", name)
+	return d.Update(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(snapshotsBucket)
+		if snapshots.Bucket(d.codec.serialisePath(name)) != nil {
+			return AlreadyExists
+		}
+
+		snapshot, err := snapshots.CreateBucket(d.codec.serialisePath(name))
+		if err != nil {
+			return err
+		}
+
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, uint64(created.UnixNano()))
+		if err := snapshot.Put(createdKey, v); err != nil {
+			return err
+		}
+
+		paths, err := snapshot.CreateBucket(pathsBucket)
+		if err != nil {
+			return err
+		}
+		content, err := snapshot.CreateBucket(contentBucket)
+		if err != nil {
+			return err
+		}
+
+		trashPrefix := d.codec.serialisePath(TrashDir)
+
+		err = tx.Bucket(pathsBucket).ForEach(func(k, v []byte) error {
+			if isWithin(k, trashPrefix) {
+				return nil
+			}
+
+			attributes, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+
+			// Files that haven't been uploaded yet have no content to keep.
+			if attributes.IsRegularFile && !attributes.HasContent &&
+				attributes.Id == "" {
+				return nil
+			}
+
+			if attributes.HasRemoteCopy() {
+				if _, err := addSnapshotRef(tx, attributes.Id, 1); err != nil {
+					return err
+				}
+			}
+
+			return paths.Put(k, v)
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(contentBucket).ForEach(func(k, v []byte) error {
+			return content.Put(k, v)
+		})
+	})
+}
+
+// DeleteSnapshot removes the snapshot with the given name. It returns the ids
+// of the remote files that were only referenced by the snapshot and can now be
+// deleted.
+func (d *DB) DeleteSnapshot(name string) ([]string, error) {
+	log.Printf("DeleteSnapshot %s", name)
+	var released []string
+	err := d.Update(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(snapshotsBucket)
+		snapshot := snapshots.Bucket(d.codec.serialisePath(name))
+		if snapshot == nil {
+			return DoesNotExist
+		}
+
+		var unreferenced []string
+		err := snapshot.Bucket(pathsBucket).ForEach(func(k, v []byte) error {
+			attributes, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+
+			if !attributes.HasRemoteCopy() {
+				return nil
+			}
+
+			count, err := addSnapshotRef(tx, attributes.Id, -1)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				unreferenced = append(unreferenced, attributes.Id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := snapshots.DeleteBucket(
+			d.codec.serialisePath(name)); err != nil {
+			return err
+		}
+
+		if len(unreferenced) == 0 {
+			return nil
+		}
+
+		// Files that are still in the filesystem, or the trash, continue to
+		// use their remote copy.
+		live := make(map[string]bool)
+		err = tx.Bucket(pathsBucket).ForEach(func(k, v []byte) error {
+			attributes, err := d.codec.readAttributes(v)
+			if err != nil {
+				return err
+			}
+			live[attributes.Id] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range unreferenced {
+			if !live[id] {
+				released = append(released, id)
+			}
+		}
+
+		return nil
+	})
+
+	return released, err
+}
+
+// ListSnapshots returns all snapshots.
+func (d *DB) ListSnapshots() ([]Snapshot, error) {
+	var snapshots []Snapshot
+	err := d.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).ForEach(func(k, v []byte) error {
+			snapshot := tx.Bucket(snapshotsBucket).Bucket(k)
+			if snapshot == nil {
+				return nil
+			}
+
+			name, err := d.codec.readPath(k)
+			if err != nil {
+				return err
+			}
+
+			created := binary.LittleEndian.Uint64(snapshot.Get(createdKey))
+			snapshots = append(snapshots, Snapshot{
+				Name:    name,
+				Created: time.Unix(0, int64(created)),
+			})
+			return nil
+		})
+	})
+	return snapshots, err
+}
+
+// snapshotBucket returns the named bucket within the given snapshot.
+func (c *codec) snapshotBucket(tx *bolt.Tx, snapshot string, bucket []byte) (
+	*bolt.Bucket, error) {
+	b := tx.Bucket(snapshotsBucket).Bucket(c.serialisePath(snapshot))
+	if b == nil {
+		return nil, DoesNotExist
+	}
+	return b.Bucket(bucket), nil
+}
+
+// GetSnapshotAttributes returns the attributes of the node at path within the
+// given snapshot.
+func (d *DB) GetSnapshotAttributes(snapshot, path string) (Attributes, error) {
+	var attributes Attributes
+	err := d.View(func(tx *bolt.Tx) error {
+		b, err := d.codec.snapshotBucket(tx, snapshot, pathsBucket)
+		if err != nil {
+			return err
+		}
+
+		v := b.Get(d.codec.serialisePath(path))
+		if v == nil {
+			return DoesNotExist
+		}
+		attributes, err = d.codec.readAttributes(v)
+		return err
+	})
+	return attributes, err
+}
+
+// ListSnapshot returns the entries in the directory at path within the given
+// snapshot.
+func (d *DB) ListSnapshot(snapshot, path string) ([]Entry, error) {
+	var entries []Entry
+	err := d.View(func(tx *bolt.Tx) error {
+		b, err := d.codec.snapshotBucket(tx, snapshot, pathsBucket)
+		if err != nil {
+			return err
+		}
+
+		entries, err = d.codec.listBucket(b, path)
+		return err
+	})
+	return entries, err
+}
+
+// GetSnapshotFile returns the content stored in the database for the file at
+// path within the given snapshot.
+func (d *DB) GetSnapshotFile(snapshot, path string) ([]byte, error) {
+	var content []byte
+	err := d.View(func(tx *bolt.Tx) error {
+		b, err := d.codec.snapshotBucket(tx, snapshot, contentBucket)
+		if err != nil {
+			return err
+		}
+
+		v := b.Get(d.codec.serialisePath(path))
+		if v == nil {
+			content = []byte{}
+			return nil
+		}
+
+		v, err = d.codec.open(v)
+		content = make([]byte, len(v))
+		copy(content, v)
+		return err
+	})
+	return content, err
+}
+
+// IsSnapshotted returns true if any snapshot references the remote file with
+// the given id.
+func (d *DB) IsSnapshotted(id string) (bool, error) {
+	var snapshotted bool
+	err := d.View(func(tx *bolt.Tx) error {
+		snapshotted = tx.Bucket(snapshotRefsBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return snapshotted, err
+}
+
+// ReferencedIds returns the ids of every remote file that's referenced by the
+// filesystem, the trash or a snapshot.
+func (d *DB) ReferencedIds() (map[string]bool, error) {
+	var ids map[string]bool
+	err := d.View(func(tx *bolt.Tx) error {
+		var err error
+		ids, err = d.referencedIds(tx)
+		return err
+	})
+	return ids, err
+}
+
+func (d *DB) referencedIds(tx *bolt.Tx) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	err := tx.Bucket(pathsBucket).ForEach(func(k, v []byte) error {
+		attributes, err := d.codec.readAttributes(v)
+		if err != nil {
+			return err
+		}
+		if attributes.HasRemoteCopy() {
+			ids[attributes.Id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Bucket(snapshotRefsBucket).ForEach(func(k, v []byte) error {
+		ids[string(k)] = true
+		return nil
+	})
+	return ids, err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/simonhorlick/fusedrive/serialize_reads"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// readStreamSkipLimit is the furthest a stream skips forward to serve a read,
+// rather than starting a new stream. Skipped content has already been
+// requested, so it's cheaper to discard it than to make another request.
+const readStreamSkipLimit = 1024 * 1024
+
+// readStreamSequentialReads is the number of reads in a row a stream must
+// serve before it's assumed to be sequential and given readahead.
+const readStreamSequentialReads = 4
+
+// ReadOptions configures how files are read from the remote.
+type ReadOptions struct {
+	// Serializer configures how concurrent reads of each file are reordered.
+	Serializer serialize_reads.Options
+
+	// MaxStreams is the number of sequential streams followed through each
+	// open file, such as the audio and video tracks of a film. When a read
+	// doesn't continue any of them, the least recently used is replaced.
+	MaxStreams int
+
+	// StreamIdleTimeout is how long a stream is kept without being read
+	// before it's closed.
+	StreamIdleTimeout time.Duration
+}
+
+// DefaultReadOptions are suitable for reading a few streams from each file.
+var DefaultReadOptions = ReadOptions{
+	Serializer:        serialize_reads.DefaultOptions,
+	MaxStreams:        4,
+	StreamIdleTimeout: time.Minute,
+}
+
+// resetter is implemented by stream readers whose requests shrink when the
+// reads skip over content.
+type resetter interface {
+	Reset()
+}
+
+// readStream is a reader that follows one sequential stream of reads through
+// a file.
+type readStream struct {
+	// reader is a read buffer for this stream. Data is requested from the api
+	// in large chunks to increase throughput and buffered here until it is
+	// requested. This helps with sequential reads where fuse requests many
+	// small chunks of data.
+	reader io.ReadCloser
+
+	// position is the current position of reader in the file.
+	position int64
+
+	// sequential is true once the stream has been promoted to a sequential
+	// reader. reads counts the reads it has served until then.
+	sequential bool
+	reads      int
+
+	// We cache the most recent read in memory in case we get more reads for
+	// this chunk in non-sequential order.
+	lastReadOffset int64
+	lastReadData   []byte
+
+	// lastUsed is when the stream was last read.
+	lastUsed time.Time
+
+	// expiry closes the stream once it's been idle for too long.
+	expiry *time.Timer
+}
+
+// hasRead returns true if the most recent read of the stream included off.
+func (s *readStream) hasRead(off int64) bool {
+	return off >= s.lastReadOffset &&
+		off < s.lastReadOffset+int64(len(s.lastReadData))
+}
+
+// findStream returns the stream that continues at off, skipping a stream
+// forward if it's just short of off. Returns nil if there isn't one. f.lock
+// must be held.
+func (f *DriveFile) findStream(off int64) *readStream {
+	for _, s := range f.streams {
+		if s.position == off {
+			return s
+		}
+	}
+
+	for _, s := range f.streams {
+		gap := off - s.position
+		if gap <= 0 || gap > readStreamSkipLimit {
+			continue
+		}
+
+		log.Printf("DriveFile skipping %d bytes of stream at %d", gap,
+			s.position)
+		n, err := io.CopyN(ioutil.Discard, s.reader, gap)
+		s.position += n
+		if err != nil {
+			log.Printf("error skipping stream: %v", err)
+			f.closeStream(s)
+			return nil
+		}
+
+		// The reads may not be sequential after all, so don't request more
+		// than needed until they carry on.
+		if r, ok := s.reader.(resetter); ok {
+			r.Reset()
+		}
+		return s
+	}
+
+	return nil
+}
+
+// newStream starts a stream at off, replacing the least recently used stream
+// if there are already too many. f.lock must be held.
+func (f *DriveFile) newStream(off int64) (*readStream, error) {
+	maxStreams := f.readOptions.MaxStreams
+	if maxStreams < 1 {
+		maxStreams = 1
+	}
+	for len(f.streams) >= maxStreams {
+		oldest := f.streams[0]
+		for _, s := range f.streams {
+			if s.lastUsed.Before(oldest.lastUsed) {
+				oldest = s
+			}
+		}
+		log.Printf("DriveFile replacing stream at %d", oldest.position)
+		f.closeStream(oldest)
+	}
+
+	// Streams are assumed to be random until they're read sequentially.
+	reader, err := f.newReader(off, false)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &readStream{
+		reader:       reader,
+		position:     off,
+		lastReadData: make([]byte, 0, fuse.MAX_KERNEL_WRITE),
+	}
+	if f.readOptions.StreamIdleTimeout > 0 {
+		s.expiry = time.AfterFunc(f.readOptions.StreamIdleTimeout, func() {
+			f.expireStream(s)
+		})
+	}
+	f.streams = append(f.streams, s)
+
+	log.Printf("DriveFile new stream created at offset %d, %d streams", off,
+		len(f.streams))
+
+	return s, nil
+}
+
+// promote replaces the reader of a stream that has been read sequentially for
+// long enough with a sequential reader, which makes larger requests and reads
+// ahead. f.lock must be held.
+func (f *DriveFile) promote(s *readStream) error {
+	s.reads++
+	if s.sequential || s.reads < readStreamSequentialReads {
+		return nil
+	}
+
+	reader, err := f.newReader(s.position, true)
+	if err != nil {
+		return err
+	}
+	log.Printf("DriveFile stream at %d is sequential", s.position)
+
+	_ = s.reader.Close()
+	s.reader = reader
+	s.sequential = true
+	return nil
+}
+
+// touch records that the stream has just been read.
+func (f *DriveFile) touch(s *readStream) {
+	s.lastUsed = time.Now()
+	if s.expiry != nil {
+		s.expiry.Reset(f.readOptions.StreamIdleTimeout)
+	}
+}
+
+// expireStream closes s if it hasn't been read recently.
+func (f *DriveFile) expireStream(s *readStream) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if time.Since(s.lastUsed) < f.readOptions.StreamIdleTimeout {
+		return
+	}
+	for _, other := range f.streams {
+		if other == s {
+			log.Printf("DriveFile closing idle stream at %d", s.position)
+			f.closeStream(s)
+			return
+		}
+	}
+}
+
+// closeStream closes s and removes it from the file. f.lock must be held.
+func (f *DriveFile) closeStream(s *readStream) {
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	_ = s.reader.Close()
+
+	for i, other := range f.streams {
+		if other == s {
+			f.streams = append(f.streams[:i], f.streams[i+1:]...)
+			break
+		}
+	}
+}
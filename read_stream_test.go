@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestInterleavedSequentialStreams ensures that two sequential readers of the
+// same file, such as the audio and video tracks of a film, both read ahead.
+func TestInterleavedSequentialStreams(t *testing.T) {
+	fs := newTestFileSystem(t, streamingOptions)
+	defer fs.Close()
+
+	content := make([]byte, 3*readStreamSkipLimit)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	fs.writeFile(t, "file", content)
+
+	file := fs.openStream(t, "file")
+	defer file.Release()
+
+	// The second reader is too far ahead to be served by skipping the first.
+	const chunk = 4096
+	offsets := []int64{0, 2 * readStreamSkipLimit}
+	for i := 0; i < 2*readStreamSequentialReads; i++ {
+		for j, off := range offsets {
+			expectRead(t, file, off, content[off:off+chunk])
+			offsets[j] += chunk
+		}
+	}
+
+	f := file.(*DriveFile)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(f.streams) != len(offsets) {
+		t.Fatalf("Expecting %d streams, got %d", len(offsets), len(f.streams))
+	}
+	for _, s := range f.streams {
+		if !s.sequential {
+			t.Errorf("Expecting the stream at %d to read ahead", s.position)
+		}
+	}
+}
+
+// TestRandomStream ensures that a stream that's only read once doesn't read
+// ahead.
+func TestRandomStream(t *testing.T) {
+	fs := newTestFileSystem(t, streamingOptions)
+	defer fs.Close()
+
+	content := bytes.Repeat([]byte("a"), 3*readStreamSkipLimit)
+	fs.writeFile(t, "file", content)
+
+	file := fs.openStream(t, "file")
+	defer file.Release()
+
+	for _, off := range []int64{2 * readStreamSkipLimit, 0} {
+		expectRead(t, file, off, content[off:off+10])
+	}
+
+	f := file.(*DriveFile)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, s := range f.streams {
+		if s.sequential {
+			t.Errorf("Expecting the stream at %d not to read ahead", s.position)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/encryption"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// rotateRetryInterval is how long the rotator waits before retrying files that
+// couldn't be re-encrypted, for example because they were open.
+const rotateRetryInterval = 10 * time.Minute
+
+// runRotator re-encrypts every remote file with the data key of the current
+// rotation, if there is one, until either every file has been re-encrypted or
+// the filesystem is unmounted. Progress is recorded in the database so an
+// interrupted rotation carries on where it left off when next mounted.
+func (fs *DriveFileSystem) runRotator() {
+	generation, ok, err := fs.db.Rotation()
+	if err != nil {
+		log.Printf("failed to check for key rotation: %v", err)
+		return
+	} else if !ok {
+		return
+	}
+
+	for {
+		ids, err := fs.db.ListUnrotated()
+		if err != nil {
+			log.Printf("failed to list files to re-encrypt: %v", err)
+		} else if len(ids) == 0 {
+			if err := fs.db.FinishRotation(); err != nil {
+				log.Printf("failed to finish key rotation: %v", err)
+			}
+			log.Printf("Every file is encrypted with data key %d", generation)
+			return
+		}
+
+		log.Printf("Re-encrypting %d files with data key %d", len(ids),
+			generation)
+
+		inodes, err := fs.inodesById()
+		if err != nil {
+			log.Printf("failed to list files to re-encrypt: %v", err)
+		}
+
+		for _, id := range ids {
+			select {
+			case <-fs.quit:
+				return
+			default:
+			}
+
+			if err := fs.rotate(id, generation, inodes[id]); err != nil {
+				log.Printf("failed to re-encrypt %s: %v", id, err)
+			}
+		}
+
+		select {
+		case <-time.After(rotateRetryInterval):
+		case <-fs.quit:
+			return
+		}
+	}
+}
+
+// inodesById returns the inodes of the files in the filesystem, keyed by the id
+// of their remote copy.
+func (fs *DriveFileSystem) inodesById() (map[string][]uint64, error) {
+	inodes := make(map[string][]uint64)
+	err := fs.db.Walk(func(path string, attributes metadb.Attributes) error {
+		if attributes.HasRemoteCopy() {
+			inodes[attributes.Id] = append(inodes[attributes.Id],
+				attributes.Inode)
+		}
+		return nil
+	})
+	return inodes, err
+}
+
+// rotate re-encrypts the remote file with the given id using the data key of
+// the given generation. The remote file is only replaced while none of the
+// given inodes, which share it, are open.
+func (fs *DriveFileSystem) rotate(id string, generation uint32,
+	inodes []uint64) error {
+	keyring := fs.options.Keyring
+
+	original, err := fs.driveApi.GetFile(id)
+	if api.IsNotFound(err) {
+		// There's nothing left to re-encrypt.
+		return fs.db.SetRotated(id)
+	} else if err != nil {
+		return err
+	}
+
+	h, err := fs.readHeader(id)
+	if err != nil {
+		return err
+	}
+	if current, err := encryption.Generation(h); err != nil {
+		return err
+	} else if current == generation {
+		return fs.db.SetRotated(id)
+	}
+
+	log.Printf("Re-encrypting %s with data key %d", id, generation)
+
+	blob, err := ioutil.TempFile("", "")
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(blob)
+
+	if err := fs.driveApi.ReadAll(id, blob); err != nil {
+		return err
+	}
+
+	content, err := ioutil.TempFile("", "")
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(content)
+
+	if err := decryptFile(keyring, blob, content); err != nil {
+		return err
+	}
+	reencrypted, newMd5, err := encryptFile(keyring, content)
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(reencrypted)
+
+	ran, err := fs.localFileCache.RunIfClosed(inodes, func() error {
+		// The file may have been rewritten since it was downloaded.
+		remote, err := fs.driveApi.GetFile(id)
+		if err != nil {
+			return err
+		}
+		if remote.Md5Checksum != original.Md5Checksum {
+			return fmt.Errorf("remote md5 %s changed while re-encrypting",
+				remote.Md5Checksum)
+		}
+
+		remote, err = fs.driveApi.Update(id, reencrypted)
+		if err != nil {
+			return err
+		}
+		if remote.Md5Checksum != "" &&
+			remote.Md5Checksum != hex.EncodeToString(newMd5) {
+			return fmt.Errorf("remote md5 %s doesn't match local md5 %x",
+				remote.Md5Checksum, newMd5)
+		}
+
+		if err := fs.db.SetBlobMd5(id, newMd5); err != nil {
+			return err
+		}
+		return fs.db.SetRotated(id)
+	})
+	if err == nil && !ran {
+		log.Printf("Not re-encrypting %s while it's open", id)
+	}
+	return err
+}
+
+// readHeader returns the header of the encrypted remote file with the given id.
+func (fs *DriveFileSystem) readHeader(id string) ([]byte, error) {
+	body, err := fs.driveApi.ReadAt(id, uint64(encryption.HeaderSize), 0)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	h, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(h) != encryption.HeaderSize {
+		return nil, encryption.Corrupt
+	}
+	return h, nil
+}
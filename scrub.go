@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"io"
+	"log"
+	"time"
+)
+
+// scrubIdleInterval is how long the scrubber waits before looking for more
+// work once every file has been verified.
+const scrubIdleInterval = time.Hour
+
+// throttledReader limits the rate at which data is read from r.
+type throttledReader struct {
+	r io.Reader
+
+	// bytesPerSecond is the maximum average rate of reads.
+	bytesPerSecond int64
+
+	start time.Time
+	read  int64
+}
+
+func newThrottledReader(r io.Reader, bytesPerSecond int64) *throttledReader {
+	return &throttledReader{
+		r:              r,
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Don't read more than a second's worth at once, so the rate stays even.
+	if int64(len(p)) > t.bytesPerSecond {
+		p = p[:t.bytesPerSecond]
+	}
+
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+
+	// Sleep until the average rate is back under the limit.
+	due := t.start.Add(time.Duration(t.read * int64(time.Second) /
+		t.bytesPerSecond))
+	time.Sleep(time.Until(due))
+
+	return n, err
+}
+
+// runScrubber slowly verifies the remote copy of every file against the
+// checksums recorded when it was uploaded, until the filesystem is unmounted.
+// Each file is verified at most once every ScrubInterval.
+func (fs *DriveFileSystem) runScrubber() {
+	for {
+		entries, err := fs.db.ListUnverified(
+			time.Now().Add(-fs.options.ScrubInterval))
+		if err != nil {
+			log.Printf("failed to list files to scrub: %v", err)
+		}
+
+		fs.scrubAll(entries)
+
+		select {
+		case <-time.After(scrubIdleInterval):
+		case <-fs.quit:
+			return
+		}
+	}
+}
+
+// scrubKey identifies the remote content that a file is expected to have.
+type scrubKey struct {
+	id  string
+	md5 string
+}
+
+// scrubAll verifies the given files until the filesystem is unmounted. Files
+// that share a remote copy are only downloaded once, and each of them is
+// flagged if the copy doesn't match.
+func (fs *DriveFileSystem) scrubAll(entries []metadb.ScrubEntry) {
+	results := make(map[scrubKey]metadb.SyncState)
+
+	for _, entry := range entries {
+		select {
+		case <-fs.quit:
+			return
+		default:
+		}
+
+		// The content of open files may be about to change.
+		if fs.localFileCache.IsOpen(entry.Attributes.Inode) {
+			continue
+		}
+
+		key := scrubKey{entry.Attributes.Id, string(entry.Attributes.Md5)}
+		state, ok := results[key]
+		if !ok {
+			state, ok = fs.scrub(entry)
+			if !ok {
+				continue
+			}
+			results[key] = state
+		}
+
+		if state != metadb.Synced {
+			fs.flag(entry, state)
+		}
+	}
+}
+
+// scrub downloads the remote copy of a single file and compares it with the
+// recorded checksums. It returns the state the file should be in: corrupt if
+// the copy doesn't match, or missing if it no longer exists. Returns false if
+// the copy couldn't be checked.
+func (fs *DriveFileSystem) scrub(entry metadb.ScrubEntry) (metadb.SyncState,
+	bool) {
+	attributes := entry.Attributes
+
+	log.Printf("Scrubbing %s (%s)", entry.Path, attributes.Id)
+
+	state := metadb.Synced
+	body, err := fs.driveApi.Download(attributes.Id)
+	if api.IsNotFound(err) {
+		state = metadb.RemoteMissing
+	} else if err != nil {
+		log.Printf("failed to download %s for scrubbing: %v", entry.Path, err)
+		return state, false
+	} else {
+		// The sha256 of an encrypted file is of its content, which would need
+		// to be decrypted, so only the md5 of the remote copy is checked.
+		withSha256 := len(attributes.Sha256) > 0 && fs.options.Keyring == nil
+
+		md5sum, sha256sum, err := checksumReader(
+			newThrottledReader(body, fs.options.ScrubBandwidth), withSha256)
+		body.Close()
+		if err != nil {
+			log.Printf("failed to read %s for scrubbing: %v", entry.Path, err)
+			return state, false
+		}
+
+		if !bytes.Equal(md5sum, attributes.Md5) || (withSha256 &&
+			!bytes.Equal(sha256sum, attributes.Sha256)) {
+			state = metadb.Corrupt
+		}
+	}
+
+	if err := fs.db.SetLastVerified(attributes.Id, time.Now()); err != nil {
+		log.Printf("failed to record scrub of %s: %v", entry.Path, err)
+	}
+
+	return state, true
+}
+
+// flag sets the state of a file whose remote copy was found to be corrupt or
+// missing.
+func (fs *DriveFileSystem) flag(entry metadb.ScrubEntry, state metadb.SyncState) {
+	attributes := entry.Attributes
+	log.Printf("Scrub found %s (%s) is %s", entry.Path, attributes.Id, state)
+
+	// Only flag the file if it hasn't been changed or moved in the meantime.
+	// Content that's replaced in place keeps the same id, so the md5 has to
+	// match too.
+	current, err := fs.db.GetAttributes(entry.Path)
+	if err != nil || current.Id != attributes.Id ||
+		current.State != metadb.Synced ||
+		!bytes.Equal(current.Md5, attributes.Md5) {
+		return
+	}
+	if err := fs.db.SetState(entry.Path, state); err != nil {
+		log.Printf("failed to set state for file %s: %v", entry.Path, err)
+	}
+}
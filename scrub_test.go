@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/simonhorlick/fusedrive/metadb"
+	"testing"
+	"time"
+)
+
+// newScrubbedFileSystem returns a filesystem that stores files with the same
+// content once, and writes the given files to it.
+func newScrubbedFileSystem(t *testing.T, names ...string) (*testFileSystem,
+	[]metadb.Attributes) {
+	fs := newTestFileSystem(t, DriveFileSystemOptions{Dedup: true})
+	fs.options.ScrubBandwidth = 1 << 30
+
+	var files []metadb.Attributes
+	for _, name := range names {
+		files = append(files, fs.writeFile(t, name, []byte("shared")))
+	}
+	return fs, files
+}
+
+// scrubUnverified scrubs every file that's due to be verified.
+func (fs *testFileSystem) scrubUnverified(t *testing.T) {
+	entries, err := fs.db.ListUnverified(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.scrubAll(entries)
+}
+
+// TestScrubSharedCopyOnce ensures that files that share a remote copy only
+// download it once per pass.
+func TestScrubSharedCopyOnce(t *testing.T) {
+	fs, files := newScrubbedFileSystem(t, "a", "b", "c")
+	defer fs.Close()
+
+	if files[0].Id != files[1].Id || files[0].Id != files[2].Id {
+		t.Fatal("Expecting the files to share a remote copy")
+	}
+
+	fs.scrubUnverified(t)
+
+	if fs.drive.downloads != 1 {
+		t.Fatalf("Expecting 1 download, got %d", fs.drive.downloads)
+	}
+	entries, err := fs.db.ListUnverified(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expecting every file to be verified, got %d", len(entries))
+	}
+}
+
+// TestScrubFlagsEverySharer ensures that every file that shares a corrupt
+// remote copy is flagged.
+func TestScrubFlagsEverySharer(t *testing.T) {
+	fs, files := newScrubbedFileSystem(t, "a", "b")
+	defer fs.Close()
+
+	fs.drive.replace(files[0].Id, []byte("corrupt"))
+	fs.scrubUnverified(t)
+
+	if fs.drive.downloads != 1 {
+		t.Fatalf("Expecting 1 download, got %d", fs.drive.downloads)
+	}
+	for _, name := range []string{"a", "b"} {
+		attributes, err := fs.db.GetAttributes(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attributes.State != metadb.Corrupt {
+			t.Errorf("Expecting %s to be corrupt, got %s", name,
+				attributes.State)
+		}
+	}
+}
@@ -1,29 +1,74 @@
 package serialize_reads
 
 import (
+	"context"
+	"errors"
 	"log"
 	"sync"
 	"time"
 )
 
-// serializerState is used by the Wait and Done functions
-type serializerState struct {
+// Closed is returned by Wait once the serializer has been closed.
+var Closed = errors.New("serializer is closed")
+
+// Options configures how a Serializer reorders reads.
+type Options struct {
+	// QueueDepth is the maximum number of reads held back at once. When the
+	// queue is full the read with the lowest offset is let through as soon as
+	// the current read finishes. If zero, reads aren't reordered.
+	QueueDepth int
+
+	// Window is how long the serializer waits for further reads to arrive
+	// before letting through the one with the lowest offset.
+	Window time.Duration
+
+	// Timeout is how long a read may hold up the reads queued behind it. Once
+	// it expires the next read is let through even if the first hasn't
+	// finished. If zero, reads are waited for indefinitely.
+	Timeout time.Duration
+}
+
+// DefaultOptions are suitable for the out of order reads that the kernel issues
+// during sequential reads of a single file.
+var DefaultOptions = Options{
+	QueueDepth: 10,
+	Window:     500 * time.Microsecond,
+	Timeout:    30 * time.Second,
+}
+
+// Serializer reorders concurrent reads of a single file, so they're issued in
+// order of offset, and runs them one at a time. Each open file should have its
+// own Serializer, so reads of one file don't hold up reads of another.
+type Serializer struct {
+	options Options
+
 	// we get submissions through the "input" channel
 	input chan *submission
-	// q = Queue
-	q []*submission
-	// wg is used to wait for the read to complete before unblocking the next
-	wg sync.WaitGroup
+
+	// release receives submissions that have finished, or whose caller has
+	// given up waiting.
+	release chan *submission
+
+	// quit is closed by Close to stop the event loop.
+	quit      chan struct{}
+	closeOnce sync.Once
 }
 
-// Wait places the caller into a queue and blocks
-func Wait(offset int64, size int) {
-	serializer.wait(offset, size)
+// Token is returned by Wait once the caller may start its read. Done must be
+// called when the read has finished to let the next read through.
+type Token struct {
+	sr   *Serializer
+	sb   *submission
+	once sync.Once
 }
 
-// Done signals that the read operation has finished
-func Done() {
-	serializer.wg.Done()
+// Done signals that the read operation has finished. It's safe to call more
+// than once.
+func (t *Token) Done() {
+	if t.sr == nil {
+		return
+	}
+	t.once.Do(func() { t.sr.forget(t.sb) })
 }
 
 type submission struct {
@@ -36,113 +81,164 @@ type submission struct {
 	size int
 }
 
-func (sr *serializerState) wait(offset int64, size int) {
-	ch := make(chan struct{})
+// New returns a Serializer with the given options and starts its event loop,
+// which runs until Close is called.
+func New(options Options) *Serializer {
+	sr := &Serializer{
+		options: options,
+		quit:    make(chan struct{}),
+	}
+	if options.QueueDepth > 0 {
+		sr.input = make(chan *submission)
+		sr.release = make(chan *submission)
+		go sr.eventLoop()
+	}
+	return sr
+}
+
+// Wait places the caller into a queue and blocks until it's the caller's turn
+// to read, the context is done or the serializer is closed. The returned
+// token's Done method must be called once the read has finished.
+func (sr *Serializer) Wait(ctx context.Context, offset int64,
+	size int) (*Token, error) {
+	select {
+	case <-sr.quit:
+		return nil, Closed
+	default:
+	}
+
+	if sr.input == nil {
+		return &Token{}, nil
+	}
+
 	sb := &submission{
-		ch:     ch,
+		ch:     make(chan struct{}),
 		offset: offset,
 		size:   size,
 	}
+
 	// Send our submission
-	sr.input <- sb
+	select {
+	case sr.input <- sb:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-sr.quit:
+		return nil, Closed
+	}
+
 	// Wait till we get unblocked
-	<-ch
+	select {
+	case <-sb.ch:
+		return &Token{sr: sr, sb: sb}, nil
+	case <-ctx.Done():
+		// The submission may have been unblocked at the same time, so it must
+		// be released either way.
+		sr.forget(sb)
+		return nil, ctx.Err()
+	case <-sr.quit:
+		return nil, Closed
+	}
 }
 
-// push returns true if the queue is full after the element has been stored.
-// It panics if it did not have space to store the element.
-func (sr *serializerState) push(sb *submission) (full bool) {
-	free := 0
-	stored := false
-	for i, v := range sr.q {
-		if v != nil {
-			continue
-		}
-		if !stored {
-			sr.q[i] = sb
-			stored = true
-			continue
-		}
-		free++
-	}
-	if !stored {
-		// This should never happen because eventLoop checks if the queue got full
-		log.Panic("BUG: unhandled queue overflow")
-	}
-	if free == 0 {
-		return true
+// Close stops the event loop. Any reads that are still queued fail with
+// Closed.
+func (sr *Serializer) Close() {
+	sr.closeOnce.Do(func() { close(sr.quit) })
+}
+
+// forget removes sb from the queue if it's still waiting, or lets the next read
+// through if it's running.
+func (sr *Serializer) forget(sb *submission) {
+	select {
+	case sr.release <- sb:
+	case <-sr.quit:
 	}
-	return false
 }
 
-// pop the submission with the lowest offset off the queue
-func (sr *serializerState) pop() *submission {
-	var winner *submission
-	var winnerIndex int
-	for i, v := range sr.q {
-		if v == nil {
-			continue
-		}
-		if winner == nil {
-			winner = v
-			winnerIndex = i
-			continue
+func (sr *Serializer) eventLoop() {
+	// q holds the submissions waiting to be unblocked.
+	q := make([]*submission, 0, sr.options.QueueDepth)
+
+	// running is the submission that's currently unblocked, if any.
+	var running *submission
+	var runningTimeout *time.Timer
+
+	// pop unblocks the submission with the lowest offset.
+	pop := func() {
+		winner := 0
+		for i, v := range q {
+			if v.offset < q[winner].offset {
+				winner = i
+			}
 		}
-		if v.offset < winner.offset {
-			winner = v
-			winnerIndex = i
+		running = q[winner]
+		q = append(q[:winner], q[winner+1:]...)
+		close(running.ch)
+
+		if sr.options.Timeout > 0 {
+			runningTimeout = time.NewTimer(sr.options.Timeout)
 		}
 	}
-	if winner == nil {
-		return nil
+
+	stopRunning := func() {
+		running = nil
+		if runningTimeout != nil {
+			runningTimeout.Stop()
+			runningTimeout = nil
+		}
 	}
-	sr.q[winnerIndex] = nil
-	return winner
-}
 
-func (sr *serializerState) eventLoop() {
-	sr.input = make(chan *submission)
-	empty := true
 	for {
-		if empty {
-			// If the queue is empty we block on the channel to conserve CPU
-			sb := <-sr.input
-			sr.push(sb)
-			empty = false
+		if running == nil && len(q) == cap(q) {
+			// Queue is full, unblock a request immediately
+			log.Printf("serialize_reads: queue full, forcing unblock")
+			pop()
 		}
-		select {
-		case sb := <-sr.input:
-			full := sr.push(sb)
-			if full {
-				// Queue is full, unblock the new request immediately
-				log.Printf("serialize_reads: queue full, forcing unblock")
-				sr.unblockOne()
-			}
-			continue
-		case <-time.After(time.Microsecond * 500):
-			// Looks like we have waited out all concurrent requests.
-			empty = sr.unblockOne()
+
+		// Stop accepting submissions while the queue is full.
+		input := sr.input
+		if len(q) == cap(q) {
+			input = nil
 		}
-	}
-}
 
-// Unblock a submission and wait for completion
-func (sr *serializerState) unblockOne() (empty bool) {
-	winner := sr.pop()
-	if winner == nil {
-		return true
-	}
-	sr.wg.Add(1)
-	close(winner.ch)
-	sr.wg.Wait()
-	return false
-}
+		// Once nothing is running, wait for any other concurrent requests to
+		// arrive before unblocking the lowest offset. If the queue is empty we
+		// just block on the channels to conserve CPU.
+		var window <-chan time.Time
+		if running == nil && len(q) > 0 {
+			window = time.After(sr.options.Window)
+		}
 
-var serializer serializerState
+		var timeout <-chan time.Time
+		if runningTimeout != nil {
+			timeout = runningTimeout.C
+		}
 
-// InitSerializer sets up the internal serializer state and starts the event loop.
-func InitSerializer() {
-	serializer.input = make(chan *submission)
-	serializer.q = make([]*submission, 10)
-	go serializer.eventLoop()
+		select {
+		case sb := <-input:
+			q = append(q, sb)
+		case <-window:
+			// Looks like we have waited out all concurrent requests.
+			pop()
+		case sb := <-sr.release:
+			if sb == running {
+				stopRunning()
+				continue
+			}
+			for i, v := range q {
+				if v == sb {
+					q = append(q[:i], q[i+1:]...)
+					break
+				}
+			}
+		case <-timeout:
+			log.Printf("serialize_reads: read at offset %d took longer than "+
+				"%v, unblocking the next read", running.offset,
+				sr.options.Timeout)
+			stopRunning()
+		case <-sr.quit:
+			stopRunning()
+			return
+		}
+	}
 }
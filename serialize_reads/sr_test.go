@@ -0,0 +1,187 @@
+package serialize_reads
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testOptions = Options{
+	QueueDepth: 10,
+	Window:     50 * time.Millisecond,
+	Timeout:    10 * time.Second,
+}
+
+// TestOutOfOrder ensures that reads arriving together are let through in order
+// of offset.
+func TestOutOfOrder(t *testing.T) {
+	sr := New(testOptions)
+	defer sr.Close()
+
+	var mu sync.Mutex
+	var order []int64
+
+	var wg sync.WaitGroup
+	for _, offset := range []int64{3, 1, 2, 0} {
+		wg.Add(1)
+		go func(offset int64) {
+			defer wg.Done()
+			token, err := sr.Wait(context.Background(), offset, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer token.Done()
+
+			mu.Lock()
+			order = append(order, offset)
+			mu.Unlock()
+		}(offset)
+	}
+	wg.Wait()
+
+	for i, offset := range order {
+		if offset != int64(i) {
+			t.Fatalf("Expecting reads in order of offset, got %v", order)
+		}
+	}
+}
+
+// TestConcurrent ensures that only one read runs at a time, even when more
+// reads arrive than fit in the queue.
+func TestConcurrent(t *testing.T) {
+	sr := New(Options{QueueDepth: 4, Window: time.Millisecond})
+	defer sr.Close()
+
+	var running, completed int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(offset int64) {
+			defer wg.Done()
+			token, err := sr.Wait(context.Background(), offset, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer token.Done()
+
+			if n := atomic.AddInt32(&running, 1); n != 1 {
+				t.Errorf("Expecting one read at a time, got %d", n)
+			}
+			time.Sleep(100 * time.Microsecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&completed, 1)
+		}(int64(i))
+	}
+	wg.Wait()
+
+	if completed != 50 {
+		t.Fatalf("Expecting every read to complete, got %d", completed)
+	}
+}
+
+// TestCancelled ensures that a read that gives up waiting doesn't hold up
+// later reads.
+func TestCancelled(t *testing.T) {
+	sr := New(testOptions)
+	defer sr.Close()
+
+	first, err := sr.Wait(context.Background(), 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	if _, err := sr.Wait(ctx, 1, 1); err != context.DeadlineExceeded {
+		t.Fatalf("Expecting the wait to time out, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sr.Wait(cancelled, 2, 1); err != context.Canceled {
+		t.Fatalf("Expecting the wait to be cancelled, got %v", err)
+	}
+
+	first.Done()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	token, err := sr.Wait(ctx, 3, 1)
+	if err != nil {
+		t.Fatalf("Expecting the next read to proceed, got %v", err)
+	}
+	token.Done()
+}
+
+// TestTimeout ensures that a read that never finishes only holds up other reads
+// until the timeout.
+func TestTimeout(t *testing.T) {
+	sr := New(Options{
+		QueueDepth: 10,
+		Window:     time.Millisecond,
+		Timeout:    50 * time.Millisecond,
+	})
+	defer sr.Close()
+
+	if _, err := sr.Wait(context.Background(), 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	token, err := sr.Wait(ctx, 1, 1)
+	if err != nil {
+		t.Fatalf("Expecting the next read to proceed, got %v", err)
+	}
+
+	// Calling Done more than once has no further effect.
+	token.Done()
+	token.Done()
+}
+
+// TestClosed ensures that queued and later reads fail once the serializer is
+// closed.
+func TestClosed(t *testing.T) {
+	sr := New(testOptions)
+
+	first, err := sr.Wait(context.Background(), 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := sr.Wait(context.Background(), 1, 1)
+		errs <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	sr.Close()
+	if err := <-errs; err != Closed {
+		t.Fatalf("Expecting queued read to fail, got %v", err)
+	}
+
+	first.Done()
+
+	if _, err := sr.Wait(context.Background(), 2, 1); err != Closed {
+		t.Fatalf("Expecting read after close to fail, got %v", err)
+	}
+}
+
+// TestDisabled ensures that reads aren't held back if the queue depth is zero.
+func TestDisabled(t *testing.T) {
+	sr := New(Options{})
+	defer sr.Close()
+
+	for offset := int64(0); offset < 3; offset++ {
+		if _, err := sr.Wait(context.Background(), offset, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"log"
+	"strings"
+	"syscall"
+)
+
+// snapshotsDir is the read-only directory at the root of the filesystem that
+// contains each snapshot.
+const snapshotsDir = ".snapshots"
+
+// inSnapshots returns true if name is the snapshots directory or is inside it.
+func inSnapshots(name string) bool {
+	return name == snapshotsDir || strings.HasPrefix(name, snapshotsDir+"/")
+}
+
+// splitSnapshotPath returns the name of the snapshot that contains name and
+// the path within that snapshot. Returns false if name isn't inside a
+// snapshot.
+func splitSnapshotPath(name string) (snapshot string, path string, ok bool) {
+	prefix := snapshotsDir + "/"
+	if !strings.HasPrefix(name, prefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(name, prefix), "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1], true
+	}
+	return parts[0], "", true
+}
+
+// snapshotStatus converts an error from reading a snapshot into a status.
+func snapshotStatus(name string, err error) fuse.Status {
+	if err == metadb.DoesNotExist {
+		return fuse.ENOENT
+	}
+	log.Printf("failed to read snapshot %s: %v", name, err)
+	return fuse.EIO
+}
+
+// getSnapshotAttr returns the attributes of a node within the snapshots
+// directory. Everything within a snapshot is read-only.
+func (fs *DriveFileSystem) getSnapshotAttr(name string) (*fuse.Attr,
+	fuse.Status) {
+	snapshot, path, ok := splitSnapshotPath(name)
+	if !ok || path == "" {
+		if ok {
+			if _, err := fs.db.ListSnapshot(snapshot, ""); err != nil {
+				return nil, snapshotStatus(name, err)
+			}
+		}
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	}
+
+	attributes, err := fs.db.GetSnapshotAttributes(snapshot, path)
+	if err != nil {
+		return nil, snapshotStatus(name, err)
+	}
+
+	out := new(fuse.Attr)
+	toFuseAttributes(attributes, out)
+	out.Mode &^= 0222
+
+	return out, fuse.OK
+}
+
+// openSnapshotDir lists a directory within the snapshots directory.
+func (fs *DriveFileSystem) openSnapshotDir(name string) ([]fuse.DirEntry,
+	fuse.Status) {
+	snapshot, path, ok := splitSnapshotPath(name)
+
+	// List the snapshots themselves.
+	if !ok {
+		snapshots, err := fs.db.ListSnapshots()
+		if err != nil {
+			return nil, snapshotStatus(name, err)
+		}
+
+		output := make([]fuse.DirEntry, 0, len(snapshots))
+		for _, s := range snapshots {
+			output = append(output, fuse.DirEntry{
+				Name: s.Name,
+				Mode: fuse.S_IFDIR | 0555,
+			})
+		}
+		return output, fuse.OK
+	}
+
+	entries, err := fs.db.ListSnapshot(snapshot, path)
+	if err != nil {
+		return nil, snapshotStatus(name, err)
+	}
+
+	output := make([]fuse.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		var fileType uint32
+		if entry.Attributes.IsRegularFile {
+			fileType = fuse.S_IFREG
+		} else {
+			fileType = fuse.S_IFDIR
+		}
+
+		output = append(output, fuse.DirEntry{
+			Name: entry.Path,
+			Mode: fileType | (entry.Attributes.Mode &^ 0222),
+		})
+	}
+
+	return output, fuse.OK
+}
+
+// openSnapshotFile opens a file within a snapshot for reading.
+func (fs *DriveFileSystem) openSnapshotFile(name string, flags uint32) (
+	nodefs.File, fuse.Status) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, fuse.EROFS
+	}
+
+	snapshot, path, ok := splitSnapshotPath(name)
+	if !ok || path == "" {
+		return nil, fuse.EISDIR
+	}
+
+	attributes, err := fs.db.GetSnapshotAttributes(snapshot, path)
+	if err != nil {
+		return nil, snapshotStatus(name, err)
+	}
+
+	if !attributes.IsRegularFile {
+		return nil, fuse.EISDIR
+	}
+
+	if attributes.HasContent {
+		content, err := fs.db.GetSnapshotFile(snapshot, path)
+		if err != nil {
+			return nil, snapshotStatus(name, err)
+		}
+		return nodefs.NewReadOnlyFile(nodefs.NewDataFile(content)), fuse.OK
+	}
+
+	out := new(fuse.Attr)
+	toFuseAttributes(attributes, out)
+	out.Mode &^= 0222
+
+	return NewReadOnlyDriveFile(fs.driveApi, api.DriveApiFile{
+		Name:    name,
+		Id:      attributes.Id,
+		Size:    attributes.Size,
+		Version: hex.EncodeToString(attributes.Md5),
+	}, out, fs.options.Keyring, fs.options.Reads), fuse.OK
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// quotaRefreshInterval is how often the Drive storage quota is fetched and
+	// the files in the filesystem are counted.
+	quotaRefreshInterval = 5 * time.Minute
+
+	// statFsBlockSize is the block size reported by StatFs.
+	statFsBlockSize = 4096
+
+	// unlimitedBytes is the capacity reported when the account has no storage
+	// limit, or when the quota hasn't been fetched yet.
+	unlimitedBytes = 1 << 60
+
+	// freeInodes is the number of free inodes reported by StatFs. Drive
+	// doesn't limit the number of files that can be stored.
+	freeInodes = math.MaxUint32
+)
+
+// quotaCache holds the most recently fetched Drive storage quota, along with
+// the size of the filesystem. Counting the files means reading every node in
+// the database, which is too slow to do on every call to StatFs.
+type quotaCache struct {
+	mu sync.Mutex
+
+	// total and used are the capacity of the account and how much of it is
+	// used, in bytes.
+	total, used uint64
+
+	// fetched is false until the quota has been fetched successfully.
+	fetched bool
+
+	// files and usedBytes are the number of files in the filesystem and their
+	// total size.
+	files, usedBytes uint64
+}
+
+// get returns the capacity and usage of the account, and whether they're known.
+func (c *quotaCache) get() (total, used uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.total, c.used, c.fetched
+}
+
+// stats returns the number of files in the filesystem and their total size.
+func (c *quotaCache) stats() (files, usedBytes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.files, c.usedBytes
+}
+
+// refreshStats counts the files in the filesystem.
+func (fs *DriveFileSystem) refreshStats() {
+	files, usedBytes, err := fs.db.FilesystemStats()
+	if err != nil {
+		log.Printf("failed to read filesystem stats: %v", err)
+		return
+	}
+
+	fs.quota.mu.Lock()
+	fs.quota.files = files
+	fs.quota.usedBytes = usedBytes
+	fs.quota.mu.Unlock()
+}
+
+// refreshQuota fetches the Drive storage quota.
+func (fs *DriveFileSystem) refreshQuota() {
+	quota, err := fs.driveApi.GetQuota()
+	if err != nil {
+		log.Printf("failed to fetch storage quota: %v", err)
+		return
+	}
+
+	total := quota.Limit
+	if quota.Unlimited() {
+		total = quota.Usage + unlimitedBytes
+	}
+
+	fs.quota.mu.Lock()
+	fs.quota.total = total
+	fs.quota.used = quota.Usage
+	fs.quota.fetched = true
+	fs.quota.mu.Unlock()
+}
+
+// runQuotaRefresher keeps the cached storage quota and filesystem stats up to
+// date until the filesystem is unmounted.
+func (fs *DriveFileSystem) runQuotaRefresher() {
+	fs.refreshStats()
+	fs.refreshQuota()
+
+	ticker := time.NewTicker(quotaRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fs.refreshStats()
+			fs.refreshQuota()
+		case <-fs.quit:
+			return
+		}
+	}
+}
+
+// stagingFreeBytes returns the space available on the disk that holds local
+// copies of open files.
+func stagingFreeBytes() (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(os.TempDir(), &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// StatFs reports the capacity of the Drive account and the number of files in
+// the filesystem, as of the last time they were refreshed.
+func (fs *DriveFileSystem) StatFs(name string) *fuse.StatfsOut {
+	files, usedBytes := fs.quota.stats()
+
+	// Until the quota is known, report the space used by the filesystem itself.
+	total, used, ok := fs.quota.get()
+	if !ok {
+		total, used = usedBytes+unlimitedBytes, usedBytes
+	}
+
+	free := uint64(0)
+	if total > used {
+		free = total - used
+	}
+
+	// Files are written to the staging disk before they're uploaded, so a file
+	// larger than the space there can't be written.
+	if fs.options.CapToStagingDisk {
+		staging, err := stagingFreeBytes()
+		if err != nil {
+			log.Printf("failed to read staging disk stats: %v", err)
+		} else if staging < free {
+			free = staging
+		}
+	}
+
+	return &fuse.StatfsOut{
+		Blocks:  total / statFsBlockSize,
+		Bfree:   free / statFsBlockSize,
+		Bavail:  free / statFsBlockSize,
+		Files:   files + freeInodes,
+		Ffree:   freeInodes,
+		Bsize:   statFsBlockSize,
+		Frsize:  statFsBlockSize,
+		NameLen: 255,
+	}
+}
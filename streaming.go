@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/simonhorlick/fusedrive/metadb"
+	"strings"
+)
+
+// StreamPolicy decides which files opened read-only are streamed from the
+// remote in ranges, rather than downloaded in full before the first read.
+// Streaming starts returning data sooner and avoids staging large files on the
+// local disk, but the content isn't verified against its checksums.
+type StreamPolicy struct {
+	// MinSize is the size at which files are streamed. If zero, files are
+	// only streamed if they're in one of Dirs.
+	MinSize uint64
+
+	// Dirs lists directories whose files are streamed whatever their size.
+	Dirs []string
+}
+
+// ShouldStream returns true if the file with the given name and attributes can
+// and should be streamed when it's opened read-only.
+func (p StreamPolicy) ShouldStream(name string,
+	attributes metadb.Attributes) bool {
+	// Only the latest content can be streamed.
+	if !attributes.HasRemoteCopy() || attributes.State != metadb.Synced {
+		return false
+	}
+
+	if p.MinSize > 0 && attributes.Size >= p.MinSize {
+		return true
+	}
+
+	for _, dir := range p.Dirs {
+		dir = strings.Trim(dir, "/")
+		if dir == "" || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitList returns the non-empty elements of a comma-separated list.
+func splitList(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
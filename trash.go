@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// trashPurgeInterval is how often the trash is checked for files that have
+// passed the retention period.
+const trashPurgeInterval = time.Hour
+
+// inTrash returns true if name is the trash directory or is inside it.
+func inTrash(name string) bool {
+	return name == metadb.TrashDir ||
+		strings.HasPrefix(name, metadb.TrashDir+"/")
+}
+
+// trashEntryName returns the name of the trash entry at the given path, or
+// false if the path isn't inside the trash.
+func trashEntryName(name string) (string, bool) {
+	prefix := metadb.TrashDir + "/"
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, prefix), true
+}
+
+// newTrashEntryName returns a name for the trash entry of a file deleted from
+// name at the given time. The timestamp prefix keeps the names of files with
+// the same base name distinct.
+func newTrashEntryName(name string, deletedAt time.Time) string {
+	return fmt.Sprintf("%d-%s", deletedAt.UnixNano(), path.Base(name))
+}
+
+// runTrashPurger periodically purges the trash until the filesystem is
+// unmounted.
+func (fs *DriveFileSystem) runTrashPurger() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		fs.purgeTrash()
+
+		select {
+		case <-ticker.C:
+		case <-fs.quit:
+			return
+		}
+	}
+}
+
+// purgeTrash permanently deletes any files that have been in the trash for
+// longer than the retention period.
+func (fs *DriveFileSystem) purgeTrash() {
+	entries, err := fs.db.ListTrash()
+	if err != nil {
+		log.Printf("failed to list trash: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if time.Since(entry.DeletedAt) < fs.options.TrashRetention {
+			continue
+		}
+
+		log.Printf("Purging %s from trash, deleted from %s at %s", entry.Name,
+			entry.Path, entry.DeletedAt)
+
+		fs.purgeTrashEntry(entry.Name)
+	}
+}
+
+// purgeTrashEntry permanently deletes the trash entry with the given name. The
+// remote copy is deleted before the entry, so that if it fails the entry is
+// still there to be purged again later.
+func (fs *DriveFileSystem) purgeTrashEntry(entry string) {
+	name := metadb.TrashPath(entry)
+	attributes, err := fs.db.GetAttributes(name)
+	if err != nil {
+		log.Printf("failed to read attributes of %s: %v", name, err)
+		return
+	}
+
+	// Hold the file closed while its remote copy is deleted. Restoring the
+	// file takes the same lock, so the entry is read again in case it was
+	// restored in the meantime.
+	closed, err := fs.localFileCache.RunIfClosed([]uint64{attributes.Inode},
+		func() error {
+			current, err := fs.db.GetAttributes(name)
+			if err != nil {
+				return err
+			}
+			if current.Inode != attributes.Inode {
+				return metadb.DoesNotExist
+			}
+
+			if current.HasRemoteCopy() {
+				shared, err := fs.localFileCache.isShared(current.Id)
+				if err != nil {
+					return err
+				}
+				if !shared {
+					err := fs.driveApi.Delete(current.Id)
+					if err != nil && !api.IsNotFound(err) {
+						return err
+					}
+				}
+			}
+
+			_, err = fs.db.RemoveFromTrash(entry)
+			return err
+		})
+	if err == metadb.DoesNotExist {
+		log.Printf("%s was restored before it could be purged", entry)
+		return
+	} else if err != nil {
+		log.Printf("failed to purge %s from trash: %v", entry, err)
+		return
+	}
+	if closed {
+		return
+	}
+
+	// The file is open, so its remote copy is deleted once it's released.
+	attributes, err = fs.db.RemoveFromTrash(entry)
+	if err != nil {
+		log.Printf("failed to remove %s from trash: %v", entry, err)
+		return
+	}
+	fs.removeRemote(name, attributes)
+}
+
+// restore moves the trash entry with the given name to path. The file's inode
+// is locked throughout so that it can't be restored while it's being purged.
+func (fs *DriveFileSystem) restore(entry, path string) error {
+	name := metadb.TrashPath(entry)
+	attributes, err := fs.db.GetAttributes(name)
+	if err != nil {
+		return err
+	}
+
+	return fs.localFileCache.RunLocked(attributes.Inode, func() error {
+		return fs.localFileCache.Rename(name, path, func() error {
+			return fs.db.RestoreFromTrash(entry, path)
+		})
+	})
+}
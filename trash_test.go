@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRestoreRacingPurge ensures that a file restored from the trash while it's
+// being purged either keeps its remote copy or is gone entirely.
+func TestRestoreRacingPurge(t *testing.T) {
+	fs := newTestFileSystem(t, DriveFileSystemOptions{
+		TrashRetention: time.Hour,
+	})
+	defer fs.Close()
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%d", i)
+		restored := name + "-restored"
+		content := []byte(name)
+		attributes := fs.writeFile(t, name, content)
+
+		if status := fs.Unlink(name, nil); status != fuse.OK {
+			t.Fatalf("Failed to unlink %s: %v", name, status)
+		}
+		entries, err := fs.db.ListTrash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("Expecting 1 trash entry, got %d", len(entries))
+		}
+		entry := entries[0].Name
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		var status fuse.Status
+		go func() {
+			defer wg.Done()
+			status = fs.Rename(metadb.TrashPath(entry), restored, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			fs.purgeTrashEntry(entry)
+		}()
+		wg.Wait()
+
+		data, uploaded := fs.drive.content(attributes.Id)
+		switch status {
+		case fuse.OK:
+			if !uploaded || !bytes.Equal(data, content) {
+				t.Fatalf("Expecting restored %s to keep its remote copy", name)
+			}
+			if status := fs.Unlink(restored, nil); status != fuse.OK {
+				t.Fatalf("Failed to unlink %s: %v", restored, status)
+			}
+			entries, err := fs.db.ListTrash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.purgeTrashEntry(entries[0].Name)
+		case fuse.ENOENT:
+			if uploaded {
+				t.Fatalf("Expecting purged %s to lose its remote copy", name)
+			}
+		default:
+			t.Fatalf("Failed to restore %s: %v", name, status)
+		}
+
+		if entries, _ := fs.db.ListTrash(); len(entries) != 0 {
+			t.Fatalf("Expecting the trash to be empty, got %v", entries)
+		}
+	}
+}
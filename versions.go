@@ -0,0 +1,235 @@
+package main
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/simonhorlick/fusedrive/api"
+	"github.com/simonhorlick/fusedrive/encryption"
+	"github.com/simonhorlick/fusedrive/metadb"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// versionsSuffix is appended to the name of a file to get the read-only
+	// directory listing its previous revisions.
+	versionsSuffix = "@versions"
+
+	// versionTimeFormat is the format of the names of revisions in a versions
+	// directory.
+	versionTimeFormat = "2006-01-02T15:04:05Z"
+
+	// revisionCacheTTL is how long the list of revisions for a file is reused
+	// before it's fetched again. Listing a versions directory stats every
+	// entry, and each of those would otherwise list the revisions again.
+	revisionCacheTTL = time.Minute
+)
+
+// revisionCache keeps recently fetched lists of revisions.
+type revisionCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedRevisions
+}
+
+type cachedRevisions struct {
+	revisions []api.Revision
+	fetched   time.Time
+}
+
+func newRevisionCache() *revisionCache {
+	return &revisionCache{
+		entries: make(map[string]cachedRevisions),
+	}
+}
+
+// get returns the revisions of the file with the given id, using the cached
+// copy if it's recent enough.
+func (c *revisionCache) get(driveApi *api.DriveApi, id string) (
+	[]api.Revision, error) {
+	c.mu.Lock()
+	cached, ok := c.entries[id]
+	c.mu.Unlock()
+
+	if ok && time.Since(cached.fetched) < revisionCacheTTL {
+		return cached.revisions, nil
+	}
+
+	revisions, err := driveApi.ListRevisions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Drop any expired entries so the cache doesn't grow without bound.
+	for k, v := range c.entries {
+		if time.Since(v.fetched) >= revisionCacheTTL {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[id] = cachedRevisions{
+		revisions: revisions,
+		fetched:   time.Now(),
+	}
+
+	return revisions, nil
+}
+
+// splitVersionsPath returns the path of the file whose versions directory
+// contains name, and the name of the revision within that directory. The
+// revision is empty if name is the versions directory itself. Returns false if
+// name isn't within a versions directory.
+func splitVersionsPath(name string) (file string, version string, ok bool) {
+	if strings.HasSuffix(name, versionsSuffix) {
+		return strings.TrimSuffix(name, versionsSuffix), "", true
+	}
+
+	dir := path.Dir(name)
+	if strings.HasSuffix(dir, versionsSuffix) {
+		return strings.TrimSuffix(dir, versionsSuffix), path.Base(name), true
+	}
+
+	return "", "", false
+}
+
+// versionNames returns the given revisions keyed by their name in a versions
+// directory.
+func versionNames(revisions []api.Revision) map[string]api.Revision {
+	names := make(map[string]api.Revision)
+	for _, revision := range revisions {
+		name := revision.ModifiedTime.UTC().Format(versionTimeFormat)
+
+		// Revisions uploaded within the same second need distinct names.
+		if _, exists := names[name]; exists {
+			name = name + "-" + revision.Id
+		}
+
+		names[name] = revision
+	}
+	return names
+}
+
+// versions returns the attributes of the given file along with its revisions
+// keyed by name.
+func (fs *DriveFileSystem) versions(file string) (metadb.Attributes,
+	map[string]api.Revision, fuse.Status) {
+	attributes, err := fs.db.GetAttributes(file)
+	if err == metadb.DoesNotExist {
+		return attributes, nil, fuse.ENOENT
+	} else if err != nil {
+		log.Printf("failed to read file metadata %s: %v", file, err)
+		return attributes, nil, fuse.EIO
+	}
+
+	// Only files stored on the remote have revisions.
+	if !attributes.HasRemoteCopy() {
+		return attributes, nil, fuse.ENOENT
+	}
+
+	revisions, err := fs.revisions.get(fs.driveApi, attributes.Id)
+	if err != nil {
+		log.Printf("failed to list revisions of %s: %v", file, err)
+		return attributes, nil, fuse.EIO
+	}
+
+	return attributes, versionNames(revisions), fuse.OK
+}
+
+// revisionSize returns the size of the content of a revision, which is smaller
+// than the revision itself if it's encrypted.
+func (fs *DriveFileSystem) revisionSize(revision api.Revision) uint64 {
+	if fs.options.Keyring == nil {
+		return revision.Size
+	}
+
+	size, err := encryption.PlaintextSize(revision.Size)
+	if err != nil {
+		log.Printf("Revision %s has invalid encrypted size %d", revision.Id,
+			revision.Size)
+		return 0
+	}
+	return size
+}
+
+// revisionAttr returns the attributes of a revision in a versions directory.
+func (fs *DriveFileSystem) revisionAttr(revision api.Revision) *fuse.Attr {
+	out := &fuse.Attr{
+		Mode: fuse.S_IFREG | 0444,
+		Size: fs.revisionSize(revision),
+	}
+	out.SetTimes(nil, &revision.ModifiedTime, nil)
+	return out
+}
+
+// getVersionAttr returns the attributes of a versions directory, or of a
+// revision within one.
+func (fs *DriveFileSystem) getVersionAttr(file, version string) (*fuse.Attr,
+	fuse.Status) {
+	_, revisions, status := fs.versions(file)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	if version == "" {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	}
+
+	revision, ok := revisions[version]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return fs.revisionAttr(revision), fuse.OK
+}
+
+// openVersionsDir lists the revisions of the given file.
+func (fs *DriveFileSystem) openVersionsDir(file string) ([]fuse.DirEntry,
+	fuse.Status) {
+	_, revisions, status := fs.versions(file)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	output := make([]fuse.DirEntry, 0, len(revisions))
+	for name := range revisions {
+		output = append(output, fuse.DirEntry{
+			Name: name,
+			Mode: fuse.S_IFREG | 0444,
+		})
+	}
+
+	return output, fuse.OK
+}
+
+// openVersion opens a revision of the given file for reading. The content is
+// streamed from the remote.
+func (fs *DriveFileSystem) openVersion(name, file, version string,
+	flags uint32) (nodefs.File, fuse.Status) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, fuse.EROFS
+	}
+
+	attributes, revisions, status := fs.versions(file)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	revision, ok := revisions[version]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return NewReadOnlyDriveFile(fs.driveApi, api.DriveApiFile{
+		Name:     name,
+		Id:       attributes.Id,
+		Revision: revision.Id,
+		Size:     fs.revisionSize(revision),
+		Version:  revision.Id,
+	}, fs.revisionAttr(revision), fs.options.Keyring, fs.options.Reads), fuse.OK
+}